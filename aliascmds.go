@@ -0,0 +1,187 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/darkwyrm/anselusd/dbhandler"
+	"github.com/darkwyrm/anselusd/logging"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+// getAliasTarget returns the workspace given in the Workspace-ID field of the current request,
+// defaulting to the session's own. Working with another workspace's aliases requires the aliases
+// permission. It handles sending the appropriate message and returns an empty string if the
+// command handler should just exit.
+func getAliasTarget(session *sessionState) string {
+	if !session.Message.HasField("Workspace-ID") ||
+		session.Message.Data["Workspace-ID"] == session.WID {
+		return session.WID
+	}
+
+	wid := session.Message.Data["Workspace-ID"]
+	if !dbhandler.ValidateUUID(wid) {
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Workspace-ID")
+		return ""
+	}
+
+	if !checkPermission(session, permAliases) {
+		return ""
+	}
+
+	return wid
+}
+
+func commandAddAlias(session *sessionState) {
+	// Command syntax:
+	// ADDALIAS(Alias, Workspace-ID="")
+
+	alias := session.Message.Data["Alias"]
+	if alias == "" || len(alias) > 64 || strings.ContainsAny(alias, "/\" \t\r\n") ||
+		dbhandler.ValidateUUID(alias) {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad Alias")
+		return
+	}
+
+	target := getAliasTarget(session)
+	if target == "" {
+		return
+	}
+
+	wtype, err := dbhandler.GetWorkspaceType(target)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		return
+	}
+	switch wtype {
+	case "":
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
+	case "alias":
+		session.SendStringResponse(400, "BAD REQUEST", "Aliases can't point to other aliases")
+		return
+	}
+
+	aliases, err := dbhandler.GetAliases(target)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandAddAlias: error getting aliases: %s", err.Error())
+		return
+	}
+
+	// The limit applies to users managing their own aliases, not to administrators
+	maxAliases := viper.GetInt("security.max_aliases")
+	if target == session.WID && maxAliases > 0 && len(aliases.Items) >= maxAliases {
+		allowed, err := hasPermission(session.WID, permAliases)
+		if err != nil {
+			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			logging.Writef("commandAddAlias: error checking permission: %s", err.Error())
+			return
+		}
+		if !allowed {
+			session.SendStringResponse(409, "QUOTA INSUFFICIENT", "Too many aliases")
+			return
+		}
+	}
+
+	exists, _ := dbhandler.CheckUserID(alias)
+	if exists {
+		response := NewServerResponse(408, "RESOURCE EXISTS")
+		response.Data["Field"] = "Alias"
+		session.SendResponse(*response)
+		return
+	}
+
+	targetDomain, err := dbhandler.GetWorkspaceDomain(target)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandAddAlias: error getting workspace domain: %s", err.Error())
+		return
+	}
+
+	var aliasWid string
+	for exists = true; exists; {
+		aliasWid = uuid.New().String()
+		exists, _ = dbhandler.CheckWorkspace(aliasWid)
+	}
+
+	domain := viper.GetString("global.domain")
+	err = dbhandler.AddAlias(aliasWid, alias, domain, target, targetDomain)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandAddAlias: error adding alias: %s", err.Error())
+		return
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Address"] = alias + "/" + domain
+	response.Data["Workspace-ID"] = aliasWid
+	session.SendResponse(*response)
+}
+
+func commandListAliases(session *sessionState) {
+	// Command syntax:
+	// LISTALIASES(Workspace-ID="")
+
+	target := getAliasTarget(session)
+	if target == "" {
+		return
+	}
+
+	aliases, err := dbhandler.GetAliases(target)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandListAliases: error getting aliases: %s", err.Error())
+		return
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Aliases"] = aliases.Join(",")
+	session.SendResponse(*response)
+}
+
+func commandRemoveAlias(session *sessionState) {
+	// Command syntax:
+	// REMOVEALIAS(Alias)
+
+	// The address form is accepted, too, as long as it's for this server
+	alias := session.Message.Data["Alias"]
+	if strings.Contains(alias, "/") {
+		parts := strings.Split(alias, "/")
+		if len(parts) != 2 || !strings.EqualFold(parts[1], viper.GetString("global.domain")) {
+			session.SendStringResponse(400, "BAD REQUEST", "Bad Alias")
+			return
+		}
+		alias = parts[0]
+	}
+
+	// The built-in addresses must always exist
+	if alias == "support" || alias == "abuse" {
+		session.SendStringResponse(403, "FORBIDDEN", "Built-in aliases can't be removed")
+		return
+	}
+
+	aliasWid, target, err := dbhandler.GetAliasByUID(alias)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandRemoveAlias: error looking up alias: %s", err.Error())
+		return
+	}
+	if aliasWid == "" {
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
+	}
+
+	if target != session.WID && !checkPermission(session, permAliases) {
+		return
+	}
+
+	err = dbhandler.RemoveAlias(aliasWid)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandRemoveAlias: error removing alias: %s", err.Error())
+		return
+	}
+
+	session.SendStringResponse(200, "OK", "")
+}
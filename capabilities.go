@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// The range of protocol versions the server speaks. Clients are expected to check this in the
+// greeting before sending anything.
+const (
+	protocolMinVersion = "0.1"
+	protocolMaxVersion = "0.1"
+)
+
+// serverGreeting is sent to the client as soon as it connects. It is a regular response with the
+// server's name and newest protocol version added so that older clients can still read it.
+type serverGreeting struct {
+	Name    string
+	Version string
+	ServerResponse
+}
+
+// getCapabilities returns the protocol versions, commands, login types, and algorithms supported
+// by the server, along with its registration mode. Lists are JSON string arrays.
+func getCapabilities() map[string]string {
+	lists := map[string][]string{
+		"Commands":              getCommandNames(),
+		"Login-Types":           {"PLAIN"},
+		"Encryption-Algorithms": {"CURVE25519"},
+		"Signing-Algorithms":    {"ED25519"},
+		"Hash-Algorithms":       {"BLAKE2B-256", "SHA-256", "SHA3-256"},
+	}
+
+	out := map[string]string{
+		"Min-Version":  protocolMinVersion,
+		"Max-Version":  protocolMaxVersion,
+		"Registration": strings.ToLower(viper.GetString("global.registration")),
+	}
+	for field, list := range lists {
+		data, _ := json.Marshal(list)
+		out[field] = string(data)
+	}
+
+	return out
+}
+
+// sendGreeting sends the server greeting to a newly-connected client
+func sendGreeting(session *sessionState) error {
+	greeting := serverGreeting{"Anselus", protocolMaxVersion, *NewServerResponse(200, "OK")}
+	greeting.Data = getCapabilities()
+
+	out, err := json.Marshal(greeting)
+	if err != nil {
+		return err
+	}
+
+	_, err = session.WriteClient(string(out) + "\r\n")
+	return err
+}
+
+func commandCapabilities(session *sessionState) {
+	// Command syntax:
+	// CAPABILITIES()
+
+	response := NewServerResponse(200, "OK")
+	response.Data = getCapabilities()
+	session.SendResponse(*response)
+}
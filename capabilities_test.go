@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// checkCapabilities compares the capabilities sent by the server with the values clients expect
+func checkCapabilities(t *testing.T, data map[string]string) {
+	t.Helper()
+	expected := map[string]string{
+		"Min-Version":           "0.1",
+		"Max-Version":           "0.1",
+		"Registration":          "private",
+		"Login-Types":           `["PLAIN"]`,
+		"Encryption-Algorithms": `["CURVE25519"]`,
+		"Signing-Algorithms":    `["ED25519"]`,
+		"Hash-Algorithms":       `["BLAKE2B-256","SHA-256","SHA3-256"]`,
+	}
+	for field, value := range expected {
+		if data[field] != value {
+			t.Fatalf("%s was %q, expected %q", field, data[field], value)
+		}
+	}
+
+	var commands []string
+	err := json.Unmarshal([]byte(data["Commands"]), &commands)
+	if err != nil {
+		t.Fatalf("bad command list %q: %s", data["Commands"], err)
+	}
+	if !sort.StringsAreSorted(commands) || len(commands) != len(commandRegistry) {
+		t.Fatalf("command list didn't match the registry: %v", commands)
+	}
+	listed := make(map[string]bool, len(commands))
+	for _, name := range commands {
+		if _, exists := commandRegistry[name]; !exists {
+			t.Fatalf("command list included unknown command %s", name)
+		}
+		listed[name] = true
+	}
+	for _, name := range []string{"CAPABILITIES", "LOGIN", "UPLOAD", "DOWNLOAD", "SEND"} {
+		if !listed[name] {
+			t.Fatalf("command list was missing %s", name)
+		}
+	}
+}
+
+func TestGreeting(t *testing.T) {
+	viper.Set("global.registration", "Private")
+	session, client := newPipeSession(t)
+
+	go sendGreeting(session)
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatalf("error reading greeting: %s", err)
+	}
+
+	// Older clients read the greeting as a regular response, so the name and version have to be
+	// alongside the usual fields instead of wrapped in an object of their own
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal([]byte(line), &fields)
+	if err != nil {
+		t.Fatalf("bad greeting %q: %s", line, err)
+	}
+	for _, field := range []string{"Name", "Version", "Code", "Status", "Info", "Data"} {
+		if _, exists := fields[field]; !exists {
+			t.Fatalf("greeting was missing %s: %s", field, line)
+		}
+	}
+
+	var greeting serverGreeting
+	err = json.Unmarshal([]byte(line), &greeting)
+	if err != nil {
+		t.Fatalf("bad greeting %q: %s", line, err)
+	}
+	if greeting.Code != 200 || greeting.Status != "OK" || greeting.Name != "Anselus" ||
+		greeting.Version != "0.1" {
+		t.Fatalf("unexpected greeting: %s", line)
+	}
+	checkCapabilities(t, greeting.Data)
+}
+
+func TestCapabilities(t *testing.T) {
+	viper.Set("global.registration", "Private")
+	session, client := newPipeSession(t)
+	reader := bufio.NewReader(client)
+
+	response := runTestCommand(t, session, reader, ClientRequest{"CAPABILITIES",
+		map[string]string{}})
+	if response.Code != 200 || response.Status != "OK" {
+		t.Fatalf("CAPABILITIES returned %d %s", response.Code, response.Status)
+	}
+	checkCapabilities(t, response.Data)
+
+	// The greeting and the command report the same thing
+	if !reflect.DeepEqual(response.Data, getCapabilities()) {
+		t.Fatalf("CAPABILITIES didn't match the greeting: %v", response.Data)
+	}
+}
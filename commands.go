@@ -0,0 +1,355 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/darkwyrm/anselusd/logging"
+)
+
+// commandInfo describes a command the server handles. The requirements are checked by the
+// middleware in commandMiddleware before the handler is called, so handlers only need to check
+// things which depend on the request, such as permission to act on another workspace.
+type commandInfo struct {
+	Name    string
+	Handler func(*sessionState)
+	// The session must be logged in. This is implied by Permission.
+	Login bool
+	// Fields which must be present in the request
+	Fields []string
+	// Permission required to use the command at all
+	Permission string
+	// Which rate limit the command is subject to. Empty for none.
+	RateClass string
+}
+
+// Rate limit classes for commands
+const (
+	// Commands which check credentials
+	rateAuth = "auth"
+	// Lookups which don't require a login
+	rateLookup = "lookup"
+	// Bulk data transfers. These aren't limited, but long ones aren't logged as slow.
+	rateTransfer = "transfer"
+	// Messages handed off by other servers. These don't require a login, so unlike other
+	// transfers they are limited, and by address because a new session is easy to come by.
+	rateDelivery = "delivery"
+)
+
+// rateLimit is the number of requests a session may make in a rate limit class over a period. If
+// BySource is set, the requests are counted for the address they come from instead of the session.
+type rateLimit struct {
+	Count    int
+	Period   time.Duration
+	BySource bool
+}
+
+var rateLimits = map[string]rateLimit{
+	rateAuth:     {10, time.Minute, false},
+	rateLookup:   {120, time.Minute, false},
+	rateDelivery: {60, time.Minute, true},
+}
+
+// rateWindow tracks the number of requests a session has made in a rate limit class
+type rateWindow struct {
+	Start time.Time
+	Count int
+}
+
+// sourceRateWindows tracks requests in rate limit classes which are counted by address. The key
+// is the class and the address separated by a space.
+var (
+	sourceRateWindows = make(map[string]*rateWindow)
+	sourceRateLock    sync.Mutex
+)
+
+// slowCommandTime is how long a command may take before it is logged as slow
+const slowCommandTime = time.Second * 10
+
+// commandRegistry maps the name of each command to its description. It is filled in by init()
+// because CAPABILITIES reports its contents.
+var commandRegistry map[string]commandInfo
+
+func init() {
+	commands := []commandInfo{
+		{Name: "ADDALIAS", Handler: commandAddAlias, Login: true, Fields: []string{"Alias"}},
+		{Name: "ADDENTRY", Handler: commandAddEntry, Login: true, Fields: []string{"Base-Entry"}},
+		{Name: "ADDMEMBER", Handler: commandAddMember, Login: true},
+		{Name: "CANCEL", Handler: commandCancel},
+		{Name: "CAPABILITIES", Handler: commandCapabilities},
+		{Name: "COPY", Handler: commandCopy, Login: true, Fields: []string{"SourceFile", "DestDir"}},
+		{Name: "DELETE", Handler: commandDelete, Login: true, Fields: []string{"Path"}},
+		{Name: "DELIVER", Handler: commandDeliver, RateClass: rateDelivery,
+			Fields: []string{"Size", "Hash", "Recipients", "Sender-Domain"}},
+		{Name: "DEVAPPROVE", Handler: commandDevApprove, Login: true, Fields: []string{"Device-ID"}},
+		{Name: "DEVDENY", Handler: commandDevDeny, Login: true, Fields: []string{"Device-ID"}},
+		{Name: "DEVICE", Handler: commandDevice, RateClass: rateAuth,
+			Fields: []string{"Device-ID", "Device-Key"}},
+		{Name: "DEVKEY", Handler: commandDevKey, Login: true,
+			Fields: []string{"Device-ID", "Old-Key", "New-Key"}},
+		{Name: "DEVLIST", Handler: commandDevList, Login: true},
+		{Name: "DEVRENAME", Handler: commandDevRename, Login: true,
+			Fields: []string{"Device-ID", "Name"}},
+		{Name: "DEVREVOKE", Handler: commandDevRevoke, Login: true, Fields: []string{"Device-ID"}},
+		{Name: "DOWNLOAD", Handler: commandDownload, Login: true, Fields: []string{"Path"},
+			RateClass: rateTransfer},
+		{Name: "EXISTS", Handler: commandExists, Login: true, Fields: []string{"Path"}},
+		{Name: "GETWID", Handler: commandGetWID, Fields: []string{"User-ID"}, RateClass: rateLookup},
+		{Name: "GRANTROLE", Handler: commandGrantRole, Permission: permRoles},
+		{Name: "ISCURRENT", Handler: commandIsCurrent, Fields: []string{"Index"},
+			RateClass: rateLookup},
+		{Name: "LIST", Handler: commandList, Login: true},
+		{Name: "LISTALIASES", Handler: commandListAliases, Login: true},
+		{Name: "LISTDIRS", Handler: commandListDirs, Login: true},
+		{Name: "LISTEXPIRING", Handler: commandListExpiring, Permission: permKeycards},
+		{Name: "LISTMEMBERS", Handler: commandListMembers, Login: true},
+		{Name: "LISTROLES", Handler: commandListRoles, Login: true},
+		{Name: "LOGIN", Handler: commandLogin, RateClass: rateAuth,
+			Fields: []string{"Login-Type", "Workspace-ID", "Challenge"}},
+		{Name: "LOGOUT", Handler: commandLogout},
+		{Name: "MKDIR", Handler: commandMkDir, Login: true, Fields: []string{"Path"}},
+		{Name: "MOVE", Handler: commandMove, Login: true, Fields: []string{"SourceFile", "DestDir"}},
+		// NOOP does nothing. It just resets the idle counter.
+		{Name: "NOOP", Handler: func(*sessionState) {}},
+		{Name: "ORGCARD", Handler: commandOrgCard, Fields: []string{"Start-Index"},
+			RateClass: rateLookup},
+		{Name: "ORGROTATE", Handler: commandOrgRotate, Permission: permOrgKeys},
+		{Name: "PASSCODE", Handler: commandPasscode, RateClass: rateAuth,
+			Fields: []string{"Workspace-ID", "Reset-Code", "Password-Hash"}},
+		{Name: "PASSWORD", Handler: commandPassword, Fields: []string{"Password-Hash"},
+			RateClass: rateAuth},
+		{Name: "PREREG", Handler: commandPreregister, Permission: permPreregister},
+		{Name: "PWD", Handler: commandPwd, Login: true},
+		{Name: "REGAPPROVE", Handler: commandRegApprove, Permission: permRegistration},
+		{Name: "REGCODE", Handler: commandRegCode, RateClass: rateAuth,
+			Fields: []string{"Reg-Code", "Password-Hash", "Device-ID", "Device-Key"}},
+		// The required fields for REGISTER depend on the type of workspace
+		{Name: "REGISTER", Handler: commandRegister, RateClass: rateAuth},
+		{Name: "REGLIST", Handler: commandRegList, Permission: permRegistration},
+		{Name: "REGREJECT", Handler: commandRegReject, Permission: permRegistration},
+		{Name: "REMOVEALIAS", Handler: commandRemoveAlias, Login: true, Fields: []string{"Alias"}},
+		{Name: "REMOVEMEMBER", Handler: commandRemoveMember, Login: true},
+		{Name: "RESETPASSWORD", Handler: commandResetPassword, Permission: permResetPassword,
+			Fields: []string{"Workspace-ID"}},
+		{Name: "REVOKEENTRY", Handler: commandRevokeEntry, Permission: permKeycards,
+			Fields: []string{"Workspace-ID"}},
+		{Name: "REVOKEROLE", Handler: commandRevokeRole, Permission: permRoles},
+		{Name: "RMDIR", Handler: commandRmDir, Login: true, Fields: []string{"Path", "Recursive"}},
+		{Name: "SELECT", Handler: commandSelect, Login: true, Fields: []string{"Path"}},
+		{Name: "SEND", Handler: commandSend, Login: true, RateClass: rateTransfer,
+			Fields: []string{"Size", "Hash", "Recipients"}},
+		{Name: "SETPASSWORD", Handler: commandSetPassword, Login: true, RateClass: rateAuth,
+			Fields: []string{"Password-Hash", "NewPassword-Hash"}},
+		{Name: "SETROOT", Handler: commandSetRoot, Login: true, Fields: []string{"Workspace-ID"}},
+		{Name: "SETSTATUS", Handler: commandSetStatus, Permission: permSetStatus,
+			Fields: []string{"Workspace-ID", "Status"}},
+		{Name: "UNREGAPPROVE", Handler: commandUnregApprove, Permission: permUnregister},
+		{Name: "UNREGDECLINE", Handler: commandUnregDecline, Permission: permUnregister},
+		{Name: "UNREGISTER", Handler: commandUnregister, Login: true,
+			Fields: []string{"Password-Hash"}},
+		{Name: "UNREGLIST", Handler: commandUnregList, Permission: permUnregister},
+		{Name: "UPLOAD", Handler: commandUpload, Login: true, Fields: []string{"Size", "Hash"},
+			RateClass: rateTransfer},
+		{Name: "USERCARD", Handler: commandUserCard, Fields: []string{"Owner", "Start-Index"},
+			RateClass: rateLookup},
+	}
+
+	commandRegistry = make(map[string]commandInfo, len(commands))
+	for _, cmd := range commands {
+		commandRegistry[cmd.Name] = cmd
+	}
+}
+
+// getCommandNames returns the names of all registered commands in alphabetical order
+func getCommandNames() []string {
+	out := make([]string, 0, len(commandRegistry))
+	for name := range commandRegistry {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// commandFunc is a step in handling a command. The last one in the chain calls the handler.
+type commandFunc func(session *sessionState, cmd *commandInfo)
+
+// commandMiddleware wraps a commandFunc. A middleware function which rejects a request sends the
+// response itself and doesn't call next.
+type commandMiddleware func(next commandFunc) commandFunc
+
+// commandPipeline is the middleware applied to every command, outermost first
+var commandPipeline = []commandMiddleware{
+	recordCommand,
+	limitRate,
+	requireLogin,
+	requirePermission,
+	requireFields,
+}
+
+func processCommand(session *sessionState) {
+	cmd, exists := commandRegistry[session.Message.Action]
+	if !exists {
+		commandUnrecognized(session)
+		return
+	}
+
+	run := func(session *sessionState, cmd *commandInfo) {
+		cmd.Handler(session)
+	}
+	for i := len(commandPipeline) - 1; i >= 0; i-- {
+		run = commandPipeline[i](run)
+	}
+	run(session, &cmd)
+}
+
+// commandStats holds usage statistics for a command
+type commandStats struct {
+	Count   int
+	Total   time.Duration
+	Longest time.Duration
+}
+
+var commandStatsLock = &sync.Mutex{}
+var commandStatsList = make(map[string]*commandStats)
+
+// recordCommand adds the time taken by a command to its statistics and logs it if it was slow
+func recordCommand(next commandFunc) commandFunc {
+	return func(session *sessionState, cmd *commandInfo) {
+		start := time.Now()
+		next(session, cmd)
+		elapsed := time.Since(start)
+
+		commandStatsLock.Lock()
+		stats, exists := commandStatsList[cmd.Name]
+		if !exists {
+			stats = &commandStats{}
+			commandStatsList[cmd.Name] = stats
+		}
+		stats.Count++
+		stats.Total += elapsed
+		if elapsed > stats.Longest {
+			stats.Longest = elapsed
+		}
+		commandStatsLock.Unlock()
+
+		if elapsed > slowCommandTime && cmd.RateClass != rateTransfer &&
+			cmd.RateClass != rateDelivery {
+			logging.Writef("Slow command: %s took %s for session %s", cmd.Name,
+				elapsed.Round(time.Millisecond), session.ID)
+		}
+	}
+}
+
+// logCommandStats writes the usage statistics for each command used since the server started
+func logCommandStats() {
+	commandStatsLock.Lock()
+	defer commandStatsLock.Unlock()
+
+	names := make([]string, 0, len(commandStatsList))
+	for name := range commandStatsList {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		stats := commandStatsList[name]
+		logging.Writef("Command stats: %s count %d, average %s, longest %s", name, stats.Count,
+			(stats.Total / time.Duration(stats.Count)).Round(time.Millisecond),
+			stats.Longest.Round(time.Millisecond))
+	}
+}
+
+// limitRate rejects requests from sessions which have used too many commands in the rate limit
+// class of the command
+func limitRate(next commandFunc) commandFunc {
+	return func(session *sessionState, cmd *commandInfo) {
+		limit, exists := rateLimits[cmd.RateClass]
+		if !exists {
+			next(session, cmd)
+			return
+		}
+
+		var count int
+		requester := "Session " + session.ID
+		if limit.BySource {
+			source := getFailureSource(session)
+			requester = "Address " + source
+
+			sourceRateLock.Lock()
+			count = countRequest(sourceRateWindows, cmd.RateClass+" "+source, limit)
+			sourceRateLock.Unlock()
+		} else {
+			if session.RateWindows == nil {
+				session.RateWindows = make(map[string]*rateWindow)
+			}
+			count = countRequest(session.RateWindows, cmd.RateClass, limit)
+		}
+
+		if count > limit.Count {
+			if count == limit.Count+1 {
+				logging.Writef("%s exceeded the %s rate limit", requester, cmd.RateClass)
+			}
+			session.SendStringResponse(407, "UNAVAILABLE", "Too many requests")
+			return
+		}
+
+		next(session, cmd)
+	}
+}
+
+// countRequest adds a request to the window for a rate limit class in a set of windows and
+// returns the number of requests made in it so far. Windows which have ended are replaced.
+func countRequest(windows map[string]*rateWindow, key string, limit rateLimit) int {
+	window, exists := windows[key]
+	if !exists || time.Since(window.Start) > limit.Period {
+		// Windows which ended long ago are also cleared out of the set now and then so that it
+		// doesn't keep growing with addresses which have gone away
+		if !exists && len(windows) >= 1024 {
+			for oldKey, oldWindow := range windows {
+				if time.Since(oldWindow.Start) > time.Hour {
+					delete(windows, oldKey)
+				}
+			}
+		}
+		window = &rateWindow{time.Now(), 0}
+		windows[key] = window
+	}
+
+	window.Count++
+	return window.Count
+}
+
+// requireLogin rejects requests for commands which need a login from sessions which aren't
+// logged in
+func requireLogin(next commandFunc) commandFunc {
+	return func(session *sessionState, cmd *commandInfo) {
+		if cmd.Login && session.LoginState != loginClientSession {
+			session.SendStringResponse(401, "UNAUTHORIZED", "Login required")
+			return
+		}
+		next(session, cmd)
+	}
+}
+
+// requirePermission rejects requests for commands which need a permission the session's workspace
+// doesn't have
+func requirePermission(next commandFunc) commandFunc {
+	return func(session *sessionState, cmd *commandInfo) {
+		if cmd.Permission != "" && !checkPermission(session, cmd.Permission) {
+			return
+		}
+		next(session, cmd)
+	}
+}
+
+// requireFields rejects requests which are missing any of the command's required fields
+func requireFields(next commandFunc) commandFunc {
+	return func(session *sessionState, cmd *commandInfo) {
+		if session.Message.Validate(cmd.Fields) != nil {
+			session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+			return
+		}
+		next(session, cmd)
+	}
+}
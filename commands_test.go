@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/darkwyrm/anselusd/logging"
+)
+
+// rateTest is a rate limit class used only by the tests
+const rateTest = "test"
+
+// addTestCommand registers a command for testing the middleware. Its handler just counts the
+// number of times it is called and responds with 200 OK. The command is removed when the test
+// finishes.
+func addTestCommand(t *testing.T, cmd commandInfo) *int {
+	calls := new(int)
+	cmd.Handler = func(session *sessionState) {
+		*calls++
+		session.SendStringResponse(200, "OK", "")
+	}
+	commandRegistry[cmd.Name] = cmd
+	t.Cleanup(func() {
+		delete(commandRegistry, cmd.Name)
+		commandStatsLock.Lock()
+		delete(commandStatsList, cmd.Name)
+		commandStatsLock.Unlock()
+	})
+	return calls
+}
+
+// runTestCommand handles a request with the command pipeline and returns the response sent
+func runTestCommand(t *testing.T, session *sessionState, reader *bufio.Reader,
+	request ClientRequest) ServerResponse {
+	t.Helper()
+	session.Message = request
+	done := make(chan bool)
+	go func() {
+		processCommand(session)
+		close(done)
+	}()
+	response := readTestResponse(t, reader)
+	<-done
+	return response
+}
+
+func TestRequireLogin(t *testing.T) {
+	session, client := newPipeSession(t)
+	reader := bufio.NewReader(client)
+	calls := addTestCommand(t, commandInfo{Name: "TESTLOGIN", Login: true,
+		Fields: []string{"Path"}})
+
+	// The login is checked before the fields
+	response := runTestCommand(t, session, reader, ClientRequest{"TESTLOGIN", map[string]string{}})
+	if response.Code != 401 || *calls != 0 {
+		t.Fatalf("command needing a login got %d with %d calls", response.Code, *calls)
+	}
+
+	session.LoginState = loginClientSession
+	response = runTestCommand(t, session, reader, ClientRequest{"TESTLOGIN", map[string]string{}})
+	if response.Code != 400 || *calls != 0 {
+		t.Fatalf("command missing a field got %d with %d calls", response.Code, *calls)
+	}
+
+	response = runTestCommand(t, session, reader,
+		ClientRequest{"TESTLOGIN", map[string]string{"Path": "/"}})
+	if response.Code != 200 || *calls != 1 {
+		t.Fatalf("valid command got %d with %d calls", response.Code, *calls)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	session, client := newPipeSession(t)
+	reader := bufio.NewReader(client)
+	calls := addTestCommand(t, commandInfo{Name: "TESTPERM", Permission: permRoles,
+		Fields: []string{"Workspace-ID"}})
+
+	// Commands needing a permission also need a login, which is checked before the fields.
+	// Sessions which are logged in but lack the permission are covered by the integration tests
+	// because checking requires the database.
+	response := runTestCommand(t, session, reader, ClientRequest{"TESTPERM", map[string]string{}})
+	if response.Code != 401 || *calls != 0 {
+		t.Fatalf("command needing a permission got %d with %d calls", response.Code, *calls)
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	logging.Init(filepath.Join(t.TempDir(), "anselusd.log"), false)
+	rateLimits[rateTest] = rateLimit{3, time.Minute, false}
+	defer delete(rateLimits, rateTest)
+
+	session, client := newPipeSession(t)
+	session.ID = "rate-test"
+	reader := bufio.NewReader(client)
+	calls := addTestCommand(t, commandInfo{Name: "TESTRATE", Login: true, RateClass: rateTest})
+	otherCalls := addTestCommand(t, commandInfo{Name: "TESTOTHER"})
+
+	// The limit is applied before anything else so that clients can't keep trying to log in
+	request := ClientRequest{"TESTRATE", map[string]string{}}
+	for i := 1; i <= 3; i++ {
+		response := runTestCommand(t, session, reader, request)
+		if response.Code != 401 {
+			t.Fatalf("request #%d within the limit got %d", i, response.Code)
+		}
+	}
+
+	response := runTestCommand(t, session, reader, request)
+	if response.Code != 407 || *calls != 0 {
+		t.Fatalf("request over the limit got %d with %d calls", response.Code, *calls)
+	}
+
+	// Commands in other classes aren't affected
+	response = runTestCommand(t, session, reader, ClientRequest{"TESTOTHER", map[string]string{}})
+	if response.Code != 200 || *otherCalls != 1 {
+		t.Fatalf("command without a rate limit got %d with %d calls", response.Code,
+			*otherCalls)
+	}
+
+	// The count starts over once the period has passed
+	session.RateWindows[rateTest].Start = time.Now().Add(-time.Minute * 2)
+	response = runTestCommand(t, session, reader, request)
+	if response.Code != 401 {
+		t.Fatalf("request in a new period got %d", response.Code)
+	}
+
+	// Rejected requests still count in the command's statistics
+	commandStatsLock.Lock()
+	count := commandStatsList["TESTRATE"].Count
+	commandStatsLock.Unlock()
+	if count != 5 {
+		t.Fatalf("command statistics recorded %d uses instead of 5", count)
+	}
+}
+
+func TestLimitRateBySource(t *testing.T) {
+	logging.Init(filepath.Join(t.TempDir(), "anselusd.log"), false)
+	rateLimits[rateTest] = rateLimit{2, time.Minute, true}
+	defer delete(rateLimits, rateTest)
+	defer func() {
+		sourceRateLock.Lock()
+		sourceRateWindows = make(map[string]*rateWindow)
+		sourceRateLock.Unlock()
+	}()
+	calls := addTestCommand(t, commandInfo{Name: "TESTSOURCE", RateClass: rateTest})
+
+	newSession := func(address string) (*sessionState, *bufio.Reader) {
+		session, client := newPipeSession(t)
+		session.Connection = addrConn{session.Connection,
+			&net.TCPAddr{IP: net.ParseIP(address), Port: 2001}}
+		return session, bufio.NewReader(client)
+	}
+
+	request := ClientRequest{"TESTSOURCE", map[string]string{}}
+	session, reader := newSession("192.0.2.1")
+	for i := 1; i <= 2; i++ {
+		response := runTestCommand(t, session, reader, request)
+		if response.Code != 200 {
+			t.Fatalf("request #%d within the limit got %d", i, response.Code)
+		}
+	}
+
+	// Starting a new session from the same address doesn't start the count over
+	session, reader = newSession("192.0.2.1")
+	response := runTestCommand(t, session, reader, request)
+	if response.Code != 407 || *calls != 2 {
+		t.Fatalf("request over the limit from a new session got %d with %d calls",
+			response.Code, *calls)
+	}
+
+	session, reader = newSession("192.0.2.2")
+	response = runTestCommand(t, session, reader, request)
+	if response.Code != 200 || *calls != 3 {
+		t.Fatalf("request from another address got %d with %d calls", response.Code, *calls)
+	}
+}
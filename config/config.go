@@ -2,10 +2,12 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strings"
 
 	"github.com/darkwyrm/anselusd/logging"
 	"github.com/everlastingbeta/diceware"
@@ -41,6 +43,9 @@ func SetupConfig() diceware.Wordlist {
 	viper.SetDefault("network.listen_ip", "127.0.0.1")
 	viper.SetDefault("network.port", "2001")
 
+	// Number of seconds to wait for sessions to finish what they're doing when shutting down
+	viper.SetDefault("network.shutdown_drain_sec", 30)
+
 	// Database config
 	viper.SetDefault("database.engine", "postgresql")
 	viper.SetDefault("database.ip", "127.0.0.1")
@@ -71,6 +76,16 @@ func SetupConfig() diceware.Wordlist {
 		viper.AddConfigPath("/etc/anselusd/")
 	}
 
+	// Storage backend for workspace data. 'local' keeps it under workspace_dir. 's3' keeps it in
+	// a bucket on an S3-compatible object storage service. Uploads are staged in workspace_dir
+	// either way.
+	viper.SetDefault("storage.provider", "local")
+	viper.SetDefault("storage.s3_endpoint", "")
+	viper.SetDefault("storage.s3_region", "us-east-1")
+	viper.SetDefault("storage.s3_bucket", "anselus")
+	viper.SetDefault("storage.s3_access_key", "")
+	viper.SetDefault("storage.s3_secret_key", "")
+
 	// Account registration modes
 	// public - Outside registration requests.
 	// network - registration is public, but restricted to a subnet or single IP address
@@ -82,11 +97,14 @@ func SetupConfig() diceware.Wordlist {
 	// Subnet(s) used for network registration. Defaults to private networks only.
 	viper.SetDefault("global.registration_subnet",
 		"192.168.0.0/16, 172.16.0.0/12, 10.0.0.0/8, 127.0.0.1/8")
-	viper.SetDefault("global.registration_subnet6", "fe80::/10")
+	viper.SetDefault("global.registration_subnet6", "fe80::/10, fc00::/7, ::1/128")
 
 	// Default user workspace quota in MiB. 0 = no quota
 	viper.SetDefault("global.default_quota", 0)
 
+	// Largest message in MiB which can be sent or delivered to the server
+	viper.SetDefault("global.max_message_size", 32)
+
 	// Diceware settings for registration code and password reset code generation
 	viper.SetDefault("security.diceware_wordlist", "eff_short_prefix")
 	viper.SetDefault("security.diceware_wordcount", 6)
@@ -107,9 +125,39 @@ func SetupConfig() diceware.Wordlist {
 	// Default expiration time for password resets
 	viper.SetDefault("security.password_reset_min", 60)
 
+	// Maximum number of files a session may have open at once. 0 = no limit
+	viper.SetDefault("security.max_open_files", 16)
+
+	// Maximum number of aliases a user may create for their own workspace. 0 = no limit
+	viper.SetDefault("security.max_aliases", 5)
+
+	// Number of hours a replaced organization encryption key can still be used to decrypt login
+	// challenges after the organization's keys are rotated
+	viper.SetDefault("security.org_key_grace_hours", 24)
+
 	// Resource usage for password hashing
 	viper.SetDefault("security.password_security", "normal")
 
+	// Outbound delivery of messages to other servers. Failed attempts are retried with a delay
+	// which starts at one minute and doubles up to max_retry_min. Messages which can't be
+	// delivered within max_age_hours are dropped. servers is a comma-separated list of
+	// domain=host:port pairs which override DNS lookups.
+	viper.SetDefault("delivery.poll_sec", 30)
+	viper.SetDefault("delivery.max_retry_min", 240)
+	viper.SetDefault("delivery.max_age_hours", 72)
+	viper.SetDefault("delivery.servers", "")
+
+	// Monitoring of keycard expiration. Current entries are checked every check_hours hours and
+	// the owners of those which expire within warn_days days are notified.
+	viper.SetDefault("keycards.check_hours", 12)
+	viper.SetDefault("keycards.warn_days", 14)
+
+	// The location of the config file can be overridden with an environment variable, which makes
+	// it possible to run more than one instance on the same host.
+	if configFile, exists := os.LookupEnv("ANSELUSD_CONFIG"); exists {
+		viper.SetConfigFile(configFile)
+	}
+
 	// Read the config file
 	err := viper.ReadInConfig()
 	if err != nil {
@@ -173,6 +221,25 @@ func SetupConfig() diceware.Wordlist {
 		os.Exit(1)
 	}
 
+	checkSubnets("global.registration_subnet", true)
+	checkSubnets("global.registration_subnet6", false)
+
+	switch viper.GetString("storage.provider") {
+	case "local":
+		// Do nothing. Legitimate value.
+	case "s3":
+		if viper.GetString("storage.s3_endpoint") == "" ||
+			viper.GetString("storage.s3_bucket") == "" {
+			logging.Write("S3 storage requires s3_endpoint and s3_bucket in config file. Exiting.")
+			logging.Shutdown()
+			os.Exit(1)
+		}
+	default:
+		logging.Write("Invalid storage provider in config file. Exiting.")
+		logging.Shutdown()
+		os.Exit(1)
+	}
+
 	switch viper.GetString("security.diceware_wordlist") {
 	case "eff_short":
 		outList = wordlist.EFFShort
@@ -194,11 +261,61 @@ func SetupConfig() diceware.Wordlist {
 		logging.Write("Registration wordcount out of bounds in config file. Assuming 6.")
 	}
 
+	if viper.GetInt("security.max_open_files") < 0 {
+		viper.Set("security.max_open_files", 0)
+		logging.Write("Negative open file limit in config file. Assuming zero.")
+	}
+
+	if viper.GetInt("security.max_aliases") < 0 {
+		viper.Set("security.max_aliases", 0)
+		logging.Write("Negative alias limit in config file. Assuming zero.")
+	}
+
+	if viper.GetInt("security.org_key_grace_hours") < 0 {
+		viper.Set("security.org_key_grace_hours", 0)
+		logging.Write("Negative org key grace period in config file. Assuming zero.")
+	}
+
+	if viper.GetInt("delivery.poll_sec") < 1 {
+		viper.Set("delivery.poll_sec", 30)
+		logging.Write("Invalid delivery poll interval in config file. Assuming 30.")
+	}
+
+	if viper.GetInt("delivery.max_retry_min") < 1 {
+		viper.Set("delivery.max_retry_min", 240)
+		logging.Write("Invalid delivery retry delay in config file. Assuming 240.")
+	}
+
+	if viper.GetInt("delivery.max_age_hours") < 1 {
+		viper.Set("delivery.max_age_hours", 72)
+		logging.Write("Invalid delivery max age in config file. Assuming 72.")
+	}
+
+	if viper.GetInt("network.shutdown_drain_sec") < 0 {
+		viper.Set("network.shutdown_drain_sec", 0)
+		logging.Write("Negative shutdown drain period in config file. Assuming zero.")
+	}
+
+	if viper.GetInt("keycards.check_hours") < 1 {
+		viper.Set("keycards.check_hours", 12)
+		logging.Write("Invalid keycard check interval in config file. Assuming 12.")
+	}
+
+	if viper.GetInt("keycards.warn_days") < 1 {
+		viper.Set("keycards.warn_days", 14)
+		logging.Write("Invalid keycard expiration warning period in config file. Assuming 14.")
+	}
+
 	if viper.GetInt("global.default_quota") < 0 {
 		viper.Set("global.default_quota", 0)
 		logging.Write("Negative quota value in config file. Assuming zero.")
 	}
 
+	if viper.GetInt("global.max_message_size") < 1 {
+		viper.Set("global.max_message_size", 32)
+		logging.Write("Invalid maximum message size in config file. Assuming 32.")
+	}
+
 	if viper.GetInt("security.failure_delay_sec") > 60 {
 		viper.Set("security.failure_delay_sec", 60)
 		logging.Write("Limiting maximum failure delay to 60.")
@@ -232,3 +349,21 @@ func SetupConfig() diceware.Wordlist {
 
 	return outList
 }
+
+// checkSubnets exits if the comma-separated list of subnets in the specified config setting
+// contains anything other than IPv4 or IPv6 subnets in CIDR notation, as requested
+func checkSubnets(key string, isV4 bool) {
+	for _, part := range strings.Split(viper.GetString(key), ",") {
+		netstring := strings.TrimSpace(part)
+		if netstring == "" {
+			continue
+		}
+
+		ip, _, err := net.ParseCIDR(netstring)
+		if err != nil || (ip.To4() != nil) != isV4 {
+			logging.Writef("Invalid subnet %s for %s in config file. Exiting.", netstring, key)
+			logging.Shutdown()
+			os.Exit(1)
+		}
+	}
+}
@@ -189,7 +189,8 @@ func GetAnselusAddressType(addr string) int {
 	return 2
 }
 
-// ResolveAddress returns the WID corresponding to an Anselus address.
+// ResolveAddress returns the WID corresponding to an Anselus address. Aliases are resolved to the
+// workspace they point to.
 func ResolveAddress(addr string) (string, error) {
 	parts := strings.Split(addr, "/")
 	if len(parts) != 2 {
@@ -202,46 +203,22 @@ func ResolveAddress(addr string) (string, error) {
 		return "", errors.New("invalid domain")
 	}
 
-	// Is this a workspace address?
-	isWid := ValidateUUID(parts[0])
-
 	pattern = regexp.MustCompile("[\\\"]|[[:space:]]")
 	if pattern.MatchString(parts[0]) {
 		return "", errors.New("invalid user id")
 	}
 
-	if isWid {
-		// If the address is a workspace address, then all we have to do is confirm that the
-		// workspace exists -- workspace IDs are unique across an organization, not just a domain
-		row := dbConn.QueryRow(`SELECT wtype FROM workspaces WHERE wid=$1`, parts[0])
-		var wtype string
-		err := row.Scan(&wtype)
-
-		if err != nil {
-			if err == sql.ErrNoRows {
-				// No entry in the table
-				return "", errors.New("workspace not found")
-			}
-			return "", err
-		}
-
-		if wtype == "alias" {
-			row := dbConn.QueryRow(`SELECT wid FROM aliases WHERE wid=$1`, parts[0])
-			var targetAddr string
-			err := row.Scan(&targetAddr)
-			if err != nil {
-				return "", err
-			}
-
-			return targetAddr, nil
-		}
-		return addr, nil
+	// Workspace IDs are unique across an organization, not just a domain, so a workspace address
+	// only requires confirming that the workspace exists
+	var row *sql.Row
+	if ValidateUUID(parts[0]) {
+		row = dbConn.QueryRow(`SELECT wid,wtype FROM workspaces WHERE wid=$1`, parts[0])
+	} else {
+		row = dbConn.QueryRow(`SELECT wid,wtype FROM workspaces WHERE uid=$1`, parts[0])
 	}
 
-	row := dbConn.QueryRow(`SELECT wid,domain FROM workspaces WHERE uid=$1`, parts[0])
-	var wid, domain string
-
-	err := row.Scan(&wid, &domain)
+	var wid, wtype string
+	err := row.Scan(&wid, &wtype)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			// No entry in the table
@@ -249,7 +226,11 @@ func ResolveAddress(addr string) (string, error) {
 		}
 		return "", err
 	}
+	wid = strings.TrimSpace(wid)
 
+	if wtype == "alias" {
+		return GetAliasTarget(wid)
+	}
 	return wid, nil
 }
 
@@ -421,19 +402,92 @@ func AddDevice(wid string, devid string, devkey cryptostring.CryptoString, statu
 	return nil
 }
 
-// RemoveDevice removes a session string for a workspace. It returns true if successful and false
+// RemoveDevice removes a device from a workspace. It returns true if successful and false
 // if not.
 func RemoveDevice(wid string, devid string) (bool, error) {
-	if len(devid) != 40 {
-		return false, errors.New("invalid session string")
+	if !ValidateUUID(devid) {
+		return false, errors.New("invalid device ID")
 	}
 	_, err := dbConn.Exec(`DELETE FROM iwkspc_devices WHERE wid=$1 AND devid=$2`, wid, devid)
 	if err != nil {
-		return false, nil
+		return false, err
 	}
 	return true, nil
 }
 
+// AddDeviceRequest records a device which is awaiting approval from one of the workspace's
+// active devices along with the address it connected from
+func AddDeviceRequest(wid string, devid string, devkey cryptostring.CryptoString,
+	source string) error {
+	_, err := dbConn.Exec(`INSERT INTO iwkspc_devices(wid, devid, devkey, status, source) `+
+		`VALUES($1, $2, $3, 'pending', $4)`, wid, devid, devkey.AsString(), source)
+	return err
+}
+
+// GetDeviceRequest checks for a pending request for a device and returns the address it
+// connected from
+func GetDeviceRequest(wid string, devid string) (bool, string, error) {
+	row := dbConn.QueryRow(`SELECT source FROM iwkspc_devices WHERE wid=$1 AND devid=$2 AND 
+		status='pending'`, wid, devid)
+
+	var source sql.NullString
+	err := row.Scan(&source)
+
+	switch err {
+	case sql.ErrNoRows:
+		return false, "", nil
+	case nil:
+		return true, source.String, nil
+	default:
+		return false, "", err
+	}
+}
+
+// GetDeviceStatus returns the status of a device with the specified key. An empty string is
+// returned if there is no match.
+func GetDeviceStatus(wid string, devid string, devkey string) (string, error) {
+	row := dbConn.QueryRow(`SELECT status FROM iwkspc_devices WHERE wid=$1 AND 
+		devid=$2 AND devkey=$3`, wid, devid, devkey)
+
+	var status string
+	err := row.Scan(&status)
+
+	switch err {
+	case sql.ErrNoRows:
+		return "", nil
+	case nil:
+		return status, nil
+	default:
+		return "", err
+	}
+}
+
+// ApproveDeviceRequest activates a device which is awaiting approval. Devices which are already
+// active are not touched.
+func ApproveDeviceRequest(wid string, devid string) error {
+	_, err := dbConn.Exec(`UPDATE iwkspc_devices SET status='active' WHERE wid=$1 AND devid=$2 
+		AND status='pending'`, wid, devid)
+	return err
+}
+
+// RemoveDeviceRequest removes a device which is awaiting approval. Devices which are already
+// active are not touched.
+func RemoveDeviceRequest(wid string, devid string) error {
+	_, err := dbConn.Exec(`DELETE FROM iwkspc_devices WHERE wid=$1 AND devid=$2 AND 
+		status='pending'`, wid, devid)
+	return err
+}
+
+// CountDevices returns the number of devices in a workspace which have the specified status
+func CountDevices(wid string, status string) (int, error) {
+	row := dbConn.QueryRow(`SELECT COUNT(*) FROM iwkspc_devices WHERE wid=$1 AND status=$2`,
+		wid, status)
+
+	var count int
+	err := row.Scan(&count)
+	return count, err
+}
+
 // CheckDevice checks a session string on a workspace and returns true or false if there is a match.
 func CheckDevice(wid string, devid string, devkey string) (bool, error) {
 	row := dbConn.QueryRow(`SELECT status FROM iwkspc_devices WHERE wid=$1 AND 
@@ -452,6 +506,17 @@ func CheckDevice(wid string, devid string, devkey string) (bool, error) {
 	}
 }
 
+// CheckDeviceID returns true if a workspace has a device with the specified ID, regardless of its
+// key or status
+func CheckDeviceID(wid string, devid string) (bool, error) {
+	row := dbConn.QueryRow(`SELECT EXISTS(SELECT 1 FROM iwkspc_devices WHERE wid=$1 AND 
+		devid=$2)`, wid, devid)
+
+	var exists bool
+	err := row.Scan(&exists)
+	return exists, err
+}
+
 // UpdateDevice replaces a device's old key with a new one
 func UpdateDevice(wid string, devid string, oldkey string, newkey string) error {
 	_, err := dbConn.Exec(`UPDATE iwkspc_devices SET devkey=$1 WHERE wid=$2 AND 
@@ -460,10 +525,66 @@ func UpdateDevice(wid string, devid string, oldkey string, newkey string) error
 	return err
 }
 
+// DeviceInfo holds the information about a device which is shown to its owner
+type DeviceInfo struct {
+	ID       string
+	Label    string
+	Status   string
+	LastSeen string
+}
+
+// GetDevices returns information about all of a workspace's devices. LastSeen is empty for
+// devices which have never logged in.
+func GetDevices(wid string) ([]DeviceInfo, error) {
+	rows, err := dbConn.Query(`SELECT devid, label, status, lastseen FROM iwkspc_devices
+		WHERE wid=$1 ORDER BY rowid`, wid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]DeviceInfo, 0)
+	for rows.Next() {
+		var info DeviceInfo
+		var label sql.NullString
+		var lastSeen sql.NullTime
+		err = rows.Scan(&info.ID, &label, &info.Status, &lastSeen)
+		if err != nil {
+			return nil, err
+		}
+		info.ID = strings.TrimSpace(info.ID)
+		info.Label = label.String
+		if lastSeen.Valid {
+			info.LastSeen = lastSeen.Time.UTC().Format("20060102T150405Z")
+		}
+		out = append(out, info)
+	}
+
+	return out, rows.Err()
+}
+
+// SetDeviceLabel changes the name of a device. It returns false if the device doesn't exist.
+func SetDeviceLabel(wid string, devid string, label string) (bool, error) {
+	result, err := dbConn.Exec(`UPDATE iwkspc_devices SET label=$1 WHERE wid=$2 AND devid=$3`,
+		label, wid, devid)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+// UpdateDeviceLastSeen records that a device has just logged in
+func UpdateDeviceLastSeen(wid string, devid string) error {
+	_, err := dbConn.Exec(`UPDATE iwkspc_devices SET lastseen=$1 WHERE wid=$2 AND devid=$3`,
+		time.Now().UTC().Format(time.RFC3339), wid, devid)
+	return err
+}
+
 // AddWorkspace is used for adding a workspace to a server. Upon failure, it returns the error
 // state for the failure. It makes the necessary database modifications and creates the folder for
-// the workspace in the filesystem. Note that this function is strictly for adding workspaces for
-// individuals. Shared workspaces are not yet supported/implemented. Status may be 'active',
+// the workspace in the filesystem. Type may be 'individual' or 'shared'. Status may be 'active',
 // 'pending', or 'disabled'.
 func AddWorkspace(wid string, uid string, domain string, password string, status string,
 	wtype string) error {
@@ -485,6 +606,15 @@ func RemoveWorkspace(wid string) error {
 	var sqlCommands = []string{
 		`UPDATE workspaces SET password='-',status='deleted' WHERE wid=$1`,
 		`DELETE FROM iwkspc_folders WHERE wid=$1`,
+		`DELETE FROM shared_members WHERE wid=$1 OR member=$1`,
+		`DELETE FROM roles WHERE wid=$1`,
+		`DELETE FROM unregrequests WHERE wid=$1`,
+		`DELETE FROM expirynotices WHERE owner=$1`,
+		// Aliases pointing to the workspace would otherwise be left dangling. Alias targets are
+		// stored in the form wid/domain.
+		`DELETE FROM workspaces WHERE wtype='alias' AND wid IN
+			(SELECT wid FROM aliases WHERE alias LIKE $1 || '/%')`,
+		`DELETE FROM aliases WHERE alias LIKE $1 || '/%'`,
 	}
 	for _, sqlCmd := range sqlCommands {
 		_, err := dbConn.Exec(sqlCmd, wid)
@@ -624,6 +754,128 @@ func PreregWorkspace(wid string, uid string, domain string, wordList *diceware.W
 	return regcode, err
 }
 
+// RegRequest is a registration request awaiting approval by an administrator
+type RegRequest struct {
+	WID       string
+	UID       string
+	Requested string
+}
+
+// AddRegRequest adds a newly-registered workspace to the queue of requests awaiting approval
+func AddRegRequest(wid string) error {
+	_, err := dbConn.Exec(`INSERT INTO regrequests(wid, requested, status) `+
+		`VALUES($1, $2, 'pending')`, wid, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetRegRequests returns the pending registration requests, oldest first
+func GetRegRequests() ([]RegRequest, error) {
+	rows, err := dbConn.Query(`SELECT regrequests.wid, workspaces.uid, regrequests.requested
+		FROM regrequests JOIN workspaces ON regrequests.wid=workspaces.wid
+		WHERE regrequests.status='pending' ORDER BY regrequests.requested`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]RegRequest, 0)
+	for rows.Next() {
+		var request RegRequest
+		var uid sql.NullString
+		var requested time.Time
+		err = rows.Scan(&request.WID, &uid, &requested)
+		if err != nil {
+			return nil, err
+		}
+		request.WID = strings.TrimSpace(request.WID)
+		request.UID = uid.String
+		request.Requested = requested.UTC().Format("20060102T150405Z")
+		out = append(out, request)
+	}
+
+	return out, rows.Err()
+}
+
+// GetRegRequest returns the status of a workspace's registration request and the reason given
+// for the decision, if any. An empty status is returned if there is no request.
+func GetRegRequest(wid string) (string, string, error) {
+	row := dbConn.QueryRow(`SELECT status, reason FROM regrequests WHERE wid=$1`, wid)
+
+	var status string
+	var reason sql.NullString
+	err := row.Scan(&status, &reason)
+
+	switch err {
+	case sql.ErrNoRows:
+		return "", "", nil
+	case nil:
+		return status, reason.String, nil
+	default:
+		return "", "", err
+	}
+}
+
+// SetRegRequest records the decision on a registration request along with an optional reason
+func SetRegRequest(wid string, status string, reason string) error {
+	_, err := dbConn.Exec(`UPDATE regrequests SET status=$1, reason=$2 WHERE wid=$3`,
+		status, reason, wid)
+	return err
+}
+
+// RemoveRegRequest deletes a workspace's registration request
+func RemoveRegRequest(wid string) error {
+	_, err := dbConn.Exec(`DELETE FROM regrequests WHERE wid=$1`, wid)
+	return err
+}
+
+// AddUnregRequest queues a request from a user to remove their workspace. Requesting again while a
+// request is pending is not an error.
+func AddUnregRequest(wid string) error {
+	_, err := dbConn.Exec(`INSERT INTO unregrequests(wid, requested) VALUES($1, $2)
+		ON CONFLICT (wid) DO NOTHING`, wid, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetUnregRequests returns the pending requests to remove workspaces, oldest first
+func GetUnregRequests() ([]RegRequest, error) {
+	rows, err := dbConn.Query(`SELECT unregrequests.wid, workspaces.uid, unregrequests.requested
+		FROM unregrequests JOIN workspaces ON unregrequests.wid=workspaces.wid
+		ORDER BY unregrequests.requested`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]RegRequest, 0)
+	for rows.Next() {
+		var request RegRequest
+		var uid sql.NullString
+		var requested time.Time
+		err = rows.Scan(&request.WID, &uid, &requested)
+		if err != nil {
+			return nil, err
+		}
+		request.WID = strings.TrimSpace(request.WID)
+		request.UID = uid.String
+		request.Requested = requested.UTC().Format("20060102T150405Z")
+		out = append(out, request)
+	}
+
+	return out, rows.Err()
+}
+
+// RemoveUnregRequest deletes a request to remove a workspace. It returns false if there was no
+// such request.
+func RemoveUnregRequest(wid string) (bool, error) {
+	result, err := dbConn.Exec(`DELETE FROM unregrequests WHERE wid=$1`, wid)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
 // CheckRegCode handles authenticating a host using a user/workspace ID and registration
 // code provided by PreregWorkspace. Based on authentication it either returns the workspace ID
 // (success) or an empty string (failure). An error is returned only if authentication was not
@@ -807,6 +1059,10 @@ func GetLastEntry() (string, error) {
 	return entry, err
 }
 
+// ErrEntryExists is returned when adding a keycard entry whose index is already in use by the
+// owner's keycard. This happens when another entry was added after the new one was chained.
+var ErrEntryExists = errors.New("keycard entry index already exists")
+
 // AddEntry adds an entry to the database. The caller is responsible for validation of *ALL* data
 // passed to this command.
 func AddEntry(entry *keycard.Entry) error {
@@ -821,9 +1077,55 @@ func AddEntry(entry *keycard.Entry) error {
 	_, err = dbConn.Exec(`INSERT INTO keycards(owner, creationtime, index, entry, fingerprint) `+
 		`VALUES($1, $2, $3, $4, $5)`, owner, entry.Fields["Timestamp"], entry.Fields["Index"],
 		string(entry.MakeByteString(-1)), entry.Hash)
+	if isUniqueViolation(err) {
+		return ErrEntryExists
+	}
 	return err
 }
 
+// isUniqueViolation returns true if the error is from a PostgreSQL uniqueness constraint
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+// GetCurrentEntries returns the current entry of each keycard on the server, including the
+// organization's, mapped to its owner. The keycards of deleted workspaces are skipped.
+func GetCurrentEntries() (map[string]string, error) {
+	out := make(map[string]string)
+	rows, err := dbConn.Query(`SELECT DISTINCT ON (owner) owner, entry FROM keycards
+		WHERE owner NOT IN (SELECT wid FROM workspaces WHERE status='deleted')
+		ORDER BY owner, index DESC`)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var owner, entry string
+		err := rows.Scan(&owner, &entry)
+		if err != nil {
+			return out, err
+		}
+		out[owner] = entry
+	}
+	return out, rows.Err()
+}
+
+// AddExpiryNotice records that the owner of a keycard has been told that the entry with the
+// specified index is expiring or has expired. It returns false if this was already recorded.
+func AddExpiryNotice(owner string, index int, kind string) (bool, error) {
+	result, err := dbConn.Exec(`INSERT INTO expirynotices(owner, index, kind, sent)
+		VALUES($1, $2, $3, $4) ON CONFLICT (owner, index, kind) DO NOTHING`, owner, index, kind,
+		time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
 // GetPrimarySigningKey obtains the organization's primary signing key as an CryptoString
 func GetPrimarySigningKey() (string, error) {
 	row := dbConn.QueryRow(`SELECT privkey FROM orgkeys WHERE purpose = 'sign' ` +
@@ -852,24 +1154,197 @@ func GetEncryptionPair() (*ezcrypt.EncryptionPair, error) {
 	return nil, err
 }
 
-// GetAliases returns a StringList containing the aliases pointing to the specified WID
+// GetEncryptionPairs returns the organization's current encryption keypair followed by any
+// older ones which were replaced less than the specified amount of time ago. Clients may still
+// be using a retired key until they notice that the organization's keycard has changed.
+func GetEncryptionPairs(grace time.Duration) ([]*ezcrypt.EncryptionPair, error) {
+	out := make([]*ezcrypt.EncryptionPair, 0, 2)
+	rows, err := dbConn.Query(`SELECT pubkey,privkey,creationtime FROM orgkeys ` +
+		`WHERE purpose = 'encrypt' ORDER BY rowid DESC`)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+
+	cutoff := time.Now().UTC().Add(-grace)
+	for rows.Next() {
+		var pubkey, privkey string
+		var created time.Time
+		err := rows.Scan(&pubkey, &privkey, &created)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, ezcrypt.NewEncryptionPair(cryptostring.New(pubkey),
+			cryptostring.New(privkey)))
+
+		// Each key was retired when the one after it was created, so once a key is older than the
+		// grace period, none of the keys before it are needed
+		if created.Before(cutoff) {
+			break
+		}
+	}
+	if len(out) == 0 {
+		return out, sql.ErrNoRows
+	}
+	return out, rows.Err()
+}
+
+// OrgKey is one of the organization's keys along with its purpose, which is 'sign', 'altsign', or
+// 'encrypt'
+type OrgKey struct {
+	Purpose    string
+	PublicKey  cryptostring.CryptoString
+	PrivateKey cryptostring.CryptoString
+}
+
+// AddOrgEntry adds a new entry to the organization's keycard along with the keys for it. Both are
+// added in a single transaction so that the server never signs with keys that aren't in its
+// keycard or publishes keys that it doesn't have. The caller is responsible for validation of
+// *ALL* data passed to this command.
+func AddOrgEntry(entry *keycard.Entry, keys []OrgKey) error {
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO keycards(owner, creationtime, index, entry, fingerprint) `+
+		`VALUES('organization', $1, $2, $3, $4)`, entry.Fields["Timestamp"],
+		entry.Fields["Index"], string(entry.MakeByteString(-1)), entry.Hash)
+	if err != nil {
+		tx.Rollback()
+		if isUniqueViolation(err) {
+			return ErrEntryExists
+		}
+		return err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, key := range keys {
+		// Key fingerprints are the hash of the encoded public key
+		fingerprint, err := ezcrypt.HashData("BLAKE2B-256", strings.NewReader(key.PublicKey.Data))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO orgkeys(creationtime, pubkey, privkey, purpose, `+
+			`fingerprint) VALUES($1, $2, $3, $4, $5)`, now, key.PublicKey.AsString(),
+			key.PrivateKey.AsString(), key.Purpose, fingerprint.AsString())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetAliases returns a StringList containing the addresses of the aliases pointing to the
+// specified WID
 func GetAliases(wid string) (gostringlist.StringList, error) {
 	var out gostringlist.StringList
-	rows, err := dbConn.Query(`SELECT alias FROM alias WHERE wid=$1`, wid)
+	rows, err := dbConn.Query(`SELECT workspaces.uid, workspaces.domain FROM aliases
+		JOIN workspaces ON aliases.wid=workspaces.wid WHERE aliases.alias LIKE $1
+		ORDER BY workspaces.uid`, wid+"/%")
 	if err != nil {
 		return out, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var entry string
-		err := rows.Scan(&entry)
+		var uid, domain string
+		err := rows.Scan(&uid, &domain)
 		if err != nil {
 			return out, err
 		}
-		out.Append(entry)
+		out.Append(uid + "/" + domain)
 	}
-	return out, nil
+	return out, rows.Err()
+}
+
+// GetAliasTarget returns the WID of the workspace an alias points to
+func GetAliasTarget(wid string) (string, error) {
+	row := dbConn.QueryRow(`SELECT alias FROM aliases WHERE wid=$1`, wid)
+
+	var target string
+	err := row.Scan(&target)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", errors.New("workspace not found")
+		}
+		return "", err
+	}
+
+	// The target is stored as a workspace address
+	return strings.Split(strings.TrimSpace(target), "/")[0], nil
+}
+
+// GetAliasByUID returns the WID of the alias with the specified user ID and the WID of the
+// workspace it points to. Empty strings are returned if there is no such alias.
+func GetAliasByUID(uid string) (string, string, error) {
+	row := dbConn.QueryRow(`SELECT aliases.wid, aliases.alias FROM aliases
+		JOIN workspaces ON aliases.wid=workspaces.wid WHERE workspaces.uid=$1`, uid)
+
+	var wid, target string
+	err := row.Scan(&wid, &target)
+
+	switch err {
+	case sql.ErrNoRows:
+		return "", "", nil
+	case nil:
+		return strings.TrimSpace(wid), strings.Split(strings.TrimSpace(target), "/")[0], nil
+	default:
+		return "", "", err
+	}
+}
+
+// AddAlias creates an alias with the specified WID and user ID which points to the target
+// workspace
+func AddAlias(wid string, uid string, domain string, target string, targetDomain string) error {
+	_, err := dbConn.Exec(`INSERT INTO workspaces(wid, uid, domain, password, status, wtype) `+
+		`VALUES($1, $2, $3, '-', 'active', 'alias')`, wid, uid, domain)
+	if err != nil {
+		return err
+	}
+
+	_, err = dbConn.Exec(`INSERT INTO aliases(wid, alias) VALUES($1, $2)`, wid,
+		target+"/"+targetDomain)
+	if err != nil {
+		dbConn.Exec(`DELETE FROM workspaces WHERE wid=$1`, wid)
+	}
+	return err
+}
+
+// RemoveAlias deletes an alias. Unlike other workspaces, the user ID of an alias may be reused
+// afterward.
+func RemoveAlias(wid string) error {
+	_, err := dbConn.Exec(`DELETE FROM aliases WHERE wid=$1`, wid)
+	if err != nil {
+		return err
+	}
+
+	_, err = dbConn.Exec(`DELETE FROM workspaces WHERE wid=$1 AND wtype='alias'`, wid)
+	return err
+}
+
+// GetWorkspaceDomain returns the domain of a workspace
+func GetWorkspaceDomain(wid string) (string, error) {
+	row := dbConn.QueryRow(`SELECT domain FROM workspaces WHERE wid=$1`, wid)
+
+	var domain string
+	err := row.Scan(&domain)
+	return domain, err
+}
+
+// GetWorkspaceAddress returns the user ID and domain of a workspace. The user ID is empty for
+// workspaces which don't have one.
+func GetWorkspaceAddress(wid string) (string, string, error) {
+	row := dbConn.QueryRow(`SELECT uid, domain FROM workspaces WHERE wid=$1`, wid)
+
+	var uid sql.NullString
+	var domain string
+	err := row.Scan(&uid, &domain)
+	return uid.String, domain, err
 }
 
 // IsAlias returns a bool if the specified workspace is an alias or a real account
@@ -1078,3 +1553,208 @@ func SetQuotaUsage(wid string, total uint64) error {
 
 	return nil
 }
+
+// QueuedDelivery is a message waiting to be delivered to recipients on another server. The
+// message data is kept in the temporary file area of the sender's workspace until delivery
+// succeeds or is abandoned.
+type QueuedDelivery struct {
+	ID         string
+	Sender     string
+	Domain     string
+	Recipients string
+	TempName   string
+	Size       int64
+	Hash       string
+	Attempts   int
+	Created    time.Time
+}
+
+// QueueDelivery adds a message to the outbound delivery queue. It is due for delivery
+// immediately.
+func QueueDelivery(item QueuedDelivery) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	_, err := dbConn.Exec(`INSERT INTO deliveryqueue(id, sender, domain, recipients, tempname,
+		size, hash, attempts, created, nextattempt) VALUES($1, $2, $3, $4, $5, $6, $7, 0, $8, $8)`,
+		item.ID, item.Sender, item.Domain, item.Recipients, item.TempName, item.Size, item.Hash,
+		now)
+	if err != nil {
+		logging.Writef("dbhandler.QueueDelivery: failed to add delivery %s: %s", item.ID,
+			err.Error())
+	}
+	return err
+}
+
+// GetDueDeliveries returns up to the specified number of queued deliveries whose next attempt
+// time has arrived, oldest first
+func GetDueDeliveries(limit int) ([]QueuedDelivery, error) {
+	rows, err := dbConn.Query(`SELECT id, sender, domain, recipients, tempname, size, hash,
+		attempts, created FROM deliveryqueue WHERE nextattempt <= $1 ORDER BY nextattempt
+		LIMIT $2`, time.Now().UTC().Format(time.RFC3339), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]QueuedDelivery, 0)
+	for rows.Next() {
+		var item QueuedDelivery
+		err = rows.Scan(&item.ID, &item.Sender, &item.Domain, &item.Recipients, &item.TempName,
+			&item.Size, &item.Hash, &item.Attempts, &item.Created)
+		if err != nil {
+			return nil, err
+		}
+		item.ID = strings.TrimSpace(item.ID)
+		item.Sender = strings.TrimSpace(item.Sender)
+		out = append(out, item)
+	}
+
+	return out, rows.Err()
+}
+
+// RescheduleDelivery records a failed delivery attempt and sets when the next one is due
+func RescheduleDelivery(id string, attempts int, next time.Time, lastError string) error {
+	if len(lastError) > 1024 {
+		lastError = lastError[:1024]
+	}
+	_, err := dbConn.Exec(`UPDATE deliveryqueue SET attempts=$1, nextattempt=$2, lasterror=$3
+		WHERE id=$4`, attempts, next.UTC().Format(time.RFC3339), lastError, id)
+	return err
+}
+
+// RemoveDelivery removes a message from the outbound delivery queue
+func RemoveDelivery(id string) error {
+	_, err := dbConn.Exec(`DELETE FROM deliveryqueue WHERE id=$1`, id)
+	return err
+}
+
+// GetRemoteOrgHash returns the hash of the root keycard entry of another organization which was
+// saved the first time this server delivered to it. An empty string is returned if there isn't
+// one.
+func GetRemoteOrgHash(domain string) (string, error) {
+	row := dbConn.QueryRow(`SELECT roothash FROM remoteorgs WHERE domain=$1`,
+		strings.ToLower(domain))
+
+	var hash string
+	err := row.Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
+// AddRemoteOrg saves the hash of another organization's root keycard entry. A hash which has
+// already been saved for the domain is not replaced.
+func AddRemoteOrg(domain string, hash string) error {
+	_, err := dbConn.Exec(`INSERT INTO remoteorgs(domain, roothash, firstseen) VALUES($1, $2, $3)
+		ON CONFLICT (domain) DO NOTHING`, strings.ToLower(domain), hash,
+		time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetWorkspaceType returns the type of a workspace: 'individual', 'shared', or 'alias'. An empty
+// string is returned if the workspace doesn't exist.
+func GetWorkspaceType(wid string) (string, error) {
+	row := dbConn.QueryRow(`SELECT wtype FROM workspaces WHERE wid=$1`, wid)
+
+	var wtype string
+	err := row.Scan(&wtype)
+
+	switch err {
+	case sql.ErrNoRows:
+		return "", nil
+	case nil:
+		return wtype, nil
+	default:
+		logging.Writef("dbhandler.GetWorkspaceType: error reading workspaces: %s", err.Error())
+		return "", err
+	}
+}
+
+// SetMember adds a workspace to the members of a shared workspace. If it is already a member, its
+// permissions are updated.
+func SetMember(wid string, member string, permissions string) error {
+	_, err := dbConn.Exec(`INSERT INTO shared_members(wid, member, permissions) VALUES($1, $2, $3)
+		ON CONFLICT (wid, member) DO UPDATE SET permissions=$3`, wid, member, permissions)
+	return err
+}
+
+// RemoveMember removes a workspace from the members of a shared workspace
+func RemoveMember(wid string, member string) error {
+	_, err := dbConn.Exec(`DELETE FROM shared_members WHERE wid=$1 AND member=$2`, wid, member)
+	return err
+}
+
+// GetMemberPermissions returns the permissions a workspace has for a shared workspace. An empty
+// string is returned if it isn't a member.
+func GetMemberPermissions(wid string, member string) (string, error) {
+	row := dbConn.QueryRow(`SELECT permissions FROM shared_members WHERE wid=$1 AND member=$2`,
+		wid, member)
+
+	var permissions string
+	err := row.Scan(&permissions)
+
+	switch err {
+	case sql.ErrNoRows:
+		return "", nil
+	case nil:
+		return permissions, nil
+	default:
+		logging.Writef("dbhandler.GetMemberPermissions: error reading members: %s", err.Error())
+		return "", err
+	}
+}
+
+// GetMembers returns the members of a shared workspace mapped to their permissions
+func GetMembers(wid string) (map[string]string, error) {
+	rows, err := dbConn.Query(`SELECT member, permissions FROM shared_members WHERE wid=$1`, wid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string]string)
+	for rows.Next() {
+		var member, permissions string
+		err = rows.Scan(&member, &permissions)
+		if err != nil {
+			return nil, err
+		}
+		out[strings.TrimSpace(member)] = permissions
+	}
+
+	return out, rows.Err()
+}
+
+// AddRole grants a role to a workspace. Granting a role the workspace already has is not an error.
+func AddRole(wid string, role string) error {
+	_, err := dbConn.Exec(`INSERT INTO roles(wid, role) VALUES($1, $2)
+		ON CONFLICT (wid, role) DO NOTHING`, wid, role)
+	return err
+}
+
+// RemoveRole revokes a role from a workspace
+func RemoveRole(wid string, role string) error {
+	_, err := dbConn.Exec(`DELETE FROM roles WHERE wid=$1 AND role=$2`, wid, role)
+	return err
+}
+
+// GetRoles returns the roles which have been granted to a workspace
+func GetRoles(wid string) ([]string, error) {
+	rows, err := dbConn.Query(`SELECT role FROM roles WHERE wid=$1 ORDER BY role`, wid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]string, 0)
+	for rows.Next() {
+		var role string
+		err = rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, role)
+	}
+
+	return out, rows.Err()
+}
@@ -17,6 +17,11 @@ CREATE TABLE workspaces(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL,
 
 CREATE TABLE aliases(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL, alias CHAR(292) NOT NULL);
 
+-- Roles granted to workspaces, such as 'admin', 'moderator', or 'support'. The permissions each
+-- role grants are defined by the server.
+CREATE TABLE roles(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL, role VARCHAR(32) NOT NULL,
+	UNIQUE(wid, role));
+
 CREATE TABLE passcodes(rowid SERIAL PRIMARY KEY, wid VARCHAR(36) NOT NULL UNIQUE,
 	passcode VARCHAR(128) NOT NULL, expires TIMESTAMP NOT NULL);
 
@@ -27,9 +32,25 @@ CREATE TABLE failure_log(rowid SERIAL PRIMARY KEY, type VARCHAR(16) NOT NULL,
 CREATE TABLE prereg(rowid SERIAL PRIMARY KEY, wid VARCHAR(36) NOT NULL UNIQUE,
 	uid VARCHAR(128) NOT NULL, domain VARCHAR(255) NOT NULL, regcode VARCHAR(128));
 
+-- Registration requests made while the server is in moderated mode. status is 'pending',
+-- 'approved', or 'rejected'. Decided requests are kept until the requester has logged in and
+-- learned the outcome.
+CREATE TABLE regrequests(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL UNIQUE,
+	requested TIMESTAMP NOT NULL, status VARCHAR(16) NOT NULL, reason VARCHAR(1024));
+
+-- Requests from users to remove their own workspaces on servers where this requires approval
+CREATE TABLE unregrequests(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL UNIQUE,
+	requested TIMESTAMP NOT NULL);
+
 CREATE TABLE keycards(rowid SERIAL PRIMARY KEY, owner VARCHAR(292) NOT NULL,
 	creationtime TIMESTAMP NOT NULL, index INTEGER NOT NULL,
-	entry VARCHAR(8192) NOT NULL, fingerprint VARCHAR(96) NOT NULL);
+	entry VARCHAR(8192) NOT NULL, fingerprint VARCHAR(96) NOT NULL, UNIQUE(owner, index));
+
+-- Keycard expiration notices which have been sent. kind is 'expiring' or 'expired'. owner is a
+-- workspace ID or 'organization'.
+CREATE TABLE expirynotices(rowid SERIAL PRIMARY KEY, owner VARCHAR(292) NOT NULL,
+	index INTEGER NOT NULL, kind VARCHAR(16) NOT NULL, sent TIMESTAMP NOT NULL,
+	UNIQUE(owner, index, kind));
 
 CREATE TABLE orgkeys(rowid SERIAL PRIMARY KEY, creationtime TIMESTAMP NOT NULL, 
 	pubkey VARCHAR(7000), privkey VARCHAR(7000) NOT NULL, 
@@ -38,11 +59,31 @@ CREATE TABLE orgkeys(rowid SERIAL PRIMARY KEY, creationtime TIMESTAMP NOT NULL,
 CREATE TABLE quotas(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL, 
 			usage BIGINT, quota BIGINT);
 
+-- Messages waiting to be delivered to other servers. The message data itself is kept in the
+-- temporary file area of the sender's workspace under tempname.
+CREATE TABLE deliveryqueue(rowid SERIAL PRIMARY KEY, id CHAR(36) NOT NULL UNIQUE,
+	sender CHAR(36) NOT NULL, domain VARCHAR(255) NOT NULL, recipients VARCHAR(8192) NOT NULL,
+	tempname VARCHAR(64) NOT NULL, size BIGINT NOT NULL, hash VARCHAR(128) NOT NULL,
+	attempts INTEGER NOT NULL, created TIMESTAMP NOT NULL, nextattempt TIMESTAMP NOT NULL,
+	lasterror VARCHAR(1024));
+
+-- The hash of the root keycard entry of each organization this server has delivered to, saved on
+-- first contact. Keycards which don't start with the same entry later are refused.
+CREATE TABLE remoteorgs(rowid SERIAL PRIMARY KEY, domain VARCHAR(255) NOT NULL UNIQUE,
+	roothash VARCHAR(128) NOT NULL, firstseen TIMESTAMP NOT NULL);
+
+-- Members of shared workspaces. permissions is 'read', 'write', or 'admin'.
+CREATE TABLE shared_members(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL,
+	member CHAR(36) NOT NULL, permissions VARCHAR(16) NOT NULL, UNIQUE(wid, member));
+
 -- Information about individual workspaces
 
 CREATE TABLE iwkspc_folders(rowid SERIAL PRIMARY KEY, wid char(36) NOT NULL, 
 	enc_key VARCHAR(64) NOT NULL);
 
+-- status is 'active' or 'pending'. source is the address a pending device connected from. label
+-- is a name for the device chosen by the user.
 CREATE TABLE iwkspc_devices(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL,
-	devid CHAR(36) NOT NULL, devkey VARCHAR(1000) NOT NULL, status VARCHAR(16) NOT NULL);
+	devid CHAR(36) NOT NULL, devkey VARCHAR(1000) NOT NULL, status VARCHAR(16) NOT NULL,
+	source VARCHAR(48), label VARCHAR(64), lastseen TIMESTAMP, UNIQUE(wid, devid));
 
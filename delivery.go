@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darkwyrm/anselusd/cryptostring"
+	"github.com/darkwyrm/anselusd/dbhandler"
+	"github.com/darkwyrm/anselusd/fshandler"
+	"github.com/darkwyrm/anselusd/keycard"
+	"github.com/darkwyrm/anselusd/logging"
+	"github.com/spf13/viper"
+)
+
+// deliveryWake is used to start a pass over the delivery queue without waiting for the next poll
+var deliveryWake = make(chan bool, 1)
+
+// wakeDeliveryWorker asks the delivery worker to check the queue right away
+func wakeDeliveryWorker() {
+	select {
+	case deliveryWake <- true:
+	default:
+		// A wakeup is already pending
+	}
+}
+
+// deliveryWorker attempts delivery of messages in the outbound queue for the life of the server
+func deliveryWorker() {
+	for {
+		processDeliveryQueue()
+
+		select {
+		case <-deliveryWake:
+		case <-time.After(time.Second * time.Duration(viper.GetInt("delivery.poll_sec"))):
+		}
+	}
+}
+
+// processDeliveryQueue makes one attempt at each queued delivery which is due
+func processDeliveryQueue() {
+	items, err := dbhandler.GetDueDeliveries(100)
+	if err != nil {
+		logging.Writef("processDeliveryQueue: error reading queue: %s", err.Error())
+		return
+	}
+
+	for _, item := range items {
+		attemptDelivery(item)
+	}
+}
+
+// attemptDelivery tries to deliver a queued message. Successful or abandoned deliveries are
+// removed from the queue and failed ones are rescheduled with an exponential backoff.
+func attemptDelivery(item dbhandler.QueuedDelivery) {
+	results, err := deliverToServer(item)
+	if err == nil {
+		for addr, result := range results {
+			if result != deliveryOK {
+				logging.Writef("Delivery %s to %s failed: %s", item.ID, addr, result)
+			}
+		}
+		finishDelivery(item)
+		return
+	}
+
+	maxAge := time.Hour * time.Duration(viper.GetInt("delivery.max_age_hours"))
+	if time.Since(item.Created) > maxAge {
+		logging.Writef("Delivery %s to %s abandoned after %d attempts: %s", item.ID, item.Domain,
+			item.Attempts+1, err.Error())
+		finishDelivery(item)
+		return
+	}
+
+	attempts := item.Attempts + 1
+	next := time.Now().Add(deliveryBackoff(attempts))
+	err = dbhandler.RescheduleDelivery(item.ID, attempts, next, err.Error())
+	if err != nil {
+		logging.Writef("attemptDelivery: error rescheduling delivery %s: %s", item.ID,
+			err.Error())
+	}
+}
+
+// finishDelivery removes a message from the queue along with its data
+func finishDelivery(item dbhandler.QueuedDelivery) {
+	err := dbhandler.RemoveDelivery(item.ID)
+	if err != nil {
+		logging.Writef("finishDelivery: error removing delivery %s: %s", item.ID, err.Error())
+	}
+	fshandler.GetFSHandler().DeleteTempFile(item.Sender, item.TempName)
+}
+
+// deliveryBackoff returns the delay before the next attempt after the specified number of failed
+// attempts. The delay starts at one minute and doubles with each attempt up to the configured
+// maximum.
+func deliveryBackoff(attempts int) time.Duration {
+	maxDelay := time.Minute * time.Duration(viper.GetInt("delivery.max_retry_min"))
+	delay := time.Minute
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// lookupServer returns the address of the Anselus server for a domain. Entries in the
+// delivery.servers setting take precedence, followed by the DNS SRV record _anselus._tcp.<domain>,
+// and finally the domain itself on the standard port.
+func lookupServer(domain string) string {
+	for _, route := range strings.Split(viper.GetString("delivery.servers"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(route), "=", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], domain) {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+
+	_, records, err := net.LookupSRV("anselus", "tcp", domain)
+	if err == nil && len(records) > 0 {
+		return net.JoinHostPort(strings.TrimSuffix(records[0].Target, "."),
+			strconv.Itoa(int(records[0].Port)))
+	}
+
+	return net.JoinHostPort(domain, "2001")
+}
+
+// isServerAddress returns true if an IP address is one of those used by the Anselus server for a
+// domain. It is used to check the domain claimed by a server which connects to deliver messages.
+func isServerAddress(domain string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(lookupServer(domain))
+	if err != nil {
+		return false
+	}
+
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverClient is a connection to another Anselus server using the client protocol
+type serverClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialServer connects to the server for a domain and reads its greeting
+func dialServer(domain string) (*serverClient, error) {
+	conn, err := net.DialTimeout("tcp", lookupServer(domain), time.Second*30)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute * 10))
+
+	client := &serverClient{conn: conn, reader: bufio.NewReader(conn)}
+	greeting, err := client.readResponse()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if greeting.Code != 200 {
+		conn.Close()
+		return nil, fmt.Errorf("server greeting failed: %d %s", greeting.Code, greeting.Status)
+	}
+	return client, nil
+}
+
+// Close ends the session with the remote server
+func (c *serverClient) Close() {
+	c.sendRequest("QUIT", map[string]string{})
+	c.conn.Close()
+}
+
+func (c *serverClient) sendRequest(action string, data map[string]string) error {
+	out, err := json.Marshal(ClientRequest{action, data})
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(append(out, '\r', '\n'))
+	return err
+}
+
+// readResponse reads one JSON response from the server. Responses are sent one per line.
+func (c *serverClient) readResponse() (ServerResponse, error) {
+	var response ServerResponse
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return response, err
+	}
+	err = json.Unmarshal(line, &response)
+	return response, err
+}
+
+// getOrgCard downloads the remote organization's keycard and verifies it. The root entry must be
+// signed by its own primary verification key and each following entry must have a valid chain of
+// custody back to it.
+func (c *serverClient) getOrgCard() (*keycard.Keycard, error) {
+	err := c.sendRequest("ORGCARD", map[string]string{"Start-Index": "1"})
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.readResponse()
+	if err != nil {
+		return nil, err
+	}
+	if response.Code != 104 {
+		return nil, fmt.Errorf("keycard request failed: %d %s", response.Code, response.Status)
+	}
+	totalSize, err := strconv.Atoi(response.Data["Total-Size"])
+	if err != nil || totalSize < 1 || totalSize > MaxCommandLength*64 {
+		return nil, errors.New("bad keycard size from server")
+	}
+
+	err = c.sendRequest("TRANSFER", map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	cardData := make([]byte, totalSize)
+	_, err = io.ReadFull(c.reader, cardData)
+	if err != nil {
+		return nil, err
+	}
+
+	card := keycard.Keycard{Type: "Organization", Entries: make([]keycard.Entry, 0)}
+	for _, block := range strings.SplitAfter(string(cardData), "----- END ORG ENTRY -----\r\n") {
+		if strings.TrimSpace(block) == "" {
+			continue
+		}
+		// Entries don't necessarily end with a line terminator, so one is added before the footer
+		// to keep it on its own line. Entry.Set() ignores the blank line this might produce.
+		block = strings.Replace(block, "----- END ORG ENTRY -----", "\r\n----- END ORG ENTRY -----",
+			1)
+		entry := keycard.NewOrgEntry()
+		err = entry.Set([]byte(block))
+		if err != nil {
+			return nil, err
+		}
+		card.Entries = append(card.Entries, *entry)
+	}
+	if len(card.Entries) < 1 {
+		return nil, errors.New("empty keycard from server")
+	}
+
+	var verifyKey cryptostring.CryptoString
+	err = verifyKey.Set(card.Entries[0].Fields["Primary-Verification-Key"])
+	if err != nil {
+		return nil, err
+	}
+	verified, err := card.Entries[0].VerifySignature(verifyKey, "Organization")
+	if err != nil || !verified {
+		return nil, errors.New("root keycard entry failed verification")
+	}
+
+	verified, err = card.VerifyChain(verifyKey)
+	if err != nil || !verified {
+		return nil, errors.New("keycard chain of custody failed verification")
+	}
+
+	return &card, nil
+}
+
+// checkOrgCard makes sure that a remote organization's keycard starts with the same root entry
+// as the first time this server delivered to it. A keycard which verifies only shows that it is
+// consistent with itself, so without this, anyone able to answer for the domain could present
+// one of their own. A root entry which has changed needs an administrator to look into it. If the
+// change is legitimate, the saved one can be removed from the remoteorgs table.
+func checkOrgCard(domain string, card *keycard.Keycard) error {
+	rootHash := card.Entries[0].Hash
+	savedHash, err := dbhandler.GetRemoteOrgHash(domain)
+	if err != nil {
+		return err
+	}
+	if savedHash == "" {
+		return dbhandler.AddRemoteOrg(domain, rootHash)
+	}
+	if savedHash != rootHash {
+		logging.Writef("Keycard for %s has a different root entry than the one saved for it",
+			domain)
+		return errors.New("organization keycard root entry doesn't match the saved one")
+	}
+	return nil
+}
+
+// deliverToServer sends a queued message to the server for its recipients' domain and returns
+// the per-recipient results. An error is returned only if the delivery should be retried.
+func deliverToServer(item dbhandler.QueuedDelivery) (map[string]string, error) {
+	client, err := dialServer(item.Domain)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	card, err := client.getOrgCard()
+	if err != nil {
+		return nil, err
+	}
+	err = checkOrgCard(item.Domain, card)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := os.Open(filepath.Join(viper.GetString("global.workspace_dir"), "tmp",
+		item.Sender, item.TempName))
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	err = client.sendRequest("DELIVER", map[string]string{
+		"Size":          fmt.Sprintf("%d", item.Size),
+		"Hash":          item.Hash,
+		"Recipients":    item.Recipients,
+		"Sender-Domain": viper.GetString("global.domain"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.readResponse()
+	if err != nil {
+		return nil, err
+	}
+	if response.Code >= 400 && response.Code < 500 {
+		// The remote server understood the request and refused it, so trying again won't help
+		results := make(map[string]string)
+		for _, addr := range strings.Split(item.Recipients, ",") {
+			results[addr] = response.Status
+		}
+		return results, nil
+	}
+	if response.Code != 100 {
+		return nil, fmt.Errorf("delivery refused: %d %s %s", response.Code, response.Status,
+			response.Info)
+	}
+
+	_, err = io.CopyN(client.conn, handle, item.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err = client.readResponse()
+	if err != nil {
+		return nil, err
+	}
+	if response.Code != 200 {
+		return nil, fmt.Errorf("delivery failed: %d %s %s", response.Code, response.Status,
+			response.Info)
+	}
+
+	results := make(map[string]string)
+	err = json.Unmarshal([]byte(response.Data["Results"]), &results)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestDeliveryBackoff(t *testing.T) {
+	viper.Set("delivery.max_retry_min", 240)
+
+	expected := map[int]time.Duration{
+		1:  time.Minute,
+		2:  time.Minute * 2,
+		3:  time.Minute * 4,
+		8:  time.Minute * 128,
+		9:  time.Minute * 240,
+		50: time.Minute * 240,
+	}
+	for attempts, delay := range expected {
+		if result := deliveryBackoff(attempts); result != delay {
+			t.Fatalf("deliveryBackoff(%d) returned %s, expected %s", attempts, result, delay)
+		}
+	}
+
+	// The maximum applies even when it isn't a doubling of the starting delay
+	viper.Set("delivery.max_retry_min", 5)
+	if result := deliveryBackoff(4); result != time.Minute*5 {
+		t.Fatalf("deliveryBackoff() ignored max_retry_min: %s", result)
+	}
+}
+
+func TestLookupServerOverrides(t *testing.T) {
+	viper.Set("delivery.servers", "example.net=127.0.0.1:2002, Example.ORG = [::1]:2003,bogus")
+	defer viper.Set("delivery.servers", "")
+
+	if addr := lookupServer("example.net"); addr != "127.0.0.1:2002" {
+		t.Fatalf("lookupServer() returned %s for example.net", addr)
+	}
+	if addr := lookupServer("example.org"); addr != "[::1]:2003" {
+		t.Fatalf("lookupServer() didn't match a domain case-insensitively: %s", addr)
+	}
+}
+
+func TestIsServerAddress(t *testing.T) {
+	viper.Set("delivery.servers", "example.net=127.0.0.1:2002,example.org=[::1]:2003")
+	defer viper.Set("delivery.servers", "")
+
+	if !isServerAddress("example.net", net.ParseIP("127.0.0.1")) {
+		t.Fatal("isServerAddress() refused the address of the domain's server")
+	}
+	if !isServerAddress("example.org", net.ParseIP("::1")) {
+		t.Fatal("isServerAddress() refused the IPv6 address of the domain's server")
+	}
+	if isServerAddress("example.net", net.ParseIP("10.0.0.1")) {
+		t.Fatal("isServerAddress() accepted an address not used by the domain's server")
+	}
+	if isServerAddress("example.org", net.ParseIP("127.0.0.1")) {
+		t.Fatal("isServerAddress() accepted the address of another domain's server")
+	}
+	if isServerAddress("example.net", nil) {
+		t.Fatal("isServerAddress() accepted an empty address")
+	}
+}
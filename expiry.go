@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/darkwyrm/anselusd/dbhandler"
+	"github.com/darkwyrm/anselusd/keycard"
+	"github.com/darkwyrm/anselusd/logging"
+	"github.com/spf13/viper"
+)
+
+// expiringEntry describes the current entry of a keycard which expires soon or has expired
+type expiringEntry struct {
+	Owner   string
+	Index   int
+	Expires time.Time
+	Expired bool
+}
+
+// findExpiringEntries returns the current keycard entries which expire within the specified amount
+// of time, including those which have already expired, in order of expiration. Revocations don't
+// expire and are skipped.
+func findExpiringEntries(within time.Duration) ([]expiringEntry, error) {
+	out := make([]expiringEntry, 0)
+	entries, err := dbhandler.GetCurrentEntries()
+	if err != nil {
+		return out, err
+	}
+
+	now := time.Now().UTC()
+	for owner, data := range entries {
+		entry, err := keycard.NewEntryFromData(data)
+		if err != nil || entry.Type == "Revocation" {
+			continue
+		}
+		if entry.Type == "Organization" {
+			owner = "organization"
+		}
+
+		expires, err := time.Parse("20060102", entry.Fields["Expires"])
+		if err != nil {
+			logging.Writef("findExpiringEntries: bad expiration date in keycard for %s", owner)
+			continue
+		}
+		if expires.After(now.Add(within)) {
+			continue
+		}
+
+		index, _ := strconv.Atoi(entry.Fields["Index"])
+		out = append(out, expiringEntry{owner, index, expires, !expires.After(now)})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Expires.Before(out[j].Expires) })
+	return out, nil
+}
+
+// expiryWorker checks for expiring keycard entries for the life of the server
+func expiryWorker() {
+	for {
+		checkKeycardExpiration()
+		time.Sleep(time.Hour * time.Duration(viper.GetInt("keycards.check_hours")))
+	}
+}
+
+// checkKeycardExpiration warns the owners of keycards whose current entries are expiring. Each
+// owner is sent one notice when an entry is about to expire and another once it has. Notices for
+// the organization's keycard go to the administrator, and it is logged on every check because
+// clients can't verify anything on the server once it expires.
+func checkKeycardExpiration() {
+	warnPeriod := time.Hour * 24 * time.Duration(viper.GetInt("keycards.warn_days"))
+	entries, err := findExpiringEntries(warnPeriod)
+	if err != nil {
+		logging.Writef("checkKeycardExpiration: error reading keycards: %s", err.Error())
+		return
+	}
+
+	for _, item := range entries {
+		kind := "expiring"
+		if item.Expired {
+			kind = "expired"
+		}
+		expires := item.Expires.Format("20060102")
+
+		recipient := item.Owner
+		if item.Owner == "organization" {
+			logging.Writef("WARNING: organization keycard entry %d is %s (expires %s). Use "+
+				"ORGROTATE to replace it.", item.Index, kind, expires)
+			recipient, err = getAdminWID()
+			if err != nil {
+				logging.Writef("checkKeycardExpiration: error resolving admin address: %s",
+					err.Error())
+				continue
+			}
+		}
+
+		isNew, err := dbhandler.AddExpiryNotice(item.Owner, item.Index, kind)
+		if err != nil {
+			logging.Writef("checkKeycardExpiration: error recording notice for %s: %s",
+				item.Owner, err.Error())
+			continue
+		}
+		if !isNew {
+			continue
+		}
+
+		if item.Owner != "organization" {
+			logging.Writef("Keycard entry %d for %s is %s (expires %s)", item.Index, item.Owner,
+				kind, expires)
+		}
+		err = sendNotice(recipient, map[string]string{
+			"Type":    "keycardexpiry",
+			"Owner":   item.Owner,
+			"Index":   strconv.Itoa(item.Index),
+			"Expires": expires,
+			"Status":  kind,
+		})
+		if err != nil {
+			logging.Writef("checkKeycardExpiration: error sending notice to %s: %s", recipient,
+				err.Error())
+		}
+	}
+}
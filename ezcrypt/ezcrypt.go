@@ -3,10 +3,13 @@ package ezcrypt
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"strings"
 
 	"github.com/darkwyrm/anselusd/cryptostring"
@@ -16,6 +19,7 @@ import (
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/blake2b"
 	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/sha3"
 )
 
 // This module creates some classes which make working with Twisted Edwards Curve encryption
@@ -389,6 +393,49 @@ func (ekey EncryptionKey) Encrypt(data []byte) (string, error) {
 	return b85.Encode(encryptedData), nil
 }
 
+// GetHash returns a new hash.Hash instance for the specified algorithm. The supported hash
+// algorithms are 'BLAKE2B-256', 'SHA-256', and 'SHA3-256'.
+func GetHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "BLAKE2B-256":
+		return blake2b.New256(nil)
+	case "SHA-256":
+		return sha256.New(), nil
+	case "SHA3-256":
+		return sha3.New256(), nil
+	}
+	return nil, errors.New("unsupported hashing algorithm")
+}
+
+// HashData reads all data from the reader and returns the hash of it as a CryptoString using the
+// specified algorithm.
+func HashData(algorithm string, data io.Reader) (cryptostring.CryptoString, error) {
+	var out cryptostring.CryptoString
+
+	hasher, err := GetHash(algorithm)
+	if err != nil {
+		return out, err
+	}
+
+	_, err = io.Copy(hasher, data)
+	if err != nil {
+		return out, err
+	}
+
+	err = out.Set(algorithm + ":" + b85.Encode(hasher.Sum(nil)))
+	return out, err
+}
+
+// VerifyHash reads all data from the reader and returns true if it matches the hash given
+func VerifyHash(expected cryptostring.CryptoString, data io.Reader) (bool, error) {
+	actual, err := HashData(expected.Prefix, data)
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare(actual.AsBytes(), expected.AsBytes()) == 1, nil
+}
+
 // HashPassword turns a string into an Argon2 password hash.
 func HashPassword(password string) string {
 	mode := viper.GetString("security.password_security")
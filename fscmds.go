@@ -1,11 +1,17 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
 
+	"github.com/darkwyrm/anselusd/cryptostring"
+	"github.com/darkwyrm/anselusd/dbhandler"
+	"github.com/darkwyrm/anselusd/ezcrypt"
 	"github.com/darkwyrm/anselusd/fshandler"
+	"github.com/darkwyrm/anselusd/logging"
 )
 
 func handleFSError(session *sessionState, err error) {
@@ -21,49 +27,149 @@ func handleFSError(session *sessionState, err error) {
 		session.SendStringResponse(403, "FORBIDDEN", "")
 		return
 	}
+	if err == fshandler.ErrTooManyOpenFiles {
+		session.SendStringResponse(407, "UNAVAILABLE", "Too many open files")
+		return
+	}
 	session.SendStringResponse(400, "BAD REQUEST", err.Error())
 }
 
+// resolvePath converts a path from the client into an absolute Anselus path. Relative paths are
+// resolved against the session's current directory. If the path is invalid or outside the
+// session's filesystem root, the client is sent the appropriate error response and false is
+// returned, indicating that the command handler should exit.
+func resolvePath(session *sessionState, path string) (string, bool) {
+	out, err := session.FSRoot.Resolve(currentDir(session), path)
+	if err != nil {
+		if err == fshandler.ErrOutsideRoot {
+			session.SendStringResponse(403, "FORBIDDEN", "Path outside workspace")
+		} else {
+			session.SendStringResponse(400, "BAD REQUEST", "Bad path")
+		}
+		return "", false
+	}
+
+	return out, true
+}
+
+// currentDir returns the session's current directory, which is the root of the session's
+// filesystem if no directory has been selected.
+func currentDir(session *sessionState) string {
+	if session.CurrentPath == nil {
+		return session.FSRoot.Path()
+	}
+	return session.CurrentPath.AnselusPath()
+}
+
+// checkQuota checks to see if adding the specified number of bytes to a workspace would keep it
+// within its disk quota. A quota of 0 means that the workspace has no limit. The quota and the
+// current usage are also returned for reporting purposes.
+func checkQuota(wid string, size uint64) (bool, uint64, uint64, error) {
+	quota, err := dbhandler.GetQuota(wid)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	if quota == 0 {
+		return true, 0, 0, nil
+	}
+
+	usage, err := dbhandler.GetQuotaUsage(wid)
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	return usage+size <= quota, quota, usage, nil
+}
+
+// isOverQuota checks to see if adding the specified number of bytes to a workspace would put it
+// over its disk quota. If it would, the client is sent 409 QUOTA INSUFFICIENT and true is returned,
+// indicating that the command handler should exit.
+func isOverQuota(session *sessionState, wid string, size uint64) bool {
+	fits, quota, usage, err := checkQuota(wid, size)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("isOverQuota: error checking quota for %s: %s", wid, err.Error())
+		return true
+	}
+
+	if !fits {
+		response := NewServerResponse(409, "QUOTA INSUFFICIENT")
+		response.Data["Quota"] = fmt.Sprintf("%d", quota)
+		response.Data["Usage"] = fmt.Sprintf("%d", usage)
+		session.SendResponse(*response)
+		return true
+	}
+
+	return false
+}
+
+// updateQuotaUsage adjusts the disk usage for a workspace after a successful write or removal.
+// Failures are logged, but are not reported to the client because the filesystem operation itself
+// has already completed.
+func updateQuotaUsage(wid string, amount int64) {
+	_, err := dbhandler.ModifyQuotaUsage(wid, amount)
+	if err != nil {
+		logging.Writef("updateQuotaUsage: error updating quota usage for %s: %s", wid,
+			err.Error())
+	}
+}
+
 func commandCopy(session *sessionState) {
 	// Command syntax:
 	// COPY(SourceFile, DestDir)
 
-	if session.LoginState != loginClientSession {
-		session.SendStringResponse(401, "UNAUTHORIZED", "")
+	if !checkFSAccess(session, true) {
 		return
 	}
 
-	if session.Message.Validate([]string{"SourceFile", "DestDir"}) != nil {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+	srcPath, ok := resolvePath(session, session.Message.Data["SourceFile"])
+	if !ok {
+		return
+	}
+	destPath, ok := resolvePath(session, session.Message.Data["DestDir"])
+	if !ok {
 		return
 	}
 
 	fsh := fshandler.GetFSHandler()
-	exists, err := fsh.Exists(session.Message.Data["SourceFile"])
+	exists, err := fsh.Exists(srcPath)
 	if err != nil {
 		handleFSError(session, err)
 		return
 	}
 	if !exists {
 		session.SendStringResponse(404, "NOT FOUND", "Source does not exist")
+		return
 	}
 
-	exists, err = fsh.Exists(session.Message.Data["DestDir"])
+	exists, err = fsh.Exists(destPath)
 	if err != nil {
 		handleFSError(session, err)
 		return
 	}
 	if !exists {
 		session.SendStringResponse(404, "NOT FOUND", "Destination does not exist")
+		return
 	}
 
-	newName, err := fsh.CopyFile(session.Message.Data["SourceFile"],
-		session.Message.Data["DestDir"])
+	fileSize, err := fsh.GetFileSize(srcPath)
 	if err != nil {
 		handleFSError(session, err)
 		return
 	}
 
+	if isOverQuota(session, session.FSRoot.WID(), uint64(fileSize)) {
+		return
+	}
+
+	newName, err := fsh.CopyFile(srcPath,
+		destPath)
+	if err != nil {
+		handleFSError(session, err)
+		return
+	}
+	updateQuotaUsage(session.FSRoot.WID(), fileSize)
+
 	response := NewServerResponse(200, "OK")
 	response.Data["NewName"] = newName
 	session.SendResponse(*response)
@@ -72,42 +178,151 @@ func commandCopy(session *sessionState) {
 func commandDelete(session *sessionState) {
 	// Command syntax:
 	// DELETE(FilePath)
-	if session.LoginState != loginClientSession {
-		session.SendStringResponse(401, "UNAUTHORIZED", "")
+	if !checkFSAccess(session, true) {
 		return
 	}
 
-	if session.Message.Validate([]string{"Path"}) != nil {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+	path, ok := resolvePath(session, session.Message.Data["Path"])
+	if !ok {
 		return
 	}
 
 	fsh := fshandler.GetFSHandler()
-	err := fsh.DeleteFile(session.Message.Data["Path"])
+	fileSize, err := fsh.GetFileSize(path)
 	if err != nil {
 		handleFSError(session, err)
 		return
 	}
 
+	err = fsh.DeleteFile(path)
+	if err != nil {
+		handleFSError(session, err)
+		return
+	}
+	updateQuotaUsage(session.FSRoot.WID(), -fileSize)
+
 	session.SendStringResponse(200, "OK", "")
 }
 
+func commandDownload(session *sessionState) {
+	// Command syntax:
+	// DOWNLOAD(Path, Offset=0)
+
+	if !checkFSAccess(session, false) {
+		return
+	}
+
+	path, ok := resolvePath(session, session.Message.Data["Path"])
+	if !ok {
+		return
+	}
+
+	fsh := fshandler.GetFSHandler()
+	exists, err := fsh.Exists(path)
+	if err != nil {
+		handleFSError(session, err)
+		return
+	}
+	if !exists {
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
+	}
+
+	fileSize, err := fsh.GetFileSize(path)
+	if err != nil {
+		handleFSError(session, err)
+		return
+	}
+
+	var offset int64
+	if session.Message.HasField("Offset") {
+		offset, err = strconv.ParseInt(session.Message.Data["Offset"], 10, 64)
+		if err != nil || offset < 0 || offset > fileSize {
+			session.SendStringResponse(400, "BAD REQUEST", "Bad offset")
+			return
+		}
+	}
+
+	// Total-Size is the size of the whole file. Only the part after Offset is sent, so the
+	// number of bytes which follow the TRANSFER request is given in Remaining-Size.
+	response := NewServerResponse(104, "TRANSFER")
+	response.Data["Total-Size"] = fmt.Sprintf("%d", fileSize)
+	response.Data["Offset"] = fmt.Sprintf("%d", offset)
+	response.Data["Remaining-Size"] = fmt.Sprintf("%d", fileSize-offset)
+	if session.SendResponse(*response) != nil {
+		return
+	}
+
+	request, err := session.GetRequest()
+	if err != nil {
+		session.SendStringResponse(400, "BAD REQUEST", "")
+		return
+	}
+	if request.Action == "CANCEL" {
+		return
+	}
+	if request.Action != "TRANSFER" {
+		session.SendStringResponse(400, "BAD REQUEST", "")
+		return
+	}
+
+	handle, err := fsh.OpenFile(session.ID, path)
+	if err != nil {
+		session.IsTerminating = true
+		logging.Writef("commandDownload: error opening file: %s", err.Error())
+		return
+	}
+
+	if offset > 0 {
+		err = fsh.SeekFile(handle, offset)
+		if err != nil {
+			fsh.CloseFile(handle)
+			session.IsTerminating = true
+			logging.Writef("commandDownload: error seeking in file: %s", err.Error())
+			return
+		}
+	}
+
+	// ReadFile closes the handle by itself once it reaches the end of the file, so it only needs
+	// to be closed here if something goes wrong part of the way through.
+	buffer := make([]byte, 65536)
+	for {
+		bytesRead, err := fsh.ReadFile(handle, buffer)
+		if bytesRead > 0 {
+			_, werr := session.Connection.Write(buffer[:bytesRead])
+			if werr != nil {
+				fsh.CloseFile(handle)
+				session.IsTerminating = true
+				return
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				fsh.CloseFile(handle)
+				session.IsTerminating = true
+				logging.Writef("commandDownload: error reading file: %s", err.Error())
+			}
+			return
+		}
+	}
+}
+
 func commandExists(session *sessionState) {
 	// Command syntax:
 	// EXISTS(Path)
 
-	if session.LoginState != loginClientSession {
-		session.SendStringResponse(401, "UNAUTHORIZED", "")
+	if !checkFSAccess(session, false) {
 		return
 	}
 
-	if !session.Message.HasField("Path") {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+	path, ok := resolvePath(session, session.Message.Data["Path"])
+	if !ok {
 		return
 	}
 
 	fsh := fshandler.GetFSHandler()
-	exists, err := fsh.Exists(session.Message.Data["Path"])
+	exists, err := fsh.Exists(path)
 	if err != nil {
 		handleFSError(session, err)
 		return
@@ -122,14 +337,8 @@ func commandExists(session *sessionState) {
 
 func commandList(session *sessionState) {
 	// Command syntax:
-	// LIST(Time=0)
-	if session.LoginState != loginClientSession {
-		session.SendStringResponse(401, "UNAUTHORIZED", "")
-		return
-	}
-
-	if session.Message.Validate([]string{"Path"}) != nil {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+	// LIST(Path="", Time=0)
+	if !checkFSAccess(session, false) {
 		return
 	}
 
@@ -139,12 +348,21 @@ func commandList(session *sessionState) {
 		unixTime, err = strconv.ParseInt(session.Message.Data["Time"], 10, 64)
 		if err != nil {
 			session.SendStringResponse(400, "BAD REQUEST", "Bad time field")
+			return
+		}
+	}
+
+	path := currentDir(session)
+	if session.Message.HasField("Path") {
+		var ok bool
+		path, ok = resolvePath(session, session.Message.Data["Path"])
+		if !ok {
+			return
 		}
-		return
 	}
 
 	fsh := fshandler.GetFSHandler()
-	names, err := fsh.ListFiles(session.Message.Data["Path"], int64(unixTime))
+	names, err := fsh.ListFiles(path, int64(unixTime))
 	if err != nil {
 		handleFSError(session, err)
 		return
@@ -157,15 +375,23 @@ func commandList(session *sessionState) {
 
 func commandListDirs(session *sessionState) {
 	// Command syntax:
-	// LISTDIRS()
+	// LISTDIRS(Path="")
 
-	if session.LoginState != loginClientSession {
-		session.SendStringResponse(401, "UNAUTHORIZED", "")
+	if !checkFSAccess(session, false) {
 		return
 	}
 
+	path := currentDir(session)
+	if session.Message.HasField("Path") {
+		var ok bool
+		path, ok = resolvePath(session, session.Message.Data["Path"])
+		if !ok {
+			return
+		}
+	}
+
 	fsh := fshandler.GetFSHandler()
-	names, err := fsh.ListDirectories(session.CurrentPath.AnselusPath())
+	names, err := fsh.ListDirectories(path)
 	if err != nil {
 		handleFSError(session, err)
 		return
@@ -179,18 +405,23 @@ func commandListDirs(session *sessionState) {
 func commandMkDir(session *sessionState) {
 	// Command syntax:
 	// MKDIR(Path)
-	if session.LoginState != loginClientSession {
-		session.SendStringResponse(401, "UNAUTHORIZED", "")
+	if !checkFSAccess(session, true) {
 		return
 	}
 
-	if session.Message.Validate([]string{"Path"}) != nil {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+	path, ok := resolvePath(session, session.Message.Data["Path"])
+	if !ok {
+		return
+	}
+
+	// Directories themselves don't count against a workspace's quota, but a workspace which is
+	// already full isn't permitted to create new ones, either.
+	if isOverQuota(session, session.FSRoot.WID(), 0) {
 		return
 	}
 
 	fsh := fshandler.GetFSHandler()
-	err := fsh.MakeDirectory(session.Message.Data["Path"])
+	err := fsh.MakeDirectory(path)
 	if err != nil {
 		handleFSError(session, err)
 		return
@@ -203,36 +434,41 @@ func commandMove(session *sessionState) {
 	// Command syntax:
 	// MOVE(SourceFile, DestDir)
 
-	if session.LoginState != loginClientSession {
-		session.SendStringResponse(401, "UNAUTHORIZED", "")
+	if !checkFSAccess(session, true) {
 		return
 	}
 
-	if session.Message.Validate([]string{"SourceFile", "DestDir"}) != nil {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+	srcPath, ok := resolvePath(session, session.Message.Data["SourceFile"])
+	if !ok {
+		return
+	}
+	destPath, ok := resolvePath(session, session.Message.Data["DestDir"])
+	if !ok {
 		return
 	}
 
 	fsh := fshandler.GetFSHandler()
-	exists, err := fsh.Exists(session.Message.Data["SourceFile"])
+	exists, err := fsh.Exists(srcPath)
 	if err != nil {
 		handleFSError(session, err)
 		return
 	}
 	if !exists {
 		session.SendStringResponse(404, "NOT FOUND", "Source does not exist")
+		return
 	}
 
-	exists, err = fsh.Exists(session.Message.Data["DestDir"])
+	exists, err = fsh.Exists(destPath)
 	if err != nil {
 		handleFSError(session, err)
 		return
 	}
 	if !exists {
 		session.SendStringResponse(404, "NOT FOUND", "Destination does not exist")
+		return
 	}
 
-	err = fsh.MoveFile(session.Message.Data["SourceFile"], session.Message.Data["DestDir"])
+	err = fsh.MoveFile(srcPath, destPath)
 	if err != nil {
 		handleFSError(session, err)
 		return
@@ -244,24 +480,24 @@ func commandMove(session *sessionState) {
 func commandRmDir(session *sessionState) {
 	// Command syntax:
 	// RMDIR(Path, Recursive)
-	if session.LoginState != loginClientSession {
-		session.SendStringResponse(401, "UNAUTHORIZED", "")
+	if !checkFSAccess(session, true) {
 		return
 	}
 
-	if session.Message.Validate([]string{"Path", "Recursive"}) != nil {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+	path, ok := resolvePath(session, session.Message.Data["Path"])
+	if !ok {
 		return
 	}
 
 	fsh := fshandler.GetFSHandler()
-	exists, err := fsh.Exists(session.Message.Data["Path"])
+	exists, err := fsh.Exists(path)
 	if err != nil {
 		handleFSError(session, err)
 		return
 	}
 	if !exists {
 		session.SendStringResponse(404, "NOT FOUND", "Path does not exist")
+		return
 	}
 
 	recurseStr := strings.ToLower(session.Message.Data["Recursive"])
@@ -269,84 +505,247 @@ func commandRmDir(session *sessionState) {
 	if recurseStr == "true" || recurseStr == "yes" {
 		recursive = true
 	}
-	err = fsh.RemoveDirectory(session.Message.Data["Path"], recursive)
+	err = fsh.RemoveDirectory(path, recursive)
 	if err != nil {
 		handleFSError(session, err)
 		return
 	}
 
+	// A recursive removal can take any number of files with it, so rather than tallying them up
+	// beforehand, the workspace's usage is just recalculated afterward.
+	if recursive {
+		wid := session.FSRoot.WID()
+		usage, err := fsh.GetDiskUsage(wid)
+		if err != nil {
+			logging.Writef("commandRmDir: error getting disk usage for %s: %s", wid, err.Error())
+		} else if err = dbhandler.SetQuotaUsage(wid, usage); err != nil {
+			logging.Writef("commandRmDir: error updating quota usage for %s: %s", wid,
+				err.Error())
+		}
+	}
+
 	session.SendStringResponse(200, "OK", "")
 }
 
+func commandPwd(session *sessionState) {
+	// Command syntax:
+	// PWD()
+
+	if !checkFSAccess(session, false) {
+		return
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Path"] = currentDir(session)
+	session.SendResponse(*response)
+}
+
 func commandSelect(session *sessionState) {
 	// Command syntax:
 	// SELECT(Path)
 
-	if session.LoginState != loginClientSession {
-		session.SendStringResponse(401, "UNAUTHORIZED", "")
+	if !checkFSAccess(session, false) {
 		return
 	}
 
-	if !session.Message.HasField("Path") {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+	path, ok := resolvePath(session, session.Message.Data["Path"])
+	if !ok {
 		return
 	}
 
 	fsh := fshandler.GetFSHandler()
-	path, err := fsh.Select(session.Message.Data["Path"])
+	anpath, err := fsh.Select(path)
 	if err != nil {
 		handleFSError(session, err)
+		return
 	}
-	session.CurrentPath = path
+	session.CurrentPath = anpath
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Path"] = path
+	session.SendResponse(*response)
+}
+
+func commandSetRoot(session *sessionState) {
+	// Command syntax:
+	// SETROOT(Workspace-ID)
+
+	if !dbhandler.ValidateUUID(session.Message.Data["Workspace-ID"]) {
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Workspace-ID")
+		return
+	}
+
+	wid := session.Message.Data["Workspace-ID"]
+	exists, _ := dbhandler.CheckWorkspace(wid)
+	if !exists {
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
+	}
+
+	// Members of a shared workspace may switch to it, and anyone may switch back to their own
+	// workspace. Any other workspace requires the setroot permission.
+	permissions, err := dbhandler.GetMemberPermissions(wid, session.WID)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		return
+	}
+	shared := permissions != ""
+
+	if !shared && wid != session.WID {
+		if !checkPermission(session, permSetRoot) {
+			return
+		}
+	}
+
+	root, err := fshandler.NewFSRoot(wid)
+	if err != nil {
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Workspace-ID")
+		return
+	}
+
+	// Accessing another user's files is a big deal, so it is always logged
+	if !shared && wid != session.WID {
+		logging.Writef("SETROOT: %s changed filesystem root from %s to %s", session.WID,
+			session.FSRoot.WID(), root.WID())
+	}
+
+	session.FSRoot = root
+	session.FSShared = shared
+	session.CurrentPath = nil
+	session.SendStringResponse(200, "OK", "")
 }
 
 func commandUpload(session *sessionState) {
 	// Command syntax:
 	// UPLOAD(Size,Hash,Name="",Offset=0)
 
-	// if session.LoginState != loginClientSession {
-	// 	session.SendStringResponse(401, "UNAUTHORIZED", "")
-	// 	return
-	// }
-
-	// if session.Message.Validate([]string{"Size", "Hash"}) != nil {
-	// 	session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
-	// 	return
-	// }
-
-	// // Both Name and Hash must be present when resuming
-	// if (session.Message.HasField("Name") && !session.Message.HasField("Hash")) ||
-	// 	(session.Message.HasField("Hash") && !session.Message.HasField("Name")) {
-	// 	session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
-	// 	return
-	// }
-
-	// var fileSize int64
-	// var fileHash cs.CryptoString
-	// err := fileHash.Set(session.Message.Data["Hash"])
-	// if err != nil {
-	// 	session.SendStringResponse(400, "BAD REQUEST", err.Error())
-	// }
-
-	// fileSize, err = strconv.ParseInt(session.Message.Data["Size"], 10, 64)
-	// if err != nil {
-	// 	session.SendStringResponse(400, "BAD REQUEST", "Bad file size")
-	// }
-
-	// var resumeName string
-	// var resumeOffset int64
-	// if session.Message.HasField("Name") {
-	// 	if !fshandler.ValidateTempFileName(session.Message.Data["Name"]) {
-	// 		session.SendStringResponse(400, "BAD REQUEST", "Bad file name")
-	// 	}
-
-	// 	resumeName = session.Message.Data["Name"]
-
-	// 	resumeOffset, err = strconv.ParseInt(session.Message.Data["Offset"], 10, 64)
-	// 	if err != nil {
-	// 		session.SendStringResponse(400, "BAD REQUEST", "Bad offset")
-	// 	}
-	// }
-
-	session.SendStringResponse(308, "UNIMPLEMENTED", "")
+	if !checkFSAccess(session, true) {
+		return
+	}
+
+	// Both Name and Offset must be present when resuming
+	if (session.Message.HasField("Name") && !session.Message.HasField("Offset")) ||
+		(session.Message.HasField("Offset") && !session.Message.HasField("Name")) {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return
+	}
+
+	var fileHash cryptostring.CryptoString
+	err := fileHash.Set(session.Message.Data["Hash"])
+	if err != nil {
+		session.SendStringResponse(400, "BAD REQUEST", err.Error())
+		return
+	}
+	if _, err = ezcrypt.GetHash(fileHash.Prefix); err != nil {
+		session.SendStringResponse(309, "ENCRYPTION TYPE NOT SUPPORTED",
+			"Supported: BLAKE2B-256, SHA-256, SHA3-256")
+		return
+	}
+
+	fileSize, err := strconv.ParseInt(session.Message.Data["Size"], 10, 64)
+	if err != nil || fileSize < 1 {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad file size")
+		return
+	}
+
+	var resumeName string
+	var resumeOffset int64
+	if session.Message.HasField("Name") {
+		if !fshandler.ValidateTempFileName(session.Message.Data["Name"]) {
+			session.SendStringResponse(400, "BAD REQUEST", "Bad file name")
+			return
+		}
+
+		resumeName = session.Message.Data["Name"]
+
+		resumeOffset, err = strconv.ParseInt(session.Message.Data["Offset"], 10, 64)
+		if err != nil || resumeOffset < 0 || resumeOffset > fileSize {
+			session.SendStringResponse(400, "BAD REQUEST", "Bad offset")
+			return
+		}
+	}
+
+	// Uploaded files are installed into the currently-selected directory. If nothing has been
+	// selected yet, the session's root directory is used.
+	destPath := currentDir(session)
+
+	fsh := fshandler.GetFSHandler()
+	exists, err := fsh.Exists(destPath)
+	if err != nil {
+		handleFSError(session, err)
+		return
+	}
+	if !exists {
+		session.SendStringResponse(404, "NOT FOUND", "Destination does not exist")
+		return
+	}
+
+	if isOverQuota(session, session.FSRoot.WID(), uint64(fileSize)) {
+		return
+	}
+
+	var tempHandle *os.File
+	if resumeName != "" {
+		tempHandle, err = fsh.OpenTempFile(session.WID, resumeName, resumeOffset)
+		if err != nil {
+			handleFSError(session, err)
+			return
+		}
+	} else {
+		tempHandle, resumeName, err = fsh.MakeTempFile(session.WID)
+		if err != nil {
+			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			logging.Writef("commandUpload: error creating temp file: %s", err.Error())
+			return
+		}
+	}
+
+	response := NewServerResponse(100, "CONTINUE")
+	response.Data["Name"] = resumeName
+	response.Data["Offset"] = fmt.Sprintf("%d", resumeOffset)
+	if session.SendResponse(*response) != nil {
+		tempHandle.Close()
+		return
+	}
+
+	// The client now sends the file data raw. If the connection drops part of the way through,
+	// the temp file is kept so that the client can resume from where it left off.
+	_, err = io.CopyN(tempHandle, session.Reader, fileSize-resumeOffset)
+	if err != nil {
+		tempHandle.Close()
+		session.IsTerminating = true
+		return
+	}
+
+	_, err = tempHandle.Seek(0, io.SeekStart)
+	if err != nil {
+		tempHandle.Close()
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandUpload: error rewinding temp file: %s", err.Error())
+		return
+	}
+
+	hashMatch, err := ezcrypt.VerifyHash(fileHash, tempHandle)
+	tempHandle.Close()
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandUpload: error hashing temp file: %s", err.Error())
+		return
+	}
+	if !hashMatch {
+		fsh.DeleteTempFile(session.WID, resumeName)
+		session.SendStringResponse(410, "HASH MISMATCH", "")
+		return
+	}
+
+	newName, err := fsh.InstallTempFile(session.WID, resumeName, destPath)
+	if err != nil {
+		handleFSError(session, err)
+		return
+	}
+	updateQuotaUsage(session.FSRoot.WID(), fileSize)
+
+	response = NewServerResponse(200, "OK")
+	response.Data["FileName"] = newName
+	session.SendResponse(*response)
 }
@@ -21,10 +21,10 @@ import (
 type LocalFSHandler struct {
 	BasePath      string
 	PathSeparator string
-	Files         map[string]LocalFSHandle
+	Files         *FileTable
 }
 
-var providerLock = &sync.Mutex{}
+var localProviderLock = &sync.Mutex{}
 var localProviderInstance *LocalFSHandler
 
 // LocalFSHandle represents an open file and provides Open(), Read(), and Close() methods
@@ -33,13 +33,18 @@ type LocalFSHandle struct {
 	Handle *os.File
 }
 
-// GetFSHandler returns a new filesystem provider which interacts with the local filesystem.
+// Close closes the underlying file
+func (lfsh *LocalFSHandle) Close() error {
+	return lfsh.Handle.Close()
+}
+
+// GetLocalFSHandler returns the filesystem provider which interacts with the local filesystem.
 // It obtains the necessary information about the local filesystem directly from the server
 // configuration data.
-func GetFSHandler() *LocalFSHandler {
+func GetLocalFSHandler() *LocalFSHandler {
 	if localProviderInstance == nil {
-		providerLock.Lock()
-		defer providerLock.Unlock()
+		localProviderLock.Lock()
+		defer localProviderLock.Unlock()
 
 		if localProviderInstance == nil {
 			var provider LocalFSHandler
@@ -53,7 +58,7 @@ func GetFSHandler() *LocalFSHandler {
 				provider.PathSeparator = "/"
 			}
 
-			provider.Files = make(map[string]LocalFSHandle, 100)
+			provider.Files = NewFileTable()
 			localProviderInstance = &provider
 		}
 	}
@@ -125,13 +130,43 @@ func (lfs *LocalFSHandler) CopyFile(source string, dest string) (string, error)
 // CloseFile closes the specified file handle. It is not normally needed unless Read() returns an
 // error or the caller must abort reading the file.
 func (lfs *LocalFSHandler) CloseFile(handle string) error {
-	lfsh, exists := lfs.Files[handle]
-	if !exists {
-		return os.ErrNotExist
+	return lfs.Files.Close(handle)
+}
+
+// CloseSessionFiles closes all files opened by the specified session. It is called when a
+// client's connection ends.
+func (lfs *LocalFSHandler) CloseSessionFiles(session string) {
+	lfs.Files.CloseOwner(session)
+}
+
+// CopyTempFile duplicates a file in the temporary file area for a workspace and returns the name
+// of the new temporary file
+func (lfs *LocalFSHandler) CopyTempFile(wid string, name string) (string, error) {
+	if !ValidateTempFileName(name) {
+		return "", errors.New("bad tempfile name")
+	}
+
+	// Workspace ID validation handled in MakeTempFile()
+	srcHandle, err := os.Open(filepath.Join(viper.GetString("global.workspace_dir"), "tmp", wid,
+		name))
+	if err != nil {
+		return "", err
 	}
-	lfsh.Handle.Close()
-	delete(lfs.Files, handle)
-	return nil
+	defer srcHandle.Close()
+
+	destHandle, newName, err := lfs.MakeTempFile(wid)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(destHandle, srcHandle)
+	destHandle.Close()
+	if err != nil {
+		lfs.DeleteTempFile(wid, newName)
+		return "", err
+	}
+
+	return newName, nil
 }
 
 // DeleteFile deletes the specified workspace file. If the file does not exist, this function will
@@ -152,6 +187,27 @@ func (lfs *LocalFSHandler) DeleteFile(path string) error {
 	return os.Remove(anpath.ProviderPath())
 }
 
+// DeleteTempFile deletes a file in the temporary file area for a workspace. It is used to clean up
+// after failed or abandoned uploads.
+func (lfs *LocalFSHandler) DeleteTempFile(wid string, name string) error {
+	pattern := regexp.MustCompile("[\\da-fA-F]{8}-?[\\da-fA-F]{4}-?[\\da-fA-F]{4}-?[\\da-fA-F]{4}-?[\\da-fA-F]{12}")
+	if (len(wid) != 36 && len(wid) != 32) || !pattern.MatchString(wid) {
+		return errors.New("bad workspace id")
+	}
+
+	if !ValidateTempFileName(name) {
+		return errors.New("bad tempfile name")
+	}
+
+	tempFilePath := filepath.Join(viper.GetString("global.workspace_dir"), "tmp", wid, name)
+	_, err := os.Stat(tempFilePath)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(tempFilePath)
+}
+
 // Exists checks to see if the specified path exists
 func (lfs *LocalFSHandler) Exists(path string) (bool, error) {
 
@@ -200,6 +256,26 @@ func (lfs *LocalFSHandler) GetDiskUsage(wid string) (uint64, error) {
 	return totalSize, err
 }
 
+// GetFileSize returns the size of the specified workspace file in bytes
+func (lfs *LocalFSHandler) GetFileSize(path string) (int64, error) {
+	// Path validation handled in Set()
+	var anpath LocalAnPath
+	err := anpath.Set(path)
+	if err != nil {
+		return 0, err
+	}
+
+	stat, err := os.Stat(anpath.ProviderPath())
+	if err != nil {
+		return 0, err
+	}
+	if !stat.Mode().IsRegular() {
+		return 0, errors.New("path is a not file")
+	}
+
+	return stat.Size(), nil
+}
+
 // InstallTempFile moves a file from the temporary file area to its location in a workspace
 func (lfs *LocalFSHandler) InstallTempFile(wid string, name string, dest string) (string, error) {
 	pattern := regexp.MustCompile("[\\da-fA-F]{8}-?[\\da-fA-F]{4}-?[\\da-fA-F]{4}-?[\\da-fA-F]{4}-?[\\da-fA-F]{12}")
@@ -448,10 +524,10 @@ func (lfs *LocalFSHandler) MoveFile(source string, dest string) error {
 	return os.Rename(srcAnpath.ProviderPath(), newPath)
 }
 
-// OpenFile opens the specified file for reading data and returns a file handle as a string. The
-// contents of the handle are specific to the provider and should not be expected to follow any
-// particular format
-func (lfs *LocalFSHandler) OpenFile(path string) (string, error) {
+// OpenFile opens the specified file for reading data on behalf of a session and returns a file
+// handle as a string. The contents of the handle are specific to the provider and should not be
+// expected to follow any particular format
+func (lfs *LocalFSHandler) OpenFile(session string, path string) (string, error) {
 	// Path validation handled in Set()
 	var anpath LocalAnPath
 	err := anpath.Set(path)
@@ -467,9 +543,62 @@ func (lfs *LocalFSHandler) OpenFile(path string) (string, error) {
 	var providerHandle LocalFSHandle
 	providerHandle.Path = anpath.ProviderPath()
 	providerHandle.Handle = handle
-	lfs.Files[path] = providerHandle
 
-	return anpath.AnselusPath(), nil
+	return lfs.Files.add(session, &providerHandle)
+}
+
+// OpenTempFile reopens an existing file in the temporary file area so that an interrupted upload
+// can be resumed. Any data past the specified offset is discarded and the returned handle is
+// positioned at the offset. The caller is responsible for closing the handle when finished.
+func (lfs *LocalFSHandler) OpenTempFile(wid string, name string, offset int64) (*os.File, error) {
+	pattern := regexp.MustCompile("[\\da-fA-F]{8}-?[\\da-fA-F]{4}-?[\\da-fA-F]{4}-?[\\da-fA-F]{4}-?[\\da-fA-F]{12}")
+	if (len(wid) != 36 && len(wid) != 32) || !pattern.MatchString(wid) {
+		return nil, errors.New("bad workspace id")
+	}
+
+	if !ValidateTempFileName(name) {
+		return nil, errors.New("bad tempfile name")
+	}
+
+	if offset < 0 {
+		return nil, errors.New("bad offset")
+	}
+
+	tempFilePath := filepath.Join(viper.GetString("global.workspace_dir"), "tmp", wid, name)
+	stat, err := os.Stat(tempFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		return nil, errors.New("temp path is a not file")
+	}
+	if stat.Size() < offset {
+		return nil, errors.New("offset past end of file")
+	}
+
+	handle, err := os.OpenFile(tempFilePath, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = handle.Truncate(offset)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	_, err = handle.Seek(offset, io.SeekStart)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	return handle, nil
+}
+
+// ProviderType returns the type of storage handled by the provider
+func (lfs *LocalFSHandler) ProviderType() string {
+	return "local"
 }
 
 // ReadFile reads data from a file opened with OpenFile. If the Read() call encounters the end of
@@ -477,15 +606,14 @@ func (lfs *LocalFSHandler) OpenFile(path string) (string, error) {
 // closed.
 func (lfs *LocalFSHandler) ReadFile(handle string, buffer []byte) (int, error) {
 
-	lfsh, exists := lfs.Files[handle]
-	if !exists {
-		return 0, os.ErrNotExist
+	file, err := lfs.Files.get(handle)
+	if err != nil {
+		return 0, err
 	}
 
-	bytesRead, err := lfsh.Handle.Read(buffer)
+	bytesRead, err := file.(*LocalFSHandle).Handle.Read(buffer)
 	if err == io.EOF {
-		lfsh.Handle.Close()
-		delete(lfs.Files, handle)
+		lfs.Files.Close(handle)
 	}
 	return bytesRead, err
 }
@@ -514,30 +642,46 @@ func (lfs *LocalFSHandler) RemoveDirectory(path string, recursive bool) error {
 	return os.Remove(anpath.LocalPath)
 }
 
+// SeekFile moves the read position of a file opened with OpenFile to the specified offset from
+// the beginning of the file.
+func (lfs *LocalFSHandler) SeekFile(handle string, offset int64) error {
+	file, err := lfs.Files.get(handle)
+	if err != nil {
+		return err
+	}
+
+	if offset < 0 {
+		return errors.New("bad offset")
+	}
+
+	_, err = file.(*LocalFSHandle).Handle.Seek(offset, io.SeekStart)
+	return err
+}
+
 // Select confirms that the given path is a valid working directory for the user
-func (lfs *LocalFSHandler) Select(path string) (LocalAnPath, error) {
+func (lfs *LocalFSHandler) Select(path string) (AnPath, error) {
 
 	// Path validation handled in FromPath()
 	var anpath LocalAnPath
 	err := anpath.Set(path)
 	if err != nil {
-		return anpath, err
+		return nil, err
 	}
 
 	stat, err := os.Stat(anpath.LocalPath)
 	if err != nil {
-		return anpath, err
+		return nil, err
 	}
 	if !stat.IsDir() {
-		return anpath, errors.New("directory path is a file")
+		return nil, errors.New("directory path is a file")
 	}
 
-	return anpath, nil
+	return &anpath, nil
 }
 
 // RemoveWorkspace deletes all file and folder data for the specified workspace. This call does
 // not validate the workspace string. Validation is the caller's responsibility.
-func RemoveWorkspace(wid string) error {
+func (lfs *LocalFSHandler) RemoveWorkspace(wid string) error {
 	allWorkspacesRoot := viper.GetString("global.workspace_dir")
 	if len(allWorkspacesRoot) < 1 {
 		return errors.New("empty workspace path")
@@ -178,7 +178,7 @@ func TestLocalFSHandler_CopyFile(t *testing.T) {
 	wid := "11111111-1111-1111-1111-111111111111"
 	srcDirName := "10000000-0000-0000-0000-000000000001"
 	destDirName := "20000000-0000-0000-0000-000000000002"
-	fsh := GetFSHandler()
+	fsh := GetLocalFSHandler()
 
 	err = fsh.MakeDirectory("/ " + wid + " " + srcDirName)
 	if err != nil {
@@ -245,13 +245,13 @@ func TestLocalFSHandler_CloseFile(t *testing.T) {
 	}
 
 	wid := "11111111-1111-1111-1111-111111111111"
-	fsh := GetFSHandler()
+	fsh := GetLocalFSHandler()
 
 	// Subtest #1: File not open
 
 	filePath := strings.Join([]string{"/", wid, "12345678-1234-1234-1234-1234567890ab",
 		GenerateFileName(1000)}, " ")
-	_, err = fsh.OpenFile(filePath)
+	_, err = fsh.OpenFile("session", filePath)
 	if err == nil {
 		t.Fatalf("TestLocalFSHandler_CloseFile: subtest #1 failed to handle missing handle")
 	}
@@ -266,7 +266,7 @@ func TestLocalFSHandler_CloseFile(t *testing.T) {
 	}
 
 	filePath = strings.Join([]string{"/", wid, tempName}, " ")
-	handle, err := fsh.OpenFile(filePath)
+	handle, err := fsh.OpenFile("session", filePath)
 	if err != nil {
 		t.Fatalf("TestLocalFSHandler_CloseFile: subtest #2 failed to open file: %s",
 			err.Error())
@@ -278,12 +278,55 @@ func TestLocalFSHandler_CloseFile(t *testing.T) {
 			err.Error())
 	}
 
-	_, exists := fsh.Files[handle]
+	exists := fsh.Files.Exists(handle)
 	if exists {
 		t.Fatal("TestLocalFSHandler_CloseFile: subtest #2 handle still exists after close")
 	}
 }
 
+func TestLocalFSHandler_CopyTempFile(t *testing.T) {
+	err := setupTest()
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_CopyTempFile: Couldn't reset workspace dir: %s",
+			err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	fsh := GetLocalFSHandler()
+
+	// Subtest #1: File doesn't exist
+
+	_, err = fsh.CopyTempFile(wid, GenerateTempFileName())
+	if err == nil {
+		t.Fatal("TestLocalFSHandler_CopyTempFile: subtest #1 failed to handle nonexistent file")
+	}
+
+	// Subtest #2: Actual success
+
+	tempHandle, tempName, err := fsh.MakeTempFile(wid)
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_CopyTempFile: unexpected error making temp file for "+
+			"subtest #2: %s", err.Error())
+	}
+	tempHandle.Write([]byte("0123456789"))
+	tempHandle.Close()
+
+	newName, err := fsh.CopyTempFile(wid, tempName)
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_CopyTempFile: subtest #2 failed to copy file: %s",
+			err.Error())
+	}
+	if newName == tempName {
+		t.Fatal("TestLocalFSHandler_CopyTempFile: subtest #2 copy has the same name")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(viper.GetString("global.workspace_dir"), "tmp",
+		wid, newName))
+	if err != nil || string(data) != "0123456789" {
+		t.Fatal("TestLocalFSHandler_CopyTempFile: subtest #2 copy has the wrong contents")
+	}
+}
+
 func TestLocalFSHandler_DeleteFile(t *testing.T) {
 	err := setupTest()
 	if err != nil {
@@ -292,7 +335,7 @@ func TestLocalFSHandler_DeleteFile(t *testing.T) {
 	}
 
 	wid := "11111111-1111-1111-1111-111111111111"
-	fsh := GetFSHandler()
+	fsh := GetLocalFSHandler()
 
 	// Subtest #1: Bad path
 
@@ -335,6 +378,52 @@ func TestLocalFSHandler_DeleteFile(t *testing.T) {
 	}
 }
 
+func TestLocalFSHandler_DeleteTempFile(t *testing.T) {
+	err := setupTest()
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_DeleteTempFile: Couldn't reset workspace dir: %s",
+			err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	fsh := GetLocalFSHandler()
+
+	// Subtest #1: Bad name
+
+	err = fsh.DeleteTempFile(wid, "not a temp name")
+	if err == nil {
+		t.Fatal("TestLocalFSHandler_DeleteTempFile: subtest #1 failed to handle bad name")
+	}
+
+	// Subtest #2: File doesn't exist
+
+	err = fsh.DeleteTempFile(wid, GenerateTempFileName())
+	if err == nil {
+		t.Fatal("TestLocalFSHandler_DeleteTempFile: subtest #2 failed to handle nonexistent file")
+	}
+
+	// Subtest #3: Actual success
+
+	tempHandle, tempName, err := fsh.MakeTempFile(wid)
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_DeleteTempFile: unexpected error making temp file for "+
+			"subtest #3: %s", err.Error())
+	}
+	tempHandle.Close()
+
+	err = fsh.DeleteTempFile(wid, tempName)
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_DeleteTempFile: subtest #3 failed to delete file: %s",
+			err.Error())
+	}
+
+	expectedPath := filepath.Join(viper.GetString("global.workspace_dir"), "tmp", wid, tempName)
+	_, err = os.Stat(expectedPath)
+	if !os.IsNotExist(err) {
+		t.Fatal("TestLocalFSHandler_DeleteTempFile: subtest #3 temp file still exists")
+	}
+}
+
 func TestLocalFSHandler_Exists(t *testing.T) {
 	err := setupTest()
 	if err != nil {
@@ -350,7 +439,7 @@ func TestLocalFSHandler_Exists(t *testing.T) {
 		t.Fatalf("TestLocalFSHandler_Exists: Couldn't create wid: %s", err.Error())
 	}
 
-	fsh := GetFSHandler()
+	fsh := GetLocalFSHandler()
 
 	// Subtest #1: bad path
 	_, err = fsh.Exists("/var/anselus/" + wid)
@@ -388,7 +477,7 @@ func TestLocalFSHandler_GetDiskUsage(t *testing.T) {
 
 	wid := "11111111-1111-1111-1111-111111111111"
 	testPath := "/ " + wid
-	fsh := GetFSHandler()
+	fsh := GetLocalFSHandler()
 
 	// Subtest #1: bad WID
 
@@ -426,6 +515,50 @@ func TestLocalFSHandler_GetDiskUsage(t *testing.T) {
 	}
 }
 
+func TestLocalFSHandler_GetFileSize(t *testing.T) {
+	err := setupTest()
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_GetFileSize: Couldn't reset workspace dir: %s",
+			err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	fsh := GetLocalFSHandler()
+
+	// Subtest #1: File doesn't exist
+
+	filePath := strings.Join([]string{"/", wid, GenerateFileName(1000)}, " ")
+	_, err = fsh.GetFileSize(filePath)
+	if err == nil {
+		t.Fatal("TestLocalFSHandler_GetFileSize: subtest #1 failed to handle nonexistent file")
+	}
+
+	// Subtest #2: Path is a directory
+
+	fsh.MakeDirectory("/ " + wid)
+	_, err = fsh.GetFileSize("/ " + wid)
+	if err == nil {
+		t.Fatal("TestLocalFSHandler_GetFileSize: subtest #2 failed to handle directory")
+	}
+
+	// Subtest #3: Actual success
+
+	tempName, err := generateRandomFile("/ "+wid, 2500)
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_GetFileSize: subtest #3 failed to create test file: %s",
+			err.Error())
+	}
+
+	fileSize, err := fsh.GetFileSize(strings.Join([]string{"/", wid, tempName}, " "))
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_GetFileSize: subtest #3 failed to get file size: %s",
+			err.Error())
+	}
+	if fileSize != 2500 {
+		t.Fatalf("TestLocalFSHandler_GetFileSize: subtest #3 got wrong file size: %d", fileSize)
+	}
+}
+
 func TestLocalFSHandler_InstallTempFile(t *testing.T) {
 	err := setupTest()
 	if err != nil {
@@ -434,7 +567,7 @@ func TestLocalFSHandler_InstallTempFile(t *testing.T) {
 	}
 
 	wid := "11111111-1111-1111-1111-111111111111"
-	fsh := GetFSHandler()
+	fsh := GetLocalFSHandler()
 
 	// Subtest #2: destination doesn't exist
 
@@ -484,7 +617,7 @@ func TestLocalFSHandler_ListFiles(t *testing.T) {
 
 	wid := "11111111-1111-1111-1111-111111111111"
 	testPath := "/ " + wid
-	fsh := GetFSHandler()
+	fsh := GetLocalFSHandler()
 
 	// Subtest #1: bad path
 
@@ -569,7 +702,7 @@ func TestLocalFSHandler_ListDirectories(t *testing.T) {
 		"33333333-3333-3333-3333-333333333333",
 		"44444444-4444-4444-4444-444444444444"}
 	testPath := "/ " + wid
-	fsh := GetFSHandler()
+	fsh := GetLocalFSHandler()
 
 	// Subtest #1: bad path
 
@@ -645,7 +778,7 @@ func TestLocalFSHandler_MakeDirectory(t *testing.T) {
 
 	wid := "11111111-1111-1111-1111-111111111111"
 	wid2 := "22222222-2222-2222-2222-222222222222"
-	fsh := GetFSHandler()
+	fsh := GetLocalFSHandler()
 
 	// Subtest #1: bad path
 	err = fsh.MakeDirectory("/var/anselus/" + wid)
@@ -685,7 +818,7 @@ func TestLocalFSHandler_MakeTempFile(t *testing.T) {
 	}
 
 	wid := "11111111-1111-1111-1111-111111111111"
-	fsh := GetFSHandler()
+	fsh := GetLocalFSHandler()
 
 	// Subtest #1: bad WID
 
@@ -737,7 +870,7 @@ func TestLocalFSHandler_MoveFile(t *testing.T) {
 	wid := "11111111-1111-1111-1111-111111111111"
 	srcDirName := "10000000-0000-0000-0000-000000000001"
 	destDirName := "20000000-0000-0000-0000-000000000002"
-	fsh := GetFSHandler()
+	fsh := GetLocalFSHandler()
 
 	err = fsh.MakeDirectory("/ " + wid + " " + srcDirName)
 	if err != nil {
@@ -830,13 +963,13 @@ func TestLocalFSHandler_OpenReadFile(t *testing.T) {
 	}
 
 	wid := "11111111-1111-1111-1111-111111111111"
-	fsh := GetFSHandler()
+	fsh := GetLocalFSHandler()
 
 	// Subtest #1: Bad path
 
 	filePath := strings.Join([]string{"/", wid, "12345678-1234-1234-1234-1234567890ab",
 		GenerateFileName(1000)}, " ")
-	_, err = fsh.OpenFile(filePath)
+	_, err = fsh.OpenFile("session", filePath)
 	if err == nil {
 		t.Fatalf("TestLocalFSHandler_OpenReadFile: subtest #1 failed to handle bad path")
 	}
@@ -844,7 +977,7 @@ func TestLocalFSHandler_OpenReadFile(t *testing.T) {
 	// Subtest #2: File doesn't exist
 
 	filePath = strings.Join([]string{"/", wid, GenerateFileName(1000)}, " ")
-	_, err = fsh.OpenFile(filePath)
+	_, err = fsh.OpenFile("session", filePath)
 	if err == nil {
 		t.Fatalf("TestLocalFSHandler_OpenReadFile: subtest #2 failed to handle nonexistent file")
 	}
@@ -859,7 +992,7 @@ func TestLocalFSHandler_OpenReadFile(t *testing.T) {
 	}
 
 	filePath = strings.Join([]string{"/", wid, tempName}, " ")
-	handle, err := fsh.OpenFile(filePath)
+	handle, err := fsh.OpenFile("session", filePath)
 	if err != nil {
 		t.Fatalf("TestLocalFSHandler_OpenReadFile: subtest #3 failed to open file: %s",
 			err.Error())
@@ -881,12 +1014,120 @@ func TestLocalFSHandler_OpenReadFile(t *testing.T) {
 				bytesRead)
 		}
 	}
-	_, exists := fsh.Files[handle]
+	exists := fsh.Files.Exists(handle)
 	if exists {
 		t.Fatal("TestLocalFSHandler_OpenReadFile: subtest #3 handle still exists after close")
 	}
 }
 
+func TestLocalFSHandler_OpenTempFile(t *testing.T) {
+	err := setupTest()
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_OpenTempFile: Couldn't reset workspace dir: %s",
+			err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	fsh := GetLocalFSHandler()
+
+	// Subtest #1: File doesn't exist
+
+	_, err = fsh.OpenTempFile(wid, GenerateTempFileName(), 0)
+	if err == nil {
+		t.Fatal("TestLocalFSHandler_OpenTempFile: subtest #1 failed to handle nonexistent file")
+	}
+
+	tempHandle, tempName, err := fsh.MakeTempFile(wid)
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_OpenTempFile: unexpected error making temp file: %s",
+			err.Error())
+	}
+	_, err = tempHandle.Write([]byte("0123456789"))
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_OpenTempFile: unexpected error writing to temp file: %s",
+			err.Error())
+	}
+	tempHandle.Close()
+
+	// Subtest #2: Offset past end of file
+
+	_, err = fsh.OpenTempFile(wid, tempName, 11)
+	if err == nil {
+		t.Fatal("TestLocalFSHandler_OpenTempFile: subtest #2 failed to handle bad offset")
+	}
+
+	// Subtest #3: Actual success. Data past the offset is expected to be discarded.
+
+	tempHandle, err = fsh.OpenTempFile(wid, tempName, 5)
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_OpenTempFile: subtest #3 failed to open file: %s",
+			err.Error())
+	}
+	_, err = tempHandle.Write([]byte("abcde"))
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_OpenTempFile: subtest #3 failed to write to file: %s",
+			err.Error())
+	}
+	tempHandle.Close()
+
+	expectedPath := filepath.Join(viper.GetString("global.workspace_dir"), "tmp", wid, tempName)
+	data, err := ioutil.ReadFile(expectedPath)
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_OpenTempFile: subtest #3 failed to read file: %s",
+			err.Error())
+	}
+	if string(data) != "01234abcde" {
+		t.Fatalf("TestLocalFSHandler_OpenTempFile: subtest #3 got wrong file data: %s",
+			string(data))
+	}
+}
+
+func TestLocalFSHandler_SeekFile(t *testing.T) {
+	err := setupTest()
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_SeekFile: Couldn't reset workspace dir: %s",
+			err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	fsh := GetLocalFSHandler()
+
+	// Subtest #1: File not open
+
+	err = fsh.SeekFile("not a handle", 0)
+	if err == nil {
+		t.Fatal("TestLocalFSHandler_SeekFile: subtest #1 failed to handle missing handle")
+	}
+
+	// Subtest #2: Actual success
+
+	fsh.MakeDirectory("/ " + wid)
+	tempName, err := generateRandomFile("/ "+wid, 1000)
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_SeekFile: subtest #2 failed to create test file: %s",
+			err.Error())
+	}
+
+	handle, err := fsh.OpenFile("session", strings.Join([]string{"/", wid, tempName}, " "))
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_SeekFile: subtest #2 failed to open file: %s",
+			err.Error())
+	}
+	defer fsh.CloseFile(handle)
+
+	err = fsh.SeekFile(handle, 900)
+	if err != nil {
+		t.Fatalf("TestLocalFSHandler_SeekFile: subtest #2 failed to seek: %s", err.Error())
+	}
+
+	buffer := make([]byte, 1000)
+	bytesRead, err := fsh.ReadFile(handle, buffer)
+	if bytesRead != 100 || err != nil {
+		t.Fatalf("TestLocalFSHandler_SeekFile: subtest #2 read wrong amount: %v bytes read",
+			bytesRead)
+	}
+}
+
 func TestLocalFSHandler_RemoveDirectory(t *testing.T) {
 	err := setupTest()
 	if err != nil {
@@ -895,7 +1136,7 @@ func TestLocalFSHandler_RemoveDirectory(t *testing.T) {
 
 	wid := "11111111-1111-1111-1111-111111111111"
 	wid2 := "22222222-2222-2222-2222-222222222222"
-	fsh := GetFSHandler()
+	fsh := GetLocalFSHandler()
 
 	// Subtest #1: bad path
 
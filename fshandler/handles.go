@@ -0,0 +1,123 @@
+package fshandler
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+// ErrTooManyOpenFiles is returned by OpenFile when a session already has as many files open as
+// permitted by the security.max_open_files setting
+var ErrTooManyOpenFiles = errors.New("too many open files")
+
+// openFile is the provider-specific state for a file opened with OpenFile
+type openFile interface {
+	Close() error
+}
+
+type fileTableEntry struct {
+	owner string
+	file  openFile
+}
+
+// FileTable tracks the files opened by all sessions on behalf of a provider. Each open file gets
+// a randomly-generated handle so that sessions opening the same file don't interfere with each
+// other. It is safe for concurrent use.
+type FileTable struct {
+	lock    sync.Mutex
+	entries map[string]fileTableEntry
+	counts  map[string]int
+}
+
+// NewFileTable creates an empty file table
+func NewFileTable() *FileTable {
+	return &FileTable{
+		entries: make(map[string]fileTableEntry, 100),
+		counts:  make(map[string]int, 100),
+	}
+}
+
+// add registers an open file for an owner and returns its new handle. If the owner is already at
+// the limit, the file is closed and ErrTooManyOpenFiles is returned.
+func (ft *FileTable) add(owner string, file openFile) (string, error) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+
+	limit := viper.GetInt("security.max_open_files")
+	if limit > 0 && ft.counts[owner] >= limit {
+		file.Close()
+		return "", ErrTooManyOpenFiles
+	}
+
+	handle := uuid.New().String()
+	ft.entries[handle] = fileTableEntry{owner, file}
+	ft.counts[owner]++
+	return handle, nil
+}
+
+// get returns the open file for a handle
+func (ft *FileTable) get(handle string) (openFile, error) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+
+	entry, exists := ft.entries[handle]
+	if !exists {
+		return nil, os.ErrNotExist
+	}
+	return entry.file, nil
+}
+
+// Close closes the file for a handle and removes it from the table
+func (ft *FileTable) Close(handle string) error {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+
+	entry, exists := ft.entries[handle]
+	if !exists {
+		return os.ErrNotExist
+	}
+	ft.remove(handle, entry.owner)
+	return entry.file.Close()
+}
+
+// CloseOwner closes all files opened by an owner
+func (ft *FileTable) CloseOwner(owner string) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+
+	for handle, entry := range ft.entries {
+		if entry.owner == owner {
+			ft.remove(handle, owner)
+			entry.file.Close()
+		}
+	}
+}
+
+// Count returns the number of files an owner has open
+func (ft *FileTable) Count(owner string) int {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+
+	return ft.counts[owner]
+}
+
+// Exists checks to see if a handle is open
+func (ft *FileTable) Exists(handle string) bool {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+
+	_, exists := ft.entries[handle]
+	return exists
+}
+
+// remove deletes a table entry. The caller must hold the lock.
+func (ft *FileTable) remove(handle string, owner string) {
+	delete(ft.entries, handle)
+	ft.counts[owner]--
+	if ft.counts[owner] <= 0 {
+		delete(ft.counts, owner)
+	}
+}
@@ -0,0 +1,86 @@
+package fshandler
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestFileTable(t *testing.T) {
+	err := setupTest()
+	if err != nil {
+		t.Fatalf("TestFileTable: Couldn't reset workspace dir: %s", err.Error())
+	}
+
+	wid := "11111111-1111-1111-1111-111111111111"
+	fsh := GetLocalFSHandler()
+	fsh.MakeDirectory("/ " + wid)
+	tempName, err := generateRandomFile("/ "+wid, 1024)
+	if err != nil {
+		t.Fatalf("TestFileTable: failed to create test file: %s", err.Error())
+	}
+	filePath := strings.Join([]string{"/", wid, tempName}, " ")
+
+	// Subtest #1: two sessions opening the same file get separate handles
+
+	handle1, err := fsh.OpenFile("session1", filePath)
+	if err != nil {
+		t.Fatalf("TestFileTable: subtest #1 failed to open file: %s", err.Error())
+	}
+	handle2, err := fsh.OpenFile("session2", filePath)
+	if err != nil {
+		t.Fatalf("TestFileTable: subtest #1 failed to open file: %s", err.Error())
+	}
+	if handle1 == handle2 {
+		t.Fatal("TestFileTable: subtest #1 sessions received the same handle")
+	}
+	fsh.CloseFile(handle1)
+	if !fsh.Files.Exists(handle2) {
+		t.Fatal("TestFileTable: subtest #1 closing one session's handle closed the other's")
+	}
+	fsh.CloseFile(handle2)
+
+	// Subtest #2: handle limit
+
+	viper.Set("security.max_open_files", 2)
+	defer viper.Set("security.max_open_files", 16)
+	for i := 0; i < 2; i++ {
+		if _, err = fsh.OpenFile("session3", filePath); err != nil {
+			t.Fatalf("TestFileTable: subtest #2 failed to open file: %s", err.Error())
+		}
+	}
+	if _, err = fsh.OpenFile("session3", filePath); err != ErrTooManyOpenFiles {
+		t.Fatalf("TestFileTable: subtest #2 open file limit not enforced: %v", err)
+	}
+
+	// Subtest #3: session cleanup
+
+	fsh.CloseSessionFiles("session3")
+	if fsh.Files.Count("session3") != 0 {
+		t.Fatal("TestFileTable: subtest #3 session's handles not closed")
+	}
+
+	// Subtest #4: concurrent access
+
+	viper.Set("security.max_open_files", 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(owner string) {
+			defer wg.Done()
+			buffer := make([]byte, 256)
+			for j := 0; j < 10; j++ {
+				handle, err := fsh.OpenFile(owner, filePath)
+				if err != nil {
+					t.Errorf("TestFileTable: subtest #4 failed to open file: %s", err.Error())
+					return
+				}
+				fsh.ReadFile(handle, buffer)
+				fsh.CloseFile(handle)
+			}
+		}(strings.Repeat("x", i+1))
+	}
+	wg.Wait()
+}
@@ -130,3 +130,114 @@ func GenerateFileName(filesize int) string {
 func GenerateTempFileName() string {
 	return fmt.Sprintf("%d.%s", time.Now().Unix(), uuid.New().String())
 }
+
+// InboxDir is the name of the directory in each workspace which receives delivered messages
+const InboxDir = "3d1f3a5c-7b38-4ab3-a8c1-58a5c1d0e9d2"
+
+// InboxPath returns the Anselus path of the inbox for a workspace
+func InboxPath(wid string) string {
+	return "/ " + strings.ToLower(wid) + " " + InboxDir
+}
+
+// FSRoot confines filesystem access to a subtree of the workspace hierarchy. Each client session
+// has one, which is normally bound to the workspace the client logged into. The zero value
+// contains nothing, so a session which has not been given a root can't access anything.
+type FSRoot struct {
+	path string
+}
+
+// NewFSRoot creates an FSRoot for the workspace specified
+func NewFSRoot(wid string) (FSRoot, error) {
+	var out FSRoot
+
+	pattern := regexp.MustCompile(
+		"^[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}$")
+	if !pattern.MatchString(wid) {
+		return out, errors.New("bad workspace id")
+	}
+
+	out.path = "/ " + strings.ToLower(wid)
+	return out, nil
+}
+
+// Path returns the Anselus path of the root directory. It is empty if the root is not set.
+func (r FSRoot) Path() string {
+	return r.path
+}
+
+// WID returns the ID of the workspace the root is bound to. It is empty if the root is not set.
+func (r FSRoot) WID() string {
+	if r.path == "" {
+		return ""
+	}
+	return r.path[2:]
+}
+
+// IsSet returns true if the root has been bound to a workspace
+func (r FSRoot) IsSet() bool {
+	return r.path != ""
+}
+
+// Contains returns true if the Anselus path given is the root itself or is inside of it. Invalid
+// paths are never contained by a root.
+func (r FSRoot) Contains(path string) bool {
+	if r.path == "" || !ValidateAnselusPath(path) {
+		return false
+	}
+
+	path = strings.ToLower(path)
+	return path == r.path || strings.HasPrefix(path, r.path+" ")
+}
+
+// ErrOutsideRoot is returned by Resolve when a path is not inside the root
+var ErrOutsideRoot = errors.New("path outside root")
+
+// Resolve converts a path from a client into an absolute Anselus path inside the root. Absolute
+// paths begin with a slash and are used as-is. Relative paths are a space-separated list of names
+// applied to the current directory, where '..' refers to the parent directory. If current is
+// empty, the root itself is used. An error is returned if the resulting path is invalid or is not
+// inside the root.
+func (r FSRoot) Resolve(current string, path string) (string, error) {
+	if r.path == "" {
+		return "", errors.New("root not set")
+	}
+
+	var out string
+	if strings.HasPrefix(path, "/") {
+		out = path
+	} else {
+		if current == "" || !r.Contains(current) {
+			current = r.path
+		}
+
+		parts := strings.Split(current, " ")
+		for _, part := range strings.Fields(path) {
+			switch part {
+			case ".":
+				// Current directory. Nothing to do.
+			case "..":
+				// Stepping above the root is refused below, so popping the last part is safe here
+				// as long as there's something to pop besides the leading slash
+				if len(parts) < 2 {
+					return "", ErrOutsideRoot
+				}
+				parts = parts[:len(parts)-1]
+			default:
+				parts = append(parts, part)
+			}
+		}
+		out = strings.Join(parts, " ")
+		if out == "" {
+			out = "/"
+		}
+	}
+
+	if !ValidateAnselusPath(out) {
+		return "", errors.New("invalid path")
+	}
+	if !r.Contains(out) {
+		return "", ErrOutsideRoot
+	}
+
+	return out, nil
+}
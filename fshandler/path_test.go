@@ -60,3 +60,77 @@ func TestAnPath_SetFromString(t *testing.T) {
 		t.Fatal("LocalAnPath.Set failed to set the correct path")
 	}
 }
+
+func TestFSRoot_Contains(t *testing.T) {
+
+	wid := "3e782960-a762-4def-8038-a1d0a3cd951d"
+	root, err := NewFSRoot(wid)
+	if err != nil {
+		t.Fatalf("TestFSRoot_Contains: NewFSRoot failed on a valid workspace ID: %s", err)
+	}
+
+	// Subtest #1: the root itself and paths inside it
+
+	if !root.Contains("/ " + wid) {
+		t.Fatal("TestFSRoot_Contains: subtest #1 root doesn't contain itself")
+	}
+	if !root.Contains("/ " + wid + " e5c2f479-b9db-4475-8152-e76605e731fc") {
+		t.Fatal("TestFSRoot_Contains: subtest #1 root doesn't contain a subdirectory")
+	}
+
+	// Subtest #2: paths outside the root
+
+	if root.Contains("/") {
+		t.Fatal("TestFSRoot_Contains: subtest #2 root contains the top of the hierarchy")
+	}
+	if root.Contains("/ e5c2f479-b9db-4475-8152-e76605e731fc " + wid) {
+		t.Fatal("TestFSRoot_Contains: subtest #2 root contains another workspace")
+	}
+
+	// Subtest #3: zero value contains nothing
+
+	var empty FSRoot
+	if empty.Contains("/ " + wid) {
+		t.Fatal("TestFSRoot_Contains: subtest #3 unset root contains a path")
+	}
+}
+
+func TestFSRoot_Resolve(t *testing.T) {
+
+	wid := "3e782960-a762-4def-8038-a1d0a3cd951d"
+	subdir := "e5c2f479-b9db-4475-8152-e76605e731fc"
+	root, err := NewFSRoot(wid)
+	if err != nil {
+		t.Fatalf("TestFSRoot_Resolve: NewFSRoot failed on a valid workspace ID: %s", err)
+	}
+
+	// Subtest #1: relative path from the root when there is no current directory
+
+	out, err := root.Resolve("", subdir)
+	if err != nil || out != "/ "+wid+" "+subdir {
+		t.Fatalf("TestFSRoot_Resolve: subtest #1 failed to resolve a relative path: %s", out)
+	}
+
+	// Subtest #2: parent directory
+
+	out, err = root.Resolve("/ "+wid+" "+subdir, "..")
+	if err != nil || out != "/ "+wid {
+		t.Fatalf("TestFSRoot_Resolve: subtest #2 failed to resolve the parent directory: %s", out)
+	}
+
+	// Subtest #3: absolute path
+
+	out, err = root.Resolve("", "/ "+wid+" "+subdir)
+	if err != nil || out != "/ "+wid+" "+subdir {
+		t.Fatalf("TestFSRoot_Resolve: subtest #3 failed to resolve an absolute path: %s", out)
+	}
+
+	// Subtest #4: escaping the root
+
+	if _, err = root.Resolve("", ".."); err == nil {
+		t.Fatal("TestFSRoot_Resolve: subtest #4 resolved a path above the root")
+	}
+	if _, err = root.Resolve("", "/ "+subdir); err == nil {
+		t.Fatal("TestFSRoot_Resolve: subtest #4 resolved an absolute path outside the root")
+	}
+}
@@ -0,0 +1,74 @@
+package fshandler
+
+import (
+	"os"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// FSProvider is the interface implemented by storage backends for workspace data. All paths
+// passed to a provider are Anselus paths and all handles returned are strings whose contents are
+// specific to the provider.
+//
+// Temporary files for uploads are always staged on local disk, regardless of provider, so that
+// interrupted transfers can be resumed cheaply. InstallTempFile moves them into the provider's
+// storage.
+type FSProvider interface {
+	// ProviderType returns a string which indicates the kind of storage the provider handles. It
+	// is expected to be all lowercase. Subtypes can be indicated by a period separator.
+	ProviderType() string
+
+	CopyFile(source string, dest string) (string, error)
+	CopyTempFile(wid string, name string) (string, error)
+	CloseFile(handle string) error
+	CloseSessionFiles(session string)
+	DeleteFile(path string) error
+	DeleteTempFile(wid string, name string) error
+	Exists(path string) (bool, error)
+	GetDiskUsage(wid string) (uint64, error)
+	GetFileSize(path string) (int64, error)
+	InstallTempFile(wid string, name string, dest string) (string, error)
+	ListDirectories(path string) ([]string, error)
+	ListFiles(path string, afterTime int64) ([]string, error)
+	MakeDirectory(path string) error
+	MakeTempFile(wid string) (*os.File, string, error)
+	MoveFile(source string, dest string) error
+	OpenFile(session string, path string) (string, error)
+	OpenTempFile(wid string, name string, offset int64) (*os.File, error)
+	ReadFile(handle string, buffer []byte) (int, error)
+	RemoveDirectory(path string, recursive bool) error
+	RemoveWorkspace(wid string) error
+	SeekFile(handle string, offset int64) error
+	Select(path string) (AnPath, error)
+}
+
+var providerLock = &sync.Mutex{}
+var providerInstance FSProvider
+
+// GetFSHandler returns the filesystem provider selected by the storage.provider setting in the
+// server configuration.
+func GetFSHandler() FSProvider {
+	if providerInstance == nil {
+		providerLock.Lock()
+		defer providerLock.Unlock()
+
+		if providerInstance == nil {
+			switch viper.GetString("storage.provider") {
+			case "s3":
+				providerInstance = GetS3FSHandler()
+			default:
+				providerInstance = GetLocalFSHandler()
+			}
+		}
+	}
+
+	return providerInstance
+}
+
+// RemoveWorkspace deletes all file and folder data for the specified workspace from the
+// configured provider. This call does not validate the workspace string. Validation is the
+// caller's responsibility.
+func RemoveWorkspace(wid string) error {
+	return GetFSHandler().RemoveWorkspace(wid)
+}
@@ -98,7 +98,7 @@ type Entry struct {
 
 // IsDataCompliant checks only the data fields of the entry to ensure that they are valid
 func (entry Entry) IsDataCompliant() bool {
-	if entry.Type != "User" && entry.Type != "Organization" {
+	if entry.Type != "User" && entry.Type != "Organization" && entry.Type != "Revocation" {
 		return false
 	}
 
@@ -117,9 +117,12 @@ func (entry Entry) IsDataCompliant() bool {
 	}
 
 	var dataValid bool
-	if entry.Type == "User" {
+	switch entry.Type {
+	case "User":
 		dataValid, _ = entry.validateUserEntry()
-	} else {
+	case "Revocation":
+		dataValid, _ = entry.validateRevocationEntry()
+	default:
 		dataValid, _ = entry.validateOrgEntry()
 	}
 
@@ -300,13 +303,14 @@ func (entry *Entry) Set(data []byte) error {
 			return errors.New("entry type-data type mismatch")
 		}
 
-	} else if entry.Type == "User" {
+	} else if entry.Type == "User" || entry.Type == "Revocation" {
+		// Revocations are part of user keycards, so they are sent with the same header and footer
 		if lines[0] == "----- BEGIN USER ENTRY -----" {
 			if lines[len(lines)-1] != "----- END USER ENTRY -----" {
 				return errors.New("bad entry header/footer")
 			}
 			stripHeader = true
-		} else if lines[0] != "Type:User" {
+		} else if lines[0] != "Type:"+entry.Type {
 			return errors.New("entry type-data type mismatch")
 		}
 	} else {
@@ -528,7 +532,7 @@ func (entry Entry) VerifySignature(verifyKey cryptostring.CryptoString, sigtype
 // Chain creates a new Entry object with new keys and a custody signature. It requires the
 // previous contact request signing key passed as an cryptostring.CryptoString. The new keys are returned with the
 // string '.private' or '.public' appended to the key's field name, e.g.
-// Primary-Encryption-Key.public.
+// Primary-Encryption-Key.public. The new entry's Previous-Hash is set to the hash of this one.
 //
 // Note that a user's public encryption keys and an organization's alternate verification key are
 // not required to be updated during entry rotation so that they can be rotated on a different
@@ -554,9 +558,14 @@ func (entry *Entry) Chain(key cryptostring.CryptoString, rotateOptional bool) (*
 		return newEntry, outKeys, errors.New("entry not compliant")
 	}
 
+	// The new entry gets its own timestamp and expiration date
 	for k, v := range entry.Fields {
+		if k == "Timestamp" || k == "Expires" {
+			continue
+		}
 		newEntry.Fields[k] = v
 	}
+	newEntry.PrevHash = entry.Hash
 
 	index, err := strconv.ParseUint(newEntry.Fields["Index"], 10, 64)
 	if err != nil {
@@ -600,6 +609,21 @@ func NewEntryFromData(textBlock string) (*Entry, error) {
 	// The minimum number of lines is 11 because every org keycard, which is the smaller of the two,
 	// has 9 required fields in addition to the Type line and the entry header and footer lines.
 	lines := strings.Split(textBlock, "\r\n")
+
+	// Revocations only have 4 required fields, so they need at least 7 lines
+	if lines[0] == "Type:Revocation" {
+		if len(lines) < 7 {
+			return nil, errors.New("entry too short")
+		}
+
+		outEntry := NewRevocationEntry()
+		err := outEntry.Set([]byte(textBlock))
+		if err != nil {
+			return nil, err
+		}
+		return outEntry, nil
+	}
+
 	if len(lines) < 11 {
 		return nil, errors.New("entry too short")
 	}
@@ -659,8 +683,8 @@ func NewOrgEntry() *Entry {
 
 	self.Keys = []KeyInfo{
 		{"Primary-Verification-Key", "signing", false},
-		{"Secondary-Verification-Key", "signing", false},
-		{"Encryption-Key", "encryption", true}}
+		{"Secondary-Verification-Key", "signing", true},
+		{"Encryption-Key", "encryption", false}}
 
 	self.SignatureInfo.Items = []SigInfo{
 		{"Custody", 1, true, SigInfoSignature},
@@ -883,6 +907,77 @@ func NewUserEntry() *Entry {
 	return self
 }
 
+// NewRevocationEntry creates a new revocation entry. A revocation is issued by the organization to
+// break the chain of custody of a user's keycard when the user's contact request signing key is
+// compromised. It is linked to the revoked entry by its Previous-Hash field and signed by the
+// organization instead of the revoked entry's key. The entry which follows it starts a new chain.
+func NewRevocationEntry() *Entry {
+	self := new(Entry)
+	self.Fields = make(map[string]string)
+	self.Signatures = make(map[string]string)
+	self.Keys = make([]KeyInfo, 0)
+
+	self.Type = "Revocation"
+	self.FieldNames.Items = []string{
+		"Index",
+		"Workspace-ID",
+		"Domain",
+		"Timestamp"}
+
+	// If changes are made to the number of these fields, the minimum line count in NewEntryFromData
+	// will need to be updated
+	self.RequiredFields.Items = []string{
+		"Index",
+		"Workspace-ID",
+		"Domain",
+		"Timestamp"}
+
+	// The hashes come before the organization signature so that the link to the revoked entry is
+	// covered by the signature
+	self.SignatureInfo.Items = []SigInfo{
+		{"Hashes", 1, false, SigInfoHash},
+		{"Organization", 2, false, SigInfoSignature}}
+
+	now := time.Now()
+	self.Fields["Timestamp"] = fmt.Sprintf("%d%02d%02dT%02d%02d%02dZ", now.Year(), now.Month(),
+		now.Day(), now.Hour(), now.Minute(), now.Second())
+
+	return self
+}
+
+// validateRevocationEntry checks the validity of all revocation entry data fields
+func (entry Entry) validateRevocationEntry() (bool, error) {
+	// Required field: Index. A revocation always follows the entry it revokes.
+	pattern := regexp.MustCompile("^[[:digit:]]+$")
+	if !pattern.MatchString(entry.Fields["Index"]) {
+		return false, errors.New("bad index")
+	}
+	intValue, _ := strconv.Atoi(entry.Fields["Index"])
+	if intValue < 2 {
+		return false, errors.New("bad index value")
+	}
+
+	// Required field: Workspace-ID
+	pattern = regexp.MustCompile("^[\\da-fA-F]{8}-?[\\da-fA-F]{4}-?[\\da-fA-F]{4}-?[\\da-fA-F]{4}" +
+		"-?[\\da-fA-F]{12}$")
+	if !pattern.MatchString(entry.Fields["Workspace-ID"]) {
+		return false, errors.New("bad workspace id")
+	}
+
+	// Required field: Domain
+	pattern = regexp.MustCompile("([a-zA-Z0-9]+\x2E)+[a-zA-Z0-9]+")
+	if !pattern.MatchString(entry.Fields["Domain"]) {
+		return false, errors.New("bad domain")
+	}
+
+	// Required field: Timestamp
+	if IsTimestampValid(entry.Fields["Timestamp"]) != nil {
+		return false, errors.New("invalid timestamp")
+	}
+
+	return true, nil
+}
+
 // validateUserEntry checks the validity all UserEntry data fields to ensure the data in them
 // meets basic data validity checks. Note that this function only checks data format; it does
 // not fail if the entry's Expires field is past due, the Timestamp field is in the future, etc.
@@ -1207,7 +1302,14 @@ func GenerateUserKeys(rotateOptional bool) (map[string]cryptostring.CryptoString
 }
 
 // VerifyChain verifies the chain of custody between the provided previous entry and the current one.
-func (entry Entry) VerifyChain(previous *Entry) (bool, error) {
+// A revocation and the entry following it are not signed with the previous entry's key. Instead,
+// the revocation must carry a valid organization signature, which is checked against orgKey. The
+// organization key isn't used for any other entries.
+func (entry Entry) VerifyChain(previous *Entry, orgKey cryptostring.CryptoString) (bool, error) {
+	if entry.Type == "Revocation" || previous.Type == "Revocation" {
+		return entry.verifyRestart(previous, orgKey)
+	}
+
 	if previous.Type != entry.Type {
 		return false, errors.New("entry type mismatch")
 	}
@@ -1264,6 +1366,82 @@ func (entry Entry) VerifyChain(previous *Entry) (bool, error) {
 	return isValid, err
 }
 
+// verifyRestart checks the link between a user entry and a revocation of it or between a
+// revocation and the entry which starts the new chain after it
+func (entry Entry) verifyRestart(previous *Entry, orgKey cryptostring.CryptoString) (bool, error) {
+	if entry.Type == "Revocation" && previous.Type != "User" {
+		return false, errors.New("revocations may only follow user entries")
+	}
+	if previous.Type == "Revocation" && entry.Type != "User" {
+		return false, errors.New("revocations may only be followed by user entries")
+	}
+
+	if entry.Fields["Workspace-ID"] != previous.Fields["Workspace-ID"] {
+		return false, errors.New("workspace id mismatch")
+	}
+
+	prevIndex, err := strconv.ParseUint(previous.Fields["Index"], 10, 64)
+	if err != nil {
+		return false, errors.New("previous entry has bad index value")
+	}
+
+	var index uint64
+	index, err = strconv.ParseUint(entry.Fields["Index"], 10, 64)
+	if err != nil {
+		return false, errors.New("entry has bad index value")
+	}
+
+	if index != prevIndex+1 {
+		return false, errors.New("entry index compliance failure")
+	}
+
+	if previous.Hash == "" || entry.PrevHash != previous.Hash {
+		return false, errors.New("previous hash mismatch")
+	}
+
+	// Nothing else vouches for the new chain, so the revocation has to be unaltered and signed by
+	// the organization
+	revocation := entry
+	if previous.Type == "Revocation" {
+		revocation = *previous
+	}
+
+	if !orgKey.IsValid() {
+		return false, errors.New("organization key required to verify revocation")
+	}
+
+	isValid, err := revocation.verifyHash()
+	if !isValid {
+		return false, err
+	}
+
+	isValid, err = revocation.VerifySignature(orgKey, "Organization")
+	if err == nil && !isValid {
+		err = errors.New("revocation signature verification failure")
+	}
+	return isValid, err
+}
+
+// verifyHash checks that the entry's hash matches its contents
+func (entry Entry) verifyHash() (bool, error) {
+	parts := strings.SplitN(entry.Hash, ":", 2)
+	if len(parts) != 2 {
+		return false, errors.New("bad hash")
+	}
+
+	check := entry
+	check.Hash = ""
+	err := check.GenerateHash(parts[0])
+	if err != nil {
+		return false, err
+	}
+
+	if check.Hash != entry.Hash {
+		return false, errors.New("hash mismatch")
+	}
+	return true, nil
+}
+
 // Keycard - class which houses a list of entries into a hash-linked chain
 type Keycard struct {
 	Type    string
@@ -1387,8 +1565,9 @@ func (card Keycard) Save(path string, clobber bool) error {
 	return nil
 }
 
-// VerifyChain verifies the entire chain of entries
-func (card Keycard) VerifyChain(path string, clobber bool) (bool, error) {
+// VerifyChain verifies the entire chain of entries. Revocations in user keycards are checked
+// against the organization verification key passed in orgKey.
+func (card Keycard) VerifyChain(orgKey cryptostring.CryptoString) (bool, error) {
 	if len(card.Entries) < 1 {
 		return false, errors.New("no entries in keycard")
 	}
@@ -1398,7 +1577,7 @@ func (card Keycard) VerifyChain(path string, clobber bool) (bool, error) {
 	}
 
 	for i := 0; i < len(card.Entries)-1; i++ {
-		verifyStatus, err := card.Entries[i].VerifyChain(&card.Entries[i+1])
+		verifyStatus, err := card.Entries[i+1].VerifyChain(&card.Entries[i], orgKey)
 		if err != nil || !verifyStatus {
 			return false, err
 		}
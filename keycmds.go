@@ -2,8 +2,14 @@ package main
 
 import (
 	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/darkwyrm/anselusd/cryptostring"
 	"github.com/darkwyrm/anselusd/dbhandler"
@@ -31,19 +37,9 @@ func commandAddEntry(session *sessionState) {
 	// 7) Once uploaded, the server validates the `Hash` and `User-Signature` fields, and,
 	//    assuming that all is well, adds it to the keycard database and returns `200 OK`.
 
-	if session.LoginState != loginClientSession {
-		session.SendStringResponse(401, "UNAUTHORIZED", "Login required")
-		return
-	}
-
 	// The User-Signature field can only be part of the message once the AddEntry command has
 	// started and the org signature and hashes have been added. If present, it constitutes an
 	// out-of-order request
-	if session.Message.Validate([]string{"Base-Entry"}) != nil {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing Base-Entry field")
-		return
-	}
-
 	if session.Message.HasField("User-Signature") {
 		session.SendStringResponse(400, "BAD REQUEST", "Received out-of-order User-Signature field")
 		return
@@ -57,6 +53,10 @@ func commandAddEntry(session *sessionState) {
 		session.SendStringResponse(411, "BAD KEYCARD DATA", "Couldn't create entry from data")
 		return
 	}
+	if entry.Type != "User" {
+		session.SendStringResponse(411, "BAD KEYCARD DATA", "Only user entries may be added")
+		return
+	}
 	if !entry.IsDataCompliant() {
 		session.SendStringResponse(412, "NONCOMPLIANT KEYCARD DATA", "")
 		return
@@ -86,8 +86,7 @@ func commandAddEntry(session *sessionState) {
 		}
 	}
 
-	adminAddress := "admin/" + viper.GetString("global.domain")
-	adminWid, err := dbhandler.ResolveAddress(adminAddress)
+	adminWid, err := getAdminWID()
 	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
 		logging.Writef("commandAddEntry: error resolving address: %s", err.Error())
@@ -122,38 +121,77 @@ func commandAddEntry(session *sessionState) {
 	// into a positive integer
 	currentIndex, _ := strconv.Atoi(entry.Fields["Index"])
 
+	// The keycard is reserved from the time the current entry is checked until the new one is
+	// saved. Without this, two devices updating the keycard at the same time could both chain
+	// from the same entry and fork the keycard.
+	if !reserveKeycard(session, entry.Fields["Workspace-ID"]) {
+		sendKeycardConflict(session)
+		return
+	}
+	defer releaseKeycard(session, entry.Fields["Workspace-ID"])
+
 	// Passing a 0 as the start index means we'll get just the current entry
 	tempStrList, err := dbhandler.GetUserEntries(entry.Fields["Workspace-ID"], 0, 0)
-	if err == nil {
-		if len(tempStrList) == 0 {
-			if currentIndex != 1 {
-				session.SendStringResponse(412, "NONCOMPLIANT KEYCARD DATA",
-					"Root entry index must be 1")
-				return
-			}
-		} else {
-			prevEntry, err := keycard.NewEntryFromData(tempStrList[0])
+	if err != nil && err != sql.ErrNoRows {
+		session.SendStringResponse(300, "INTERNAL SERVER ERRROR", "")
+		logging.Writef("ERROR AddEntry: failed to obtain current entry for workspace %s: %s",
+			entry.Fields["Workspace-ID"], err.Error())
+		return
+	}
+	if len(tempStrList) == 0 {
+		if currentIndex != 1 {
+			session.SendStringResponse(412, "NONCOMPLIANT KEYCARD DATA",
+				"Root entry index must be 1")
+			return
+		}
+	} else {
+		prevEntry, err := keycard.NewEntryFromData(tempStrList[0])
+		if err != nil {
+			session.SendStringResponse(300, "INTERNAL SERVER ERRROR", "")
+			logging.Writef("ERROR AddEntry: previous keycard entry invalid for workspace %s",
+				entry.Fields["Workspace-ID"])
+			return
+		}
+
+		// An entry which doesn't follow the current one was most likely chained from an entry
+		// which has since been replaced by another device
+		prevIndex, _ := strconv.Atoi(prevEntry.Fields["Index"])
+		if currentIndex <= prevIndex {
+			sendKeycardConflict(session)
+			return
+		}
+		if currentIndex != prevIndex+1 {
+			session.SendStringResponse(412, "NONCOMPLIANT KEYCARD DATA", "Non-sequential index")
+			return
+		}
+
+		// If there are previous entries for the workspace, the chain of trust must be validated.
+		// The organization's key is only needed when the current entry is a revocation. It may
+		// have been signed before the organization's keys were last rotated, so all of them are
+		// tried.
+		orgKeys := make([]cryptostring.CryptoString, 1)
+		if prevEntry.Type == "Revocation" {
+			orgKeys, err = getOrgVerificationKeys()
 			if err != nil {
 				session.SendStringResponse(300, "INTERNAL SERVER ERRROR", "")
-				logging.Writef("ERROR AddEntry: previous keycard entry invalid for workspace %s",
-					entry.Fields["Workspace-ID"])
+				logging.Writef("ERROR AddEntry: failed to obtain org verification keys: %s",
+					err.Error())
 				return
 			}
+		}
 
-			prevIndex, _ := strconv.Atoi(prevEntry.Fields["Index"])
-			if currentIndex != prevIndex+1 {
-				session.SendStringResponse(412, "NONCOMPLIANT KEYCARD DATA", "Non-sequential index")
-				return
-			}
-
-			// If there are previous entries for the workspace, the chain of trust must be validated.
-			isOK, err := entry.VerifyChain(prevEntry)
-			if !isOK || err != nil {
-				session.SendStringResponse(412, "NONCOMPLIANT KEYCARD DATA",
-					"Entry failed to chain verify")
-				return
+		isOK := false
+		for _, orgKey := range orgKeys {
+			isOK, _ = entry.VerifyChain(prevEntry, orgKey)
+			if isOK {
+				break
 			}
 		}
+		if !isOK {
+			session.SendStringResponse(412, "NONCOMPLIANT KEYCARD DATA",
+				"Entry failed to chain verify")
+			return
+		}
 	}
 
 	// If we managed to get this far, we can (theoretically) trust the initial data set given to us
@@ -223,6 +261,9 @@ func commandAddEntry(session *sessionState) {
 		return
 	}
 
+	// Other sessions can't change the keycard while this one waits for the signature, so the
+	// client doesn't get as long to respond as it does for other requests
+	session.Connection.SetReadDeadline(time.Now().Add(time.Minute))
 	request, err := session.GetRequest()
 	if err != nil {
 		return
@@ -258,21 +299,68 @@ func commandAddEntry(session *sessionState) {
 	err = dbhandler.AddEntry(entry)
 	if err == nil {
 		session.SendStringResponse(200, "OK", "")
+	} else if err == dbhandler.ErrEntryExists {
+		sendKeycardConflict(session)
 	} else {
 		session.SendStringResponse(300, "INTERNAL SERVER ERRROR", "")
 		logging.Write("ERROR AddEntry: failed to add entry.")
 	}
 }
 
-func commandOrgCard(session *sessionState) {
+func commandListExpiring(session *sessionState) {
 	// command syntax:
-	// ORGCARD(Start-Index, End-Index=0)
+	// LISTEXPIRING(Days="")
+
+	// Lists the current keycard entries which expire within the number of days given, defaulting
+	// to the server's warning period. Entries which have already expired are always included.
 
-	if !session.Message.HasField("Start-Index") {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing Start-Index")
+	days := viper.GetInt("keycards.warn_days")
+	if session.Message.HasField("Days") {
+		var err error
+		days, err = strconv.Atoi(session.Message.Data["Days"])
+		if err != nil || days < 0 || days > 1095 {
+			session.SendStringResponse(400, "BAD REQUEST", "Bad Days")
+			return
+		}
+	}
+
+	entries, err := findExpiringEntries(time.Hour * 24 * time.Duration(days))
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandListExpiring: error finding expiring entries: %s", err.Error())
 		return
 	}
 
+	entryList := make([]map[string]string, 0, len(entries))
+	for _, item := range entries {
+		status := "expiring"
+		if item.Expired {
+			status = "expired"
+		}
+		entryList = append(entryList, map[string]string{
+			"Owner":   item.Owner,
+			"Index":   strconv.Itoa(item.Index),
+			"Expires": item.Expires.Format("20060102"),
+			"Status":  status,
+		})
+	}
+
+	entryData, err := json.Marshal(entryList)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandListExpiring: error encoding entries: %s", err.Error())
+		return
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Entries"] = string(entryData)
+	session.SendResponse(*response)
+}
+
+func commandOrgCard(session *sessionState) {
+	// command syntax:
+	// ORGCARD(Start-Index, End-Index=0)
+
 	var startIndex, endIndex int
 	var err error
 	startIndex, err = strconv.Atoi(session.Message.Data["Start-Index"])
@@ -341,14 +429,292 @@ func commandOrgCard(session *sessionState) {
 	}
 }
 
-func commandUserCard(session *sessionState) {
+// keycardReservations maps the owner of each keycard which is being changed to the ID of the
+// session changing it
+var keycardLock = &sync.Mutex{}
+var keycardReservations = make(map[string]string)
+
+// reserveKeycard reserves a keycard so that only the session can add entries to it. It returns
+// false if another session already holds the reservation. The owner is a workspace ID or
+// 'organization'.
+func reserveKeycard(session *sessionState, owner string) bool {
+	keycardLock.Lock()
+	defer keycardLock.Unlock()
+
+	if holder, exists := keycardReservations[owner]; exists && holder != session.ID {
+		return false
+	}
+	keycardReservations[owner] = session.ID
+	return true
+}
+
+// releaseKeycard releases a session's reservation of a keycard
+func releaseKeycard(session *sessionState, owner string) {
+	keycardLock.Lock()
+	defer keycardLock.Unlock()
+
+	if keycardReservations[owner] == session.ID {
+		delete(keycardReservations, owner)
+	}
+}
+
+// sendKeycardConflict tells the client that its new entry doesn't follow the current one because
+// the keycard was changed by another session. The client needs to chain a new entry from the
+// current one and try again.
+func sendKeycardConflict(session *sessionState) {
+	session.SendStringResponse(408, "RESOURCE EXISTS",
+		"Keycard changed by another session. Chain from the current entry and try again.")
+}
+
+// getOrgSigningKey returns the organization's current primary signing key
+func getOrgSigningKey() (cryptostring.CryptoString, error) {
+	var psk cryptostring.CryptoString
+	pskstring, err := dbhandler.GetPrimarySigningKey()
+	if err != nil {
+		return psk, errors.New("missing primary signing key in database")
+	}
+
+	err = psk.Set(pskstring)
+	if err != nil || psk.RawData() == nil {
+		return psk, errors.New("corrupted primary signing key in database")
+	}
+	return psk, nil
+}
+
+// getOrgVerificationKeys returns the primary verification keys from all of the organization's
+// keycard entries, newest first
+func getOrgVerificationKeys() ([]cryptostring.CryptoString, error) {
+	entries, err := dbhandler.GetOrgEntries(1, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]cryptostring.CryptoString, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry, err := keycard.NewEntryFromData(entries[i])
+		if err != nil {
+			return nil, err
+		}
+
+		var key cryptostring.CryptoString
+		err = key.Set(entry.Fields["Primary-Verification-Key"])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, key)
+	}
+	return out, nil
+}
+
+// orgKeyPurposes maps the keys in an organization keycard entry to their purposes in the database
+var orgKeyPurposes = map[string]string{
+	"Primary-Verification-Key":   "sign",
+	"Secondary-Verification-Key": "altsign",
+	"Encryption-Key":             "encrypt",
+}
+
+func commandOrgRotate(session *sessionState) {
 	// command syntax:
-	// USERCARD(Owner, Start-Index, End-Index=0)
+	// ORGROTATE(Rotate-Optional="NO")
+
+	// The organization's keycard is extended with a new entry chained from the current one and
+	// signed with the new primary signing key. Earlier encryption keys are kept so that login
+	// challenges encrypted with them can be decrypted until clients pick up the new entry.
 
-	if session.Message.Validate([]string{"Owner", "Start-Index"}) != nil {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing Start-Index")
+	rotateOptional := strings.ToUpper(session.Message.Data["Rotate-Optional"]) == "YES"
+
+	if !reserveKeycard(session, "organization") {
+		sendKeycardConflict(session)
 		return
 	}
+	defer releaseKeycard(session, "organization")
+
+	entries, err := dbhandler.GetOrgEntries(0, 0)
+	if err != nil || len(entries) == 0 {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Write("ERROR OrgRotate: failed to obtain current org entry.")
+		return
+	}
+	currentEntry, err := keycard.NewEntryFromData(entries[0])
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Write("ERROR OrgRotate: failed to create entry from current org entry data.")
+		return
+	}
+
+	psk, err := getOrgSigningKey()
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("ERROR OrgRotate: %s", err.Error())
+		return
+	}
+
+	newEntry, newKeys, err := currentEntry.Chain(psk, rotateOptional)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("ERROR OrgRotate: failed to chain org entry: %s", err.Error())
+		return
+	}
+
+	err = newEntry.GenerateHash("BLAKE2B-256")
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Write("ERROR OrgRotate: failed to hash entry.")
+		return
+	}
+
+	err = newEntry.Sign(newKeys["Primary-Verification-Key.private"], "Organization")
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("ERROR OrgRotate: failed to org sign entry: %s", err.Error())
+		return
+	}
+
+	if !newEntry.IsCompliant() {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Write("ERROR OrgRotate: new org entry is not compliant.")
+		return
+	}
+
+	keys := make([]dbhandler.OrgKey, 0, len(orgKeyPurposes))
+	for field, purpose := range orgKeyPurposes {
+		pubkey, exists := newKeys[field+".public"]
+		if !exists {
+			continue
+		}
+		keys = append(keys, dbhandler.OrgKey{Purpose: purpose, PublicKey: pubkey,
+			PrivateKey: newKeys[field+".private"]})
+	}
+
+	err = dbhandler.AddOrgEntry(newEntry, keys)
+	if err == dbhandler.ErrEntryExists {
+		sendKeycardConflict(session)
+		return
+	}
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("ERROR OrgRotate: failed to add org entry: %s", err.Error())
+		return
+	}
+
+	logging.Writef("ORGROTATE: %s rotated the organization keys to entry %s", session.WID,
+		newEntry.Fields["Index"])
+	response := NewServerResponse(200, "OK")
+	response.Data["Index"] = newEntry.Fields["Index"]
+	response.Data["Hash"] = newEntry.Hash
+	session.SendResponse(*response)
+}
+
+func commandRevokeEntry(session *sessionState) {
+	// command syntax:
+	// REVOKEENTRY(Workspace-ID)
+
+	// A revocation is added to a workspace's keycard when its contact request signing key has been
+	// compromised. It is signed by the organization, so the next entry the user adds starts a new
+	// chain of custody instead of being signed with the stolen key. Because that entry needs no
+	// custody signature, only someone with permission to manage keycards may revoke, and they are
+	// expected to have confirmed the user's identity out of band. Otherwise anyone with a user's
+	// password and a device could replace the user's keys.
+
+	wid := session.Message.Data["Workspace-ID"]
+	if !dbhandler.ValidateUUID(wid) {
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Workspace-ID")
+		return
+	}
+
+	if !reserveKeycard(session, wid) {
+		sendKeycardConflict(session)
+		return
+	}
+	defer releaseKeycard(session, wid)
+
+	entries, err := dbhandler.GetUserEntries(wid, 0, 0)
+	if err != nil && err != sql.ErrNoRows {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandRevokeEntry: error retrieving user %s entries: %s", wid,
+			err.Error())
+		return
+	}
+	if len(entries) == 0 {
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
+	}
+
+	currentEntry, err := keycard.NewEntryFromData(entries[0])
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandRevokeEntry: error creating user entry from data for %s: %s",
+			wid, err.Error())
+		return
+	}
+	if currentEntry.Type == "Revocation" {
+		session.SendStringResponse(408, "RESOURCE EXISTS", "Keycard already revoked")
+		return
+	}
+
+	currentIndex, err := strconv.Atoi(currentEntry.Fields["Index"])
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandRevokeEntry: bad index in user entry data for %s", wid)
+		return
+	}
+
+	revocation := keycard.NewRevocationEntry()
+	revocation.SetFields(map[string]string{
+		"Index":        fmt.Sprintf("%d", currentIndex+1),
+		"Workspace-ID": wid,
+		"Domain":       currentEntry.Fields["Domain"],
+	})
+	revocation.PrevHash = currentEntry.Hash
+
+	err = revocation.GenerateHash("BLAKE2B-256")
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Write("ERROR RevokeEntry: failed to hash entry.")
+		return
+	}
+
+	psk, err := getOrgSigningKey()
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("ERROR RevokeEntry: %s", err.Error())
+		return
+	}
+	err = revocation.Sign(psk, "Organization")
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("ERROR RevokeEntry: failed to org sign entry: %s", err.Error())
+		return
+	}
+
+	if !revocation.IsCompliant() {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("ERROR RevokeEntry: revocation for %s is not compliant.", wid)
+		return
+	}
+
+	err = dbhandler.AddEntry(revocation)
+	if err == dbhandler.ErrEntryExists {
+		sendKeycardConflict(session)
+		return
+	}
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("ERROR RevokeEntry: failed to add entry: %s", err.Error())
+		return
+	}
+
+	logging.Writef("REVOKEENTRY: %s revoked keycard entry %d for %s", session.WID, currentIndex,
+		wid)
+	response := NewServerResponse(200, "OK")
+	response.Data["Index"] = revocation.Fields["Index"]
+	response.Data["Hash"] = revocation.Hash
+	session.SendResponse(*response)
+}
+
+func commandUserCard(session *sessionState) {
+	// command syntax:
+	// USERCARD(Owner, Start-Index, End-Index=0)
 
 	if dbhandler.GetAnselusAddressType(session.Message.Data["Owner"]) == 0 {
 		session.SendStringResponse(400, "BAD REQUEST", "Missing Owner")
@@ -432,11 +798,6 @@ func commandIsCurrent(session *sessionState) {
 	// command syntax:
 	// ISCURRENT(Index, Workspace-ID="")
 
-	if !session.Message.HasField("Index") {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing Index")
-		return
-	}
-
 	index, err := strconv.Atoi(session.Message.Data["Index"])
 	if err != nil {
 		session.SendStringResponse(400, "BAD REQUEST", "Bad Index")
@@ -2,12 +2,17 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"errors"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/darkwyrm/anselusd/cryptostring"
 	"github.com/darkwyrm/anselusd/dbhandler"
 	"github.com/darkwyrm/anselusd/ezcrypt"
+	"github.com/darkwyrm/anselusd/fshandler"
 	"github.com/darkwyrm/anselusd/keycard"
 	"github.com/darkwyrm/anselusd/logging"
 	"github.com/darkwyrm/b85"
@@ -15,15 +20,68 @@ import (
 	"github.com/spf13/viper"
 )
 
-func commandDevice(session *sessionState) {
+func commandDevApprove(session *sessionState) {
 	// Command syntax:
-	// DEVICE(Device-ID,Device-Key)
+	// DEVAPPROVE(Device-ID)
 
-	if session.Message.Validate([]string{"Device-ID", "Device-Key"}) != nil {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+	found, _, err := dbhandler.GetDeviceRequest(session.WID, session.Message.Data["Device-ID"])
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandDevApprove: error getting device request: %s", err.Error())
+		return
+	}
+	if !found {
+		session.SendStringResponse(404, "NOT FOUND", "")
 		return
 	}
 
+	err = dbhandler.ApproveDeviceRequest(session.WID, session.Message.Data["Device-ID"])
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandDevApprove: error approving device: %s", err.Error())
+		return
+	}
+
+	session.SendStringResponse(200, "OK", "")
+}
+
+func commandDevDeny(session *sessionState) {
+	// Command syntax:
+	// DEVDENY(Device-ID)
+
+	found, source, err := dbhandler.GetDeviceRequest(session.WID,
+		session.Message.Data["Device-ID"])
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandDevDeny: error getting device request: %s", err.Error())
+		return
+	}
+	if !found {
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
+	}
+
+	err = dbhandler.RemoveDeviceRequest(session.WID, session.Message.Data["Device-ID"])
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandDevDeny: error removing device request: %s", err.Error())
+		return
+	}
+
+	// A denied device is treated like any other failed login attempt from its address so that
+	// repeated requests lead to a lockout
+	err = dbhandler.LogFailure("device", session.WID, source)
+	if err != nil {
+		logging.Writef("commandDevDeny: error logging failure: %s", err.Error())
+	}
+
+	session.SendStringResponse(200, "OK", "")
+}
+
+func commandDevice(session *sessionState) {
+	// Command syntax:
+	// DEVICE(Device-ID,Device-Key)
+
 	if !dbhandler.ValidateUUID(session.Message.Data["Device-ID"]) ||
 		session.LoginState != loginAwaitingSessionID {
 		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
@@ -36,37 +94,84 @@ func commandDevice(session *sessionState) {
 		return
 	}
 
-	success, err := dbhandler.CheckDevice(session.WID, session.Message.Data["Device-ID"],
+	status, err := dbhandler.GetDeviceStatus(session.WID, session.Message.Data["Device-ID"],
 		devkey.AsString())
 	if err != nil {
-		if err.Error() == "cancel" {
-			session.LoginState = loginNoSession
-			session.SendStringResponse(200, "OK", "")
-			return
-		}
-
 		session.SendStringResponse(400, "BAD REQUEST", "Bad Device-ID or Device-Key")
 		return
 	}
 
-	if !success {
-		// TODO: implement device checking:
-		// 1) Check to see if there are multiple devices
-		// 2) If there are multiple devices, push out an authorization message.
-		// 3) Record the session ID in the table as a pending device.
-		// 4) Return 101 PENDING and close the connection
-		// 5) Upon receipt of authorization approval, update the device status in the database
-		// 6) Upon receipt of denial, log the failure and apply a lockout to the IP
+	switch status {
+	case "active":
+		break
+	case "pending":
+		session.SendStringResponse(101, "PENDING", "Awaiting device approval")
+		session.IsTerminating = true
+		return
+	default:
+		// A device ID which is already in use with a different key is treated like a failed
+		// challenge. Otherwise approving or denying the request would also affect the device
+		// which owns the ID.
+		exists, err := dbhandler.CheckDeviceID(session.WID, session.Message.Data["Device-ID"])
+		if err != nil {
+			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			logging.Writef("commandDevice: error checking device ID: %s", err.Error())
+			return
+		}
+		if exists {
+			// logFailure lets the client know about lockouts and errors itself
+			lockout, _ := logFailure(session, "device", session.WID)
+			if !lockout {
+				session.SendStringResponse(401, "UNAUTHORIZED", "")
+			}
+			return
+		}
+
+		// An unknown device must be approved by one of the workspace's active devices before it
+		// can be used. The only exception is a workspace which has no active devices at all, in
+		// which case there is nothing to approve it.
+		activeCount, err := dbhandler.CountDevices(session.WID, "active")
+		if err != nil {
+			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			logging.Writef("commandDevice: error counting devices: %s", err.Error())
+			return
+		}
+
+		if activeCount == 0 {
+			err = dbhandler.AddDevice(session.WID, session.Message.Data["Device-ID"], devkey,
+				"active")
+			if err != nil {
+				session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+				logging.Writef("commandDevice: error adding device: %s", err.Error())
+				return
+			}
+			break
+		}
+
+		lockout, err := isLocked(session, "device", session.WID)
+		if lockout || err != nil {
+			return
+		}
+
+		remoteip := getClientIP(session).String()
+		err = dbhandler.AddDeviceRequest(session.WID, session.Message.Data["Device-ID"], devkey,
+			remoteip)
+		if err != nil {
+			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			logging.Writef("commandDevice: error adding device request: %s", err.Error())
+			return
+		}
+		sendDeviceRequest(session.WID, session.Message.Data["Device-ID"], devkey, remoteip)
 
-		// This code exists to at least enable the server to work until device checking can
-		// be implemented.
-		dbhandler.AddDevice(session.WID, session.Message.Data["Device-ID"], devkey, "active")
+		session.SendStringResponse(101, "PENDING", "Awaiting device approval")
+		session.IsTerminating = true
+		return
 	}
 
 	// The device is part of the workspace, so now we issue undergo a challenge-response
 	// to ensure that the device really is authorized and the key wasn't stolen by an impostor
 
-	success, err = challengeDevice(session, "CURVE25519", session.Message.Data["Device-Key"])
+	success, err := challengeDevice(session, "CURVE25519", session.Message.Data["Device-Key"])
 	if !success {
 		lockout, err := logFailure(session, "device", session.WID)
 		if err != nil {
@@ -83,24 +188,42 @@ func commandDevice(session *sessionState) {
 		return
 	}
 
+	session.FSRoot, err = fshandler.NewFSRoot(session.WID)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandDevice: error setting filesystem root for %s: %s", session.WID,
+			err.Error())
+		return
+	}
+
+	err = dbhandler.UpdateDeviceLastSeen(session.WID, session.Message.Data["Device-ID"])
+	if err != nil {
+		logging.Writef("commandDevice: error updating device last seen time: %s", err.Error())
+	}
+
+	session.DevID = session.Message.Data["Device-ID"]
 	session.LoginState = loginClientSession
-	session.SendStringResponse(200, "OK", "")
+	registerDeviceSession(session)
+
+	// The first login after a registration request is approved lets the user know about it
+	response := NewServerResponse(200, "OK")
+	regStatus, reason, err := dbhandler.GetRegRequest(session.WID)
+	if err != nil {
+		logging.Writef("commandDevice: error getting registration request: %s", err.Error())
+	} else if regStatus == "approved" {
+		response.Data["Registration"] = regStatus
+		if reason != "" {
+			response.Data["Reason"] = reason
+		}
+		dbhandler.RemoveRegRequest(session.WID)
+	}
+	session.SendResponse(*response)
 }
 
 func commandDevKey(session *sessionState) {
 	// Command syntax:
 	// DEVKEY(Device-ID, Old-Key, New-Key)
 
-	if session.Message.Validate([]string{"Device-ID", "Old-Key", "New-Key"}) != nil {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
-		return
-	}
-
-	if session.LoginState != loginClientSession {
-		session.SendStringResponse(401, "UNAUTHORIZED", "")
-		return
-	}
-
 	var oldkey cryptostring.CryptoString
 	if oldkey.Set(session.Message.Data["Old-Key"]) != nil {
 		session.SendStringResponse(400, "BAD REQUEST", "Bad Old-Key")
@@ -144,16 +267,130 @@ func commandDevKey(session *sessionState) {
 	session.SendStringResponse(200, "OK", "")
 }
 
-func commandLogin(session *sessionState) {
+func commandDevList(session *sessionState) {
 	// Command syntax:
-	// LOGIN(Login-Type,Workspace-ID)
+	// DEVLIST
 
-	// PLAIN authentication is currently the only supported type
-	if session.Message.Validate([]string{"Login-Type", "Workspace-ID", "Challenge"}) != nil {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+	devices, err := dbhandler.GetDevices(session.WID)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandDevList: error getting devices: %s", err.Error())
+		return
+	}
+
+	deviceList := make([]map[string]string, 0, len(devices))
+	for _, device := range devices {
+		deviceList = append(deviceList, map[string]string{
+			"Device-ID": device.ID,
+			"Name":      device.Label,
+			"Status":    device.Status,
+			"Last-Seen": device.LastSeen,
+		})
+	}
+
+	deviceData, err := json.Marshal(deviceList)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandDevList: error encoding devices: %s", err.Error())
 		return
 	}
 
+	response := NewServerResponse(200, "OK")
+	response.Data["Devices"] = string(deviceData)
+	session.SendResponse(*response)
+}
+
+func commandDevRename(session *sessionState) {
+	// Command syntax:
+	// DEVRENAME(Device-ID, Name)
+
+	if !dbhandler.ValidateUUID(session.Message.Data["Device-ID"]) {
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Device-ID")
+		return
+	}
+
+	name := strings.TrimSpace(session.Message.Data["Name"])
+	if utf8.RuneCountInString(name) > 64 || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Name")
+		return
+	}
+
+	found, err := dbhandler.SetDeviceLabel(session.WID, session.Message.Data["Device-ID"], name)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandDevRename: error renaming device: %s", err.Error())
+		return
+	}
+	if !found {
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
+	}
+
+	session.SendStringResponse(200, "OK", "")
+}
+
+func commandDevRevoke(session *sessionState) {
+	// Command syntax:
+	// DEVREVOKE(Device-ID)
+
+	devid := session.Message.Data["Device-ID"]
+	if !dbhandler.ValidateUUID(devid) {
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Device-ID")
+		return
+	}
+
+	devices, err := dbhandler.GetDevices(session.WID)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandDevRevoke: error getting devices: %s", err.Error())
+		return
+	}
+
+	status := ""
+	activeCount := 0
+	for _, device := range devices {
+		if device.ID == devid {
+			status = device.Status
+		}
+		if device.Status == "active" {
+			activeCount++
+		}
+	}
+	if status == "" {
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
+	}
+
+	// A workspace with no active devices would accept any new device without approval
+	if status == "active" && activeCount == 1 {
+		session.SendStringResponse(403, "FORBIDDEN", "Can't revoke the last active device")
+		return
+	}
+
+	_, err = dbhandler.RemoveDevice(session.WID, devid)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandDevRevoke: error removing device: %s", err.Error())
+		return
+	}
+
+	ended := endDeviceSessions(session.WID, devid, session.ID)
+	logging.Writef("Device %s revoked from workspace %s, %d session(s) ended", devid,
+		session.WID, ended)
+
+	session.SendStringResponse(200, "OK", "")
+
+	// Revoking the device in use ends this session, too
+	if devid == session.DevID {
+		session.IsTerminating = true
+	}
+}
+
+func commandLogin(session *sessionState) {
+	// Command syntax:
+	// LOGIN(Login-Type,Workspace-ID)
+
+	// PLAIN authentication is currently the only supported type
 	if session.Message.Data["Login-Type"] != "PLAIN" {
 		session.SendStringResponse(400, "BAD REQUEST", "Invalid login type")
 		return
@@ -193,27 +430,49 @@ func commandLogin(session *sessionState) {
 		return
 	}
 
+	// Shared workspaces don't have credentials of their own. Members log into their own
+	// workspaces and use SETROOT to work with the shared one's files.
+	wtype, err := dbhandler.GetWorkspaceType(wid)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		return
+	}
+	if wtype == "shared" {
+		session.SendStringResponse(403, "FORBIDDEN", "Log in as a member of shared workspaces")
+		return
+	}
+
 	switch session.WorkspaceStatus {
 	case "disabled":
 		session.SendStringResponse(407, "UNAVAILABLE", "account disabled")
 		return
-	case "awaiting":
+	case "awaiting", "pending":
 		session.SendStringResponse(101, "PENDING", "")
 		return
-	case "active", "approved":
+	case "active", "approved", "rejected":
+		// The outcome of a rejected registration request is reported once the password has been
+		// verified
 		break
 	default:
 		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
 		return
 	}
 
-	// We got this far, so decrypt the challenge and send it to the client
-	keypair, err := dbhandler.GetEncryptionPair()
+	// We got this far, so decrypt the challenge and send it to the client. Keys which were
+	// recently replaced are tried, too, because the client may not have the new keycard entry yet.
+	keypairs, err := dbhandler.GetEncryptionPairs(time.Hour *
+		time.Duration(viper.GetInt("security.org_key_grace_hours")))
 	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
 		return
 	}
-	decryptedChallenge, err := keypair.Decrypt(session.Message.Data["Challenge"])
+	var decryptedChallenge []byte
+	for _, keypair := range keypairs {
+		decryptedChallenge, err = keypair.Decrypt(session.Message.Data["Challenge"])
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
 		session.SendStringResponse(306, "KEY FAILURE", "Challenge decryption failure")
 		return
@@ -230,9 +489,14 @@ func commandLogout(session *sessionState) {
 	// command syntax:
 	// LOGOUT
 	session.SendStringResponse(200, "OK", "")
+	unregisterDeviceSession(session)
 	session.LoginState = loginNoSession
 	session.WID = ""
+	session.DevID = ""
 	session.WorkspaceStatus = ""
+	session.FSRoot = fshandler.FSRoot{}
+	session.FSShared = false
+	session.CurrentPath = nil
 }
 
 func commandPasscode(session *sessionState) {
@@ -244,11 +508,6 @@ func commandPasscode(session *sessionState) {
 		return
 	}
 
-	if session.Message.Validate([]string{"Workspace-ID", "Reset-Code", "Password-Hash"}) != nil {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
-		return
-	}
-
 	if !dbhandler.ValidateUUID(session.Message.Data["Workspace-ID"]) {
 		session.SendStringResponse(400, "BAD REQUEST", "bad workspace ID")
 		return
@@ -300,11 +559,6 @@ func commandPassword(session *sessionState) {
 
 	// This command takes a numeric hash of the user's password and compares it to what is submitted
 	// by the user.
-	if !session.Message.HasField("Password-Hash") {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
-		return
-	}
-
 	goodPass, err := ezcrypt.IsArgonHash(session.Message.Data["Password-Hash"])
 	if !goodPass || err != nil {
 		session.SendStringResponse(400, "BAD REQUEST", "bad password hash")
@@ -341,6 +595,11 @@ func commandPassword(session *sessionState) {
 		return
 	}
 
+	if session.WorkspaceStatus == "rejected" {
+		reportRejection(session)
+		return
+	}
+
 	session.LoginState = loginAwaitingSessionID
 	session.SendStringResponse(100, "CONTINUE", "")
 }
@@ -349,28 +608,12 @@ func commandResetPassword(session *sessionState) {
 	// Command syntax:
 	// RESETPASSWORD(Workspace-ID, Reset-Code="", Expires="")
 
-	adminAddress := "admin/" + viper.GetString("global.domain")
-	adminWid, err := dbhandler.ResolveAddress(adminAddress)
-	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("commandResetPassword: Error resolving address: %s", err)
-		return
-	}
-
-	if session.LoginState != loginClientSession || session.WID != adminWid {
-		session.SendStringResponse(403, "FORBIDDEN", "Only admin can use this")
-	}
-
-	if !session.Message.HasField("Workspace-ID") {
-		session.SendStringResponse(400, "BAD REQUEST", "missing required field")
-		return
-	}
-
 	if !dbhandler.ValidateUUID(session.Message.Data["Workspace-ID"]) {
 		session.SendStringResponse(400, "BAD REQUEST", "Bad Workspace-ID")
 		return
 	}
 
+	var err error
 	var passcode string
 	if session.Message.HasField("Reset-Code") && session.Message.Data["Reset-Code"] != "" {
 		if len(session.Message.Data["Reset-Code"]) < 8 {
@@ -422,16 +665,6 @@ func commandSetPassword(session *sessionState) {
 	// Command syntax:
 	// SETPASSWORD(Password-Hash, NewPassword-Hash)
 
-	if session.Message.Validate([]string{"Password-Hash", "NewPassword-Hash"}) != nil {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
-		return
-	}
-
-	if session.LoginState != loginClientSession {
-		session.SendStringResponse(401, "UNAUTHORIZED", "")
-		return
-	}
-
 	goodPass, err := ezcrypt.IsArgonHash(session.Message.Data["Password-Hash"])
 	if !goodPass || err != nil {
 		session.SendStringResponse(400, "BAD REQUEST", "bad old password hash")
@@ -607,3 +840,52 @@ func dualChallengeDevice(session *sessionState, oldkey cryptostring.CryptoString
 
 	return true, nil
 }
+
+// sendDeviceRequest places a request for approval of a new device into the inbox of a workspace
+// so that the workspace's existing devices can act on it with DEVAPPROVE or DEVDENY
+func sendDeviceRequest(wid string, devid string, devkey cryptostring.CryptoString,
+	source string) {
+
+	err := sendNotice(wid, map[string]string{
+		"Type":         "devrequest",
+		"Workspace-ID": wid,
+		"Device-ID":    devid,
+		"Device-Key":   devkey.AsString(),
+		"Source":       source,
+	})
+	if err != nil {
+		logging.Writef("sendDeviceRequest: error delivering device request for %s: %s", wid,
+			err.Error())
+	}
+}
+
+// reportRejection tells a user whose registration request was rejected about the outcome and
+// removes the workspace, which is kept only until this happens
+func reportRejection(session *sessionState) {
+	_, reason, err := dbhandler.GetRegRequest(session.WID)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("reportRejection: error getting registration request: %s", err.Error())
+		return
+	}
+
+	response := NewServerResponse(403, "FORBIDDEN")
+	response.Info = "Registration rejected"
+	if reason != "" {
+		response.Data["Reason"] = reason
+	}
+	session.SendResponse(*response)
+	session.IsTerminating = true
+
+	err = dbhandler.RemoveRegRequest(session.WID)
+	if err == nil {
+		err = dbhandler.RemoveWorkspace(session.WID)
+	}
+	if err == nil {
+		err = fshandler.RemoveWorkspace(session.WID)
+	}
+	if err != nil {
+		logging.Writef("reportRejection: error removing workspace %s: %s", session.WID,
+			err.Error())
+	}
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/darkwyrm/anselusd/config"
@@ -15,6 +21,7 @@ import (
 	"github.com/darkwyrm/anselusd/fshandler"
 	"github.com/darkwyrm/anselusd/logging"
 	"github.com/everlastingbeta/diceware"
+	"github.com/google/uuid"
 	_ "github.com/lib/pq"
 	"github.com/spf13/viper"
 )
@@ -34,6 +41,13 @@ var gDiceWordList diceware.Wordlist
 // initial command.
 const MaxCommandLength = 1024
 
+// Errors returned by GetRequest for requests which can't be used. The session can continue after
+// either of them.
+var (
+	errRequestTooLong   = errors.New("request too long")
+	errMalformedRequest = errors.New("malformed request")
+)
+
 type loginStatus int
 
 const (
@@ -48,16 +62,45 @@ const (
 )
 
 type sessionState struct {
+	ID               string
 	PasswordFailures int
 	Connection       net.Conn
+	Reader           *bufio.Reader
 	Message          ClientRequest
 	LoginState       loginStatus
 	IsTerminating    bool
 	WID              string
 	WorkspaceStatus  string
-	CurrentPath      fshandler.LocalAnPath
+	CurrentPath      fshandler.AnPath
+	FSRoot           fshandler.FSRoot
+	FSShared         bool
+	DevID            string
+	RateWindows      map[string]*rateWindow
+}
+
+// deviceSession is an entry in the registry of logged-in sessions. It is kept separately from
+// sessionState so that other sessions can read it safely.
+type deviceSession struct {
+	wid   string
+	devid string
+	conn  net.Conn
+}
+
+var deviceSessionLock = &sync.Mutex{}
+var deviceSessions = make(map[string]deviceSession)
+
+// connSession is an entry in the registry of connected sessions, which is used to end them when
+// the server shuts down. Sessions are idle while waiting for a request.
+type connSession struct {
+	conn net.Conn
+	idle bool
 }
 
+var connSessionLock = &sync.Mutex{}
+var connSessions = make(map[string]*connSession)
+var connWaitGroup sync.WaitGroup
+var shuttingDown bool
+
 // ClientRequest is for encapsulating requests from the client.
 type ClientRequest struct {
 	Action string
@@ -103,38 +146,78 @@ func (r *ClientRequest) Validate(fieldlist []string) error {
 	return nil
 }
 
-// GetRequest reads a request from a client from the socket
-func (s *sessionState) GetRequest() (ClientRequest, error) {
-	var out ClientRequest
-	buffer := make([]byte, MaxCommandLength)
-	bytesRead, err := s.Connection.Read(buffer)
-	if err != nil {
-		ne, ok := err.(*net.OpError)
-		if ok && ne.Timeout() {
-			s.IsTerminating = true
-			return out, errors.New("connection timed out")
+// readLine reads one line from the client, which may end with either LF or CRLF, and returns it
+// without the line ending. Lines longer than MaxCommandLength are discarded along with the rest of
+// the line and errRequestTooLong is returned. The returned slice is only valid until the next read.
+func (s *sessionState) readLine() ([]byte, error) {
+	line, err := s.Reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		for err == bufio.ErrBufferFull {
+			_, err = s.Reader.ReadSlice('\n')
+		}
+		if err == nil {
+			err = errRequestTooLong
 		}
+	}
+	if err != nil {
+		return nil, s.checkReadError(err)
+	}
+
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// checkReadError handles logging of errors reading from the client and marks the session for
+// termination if the connection timed out
+func (s *sessionState) checkReadError(err error) error {
+	if err == errRequestTooLong {
+		return err
+	}
 
-		if err.Error() != "EOF" {
-			fmt.Println("Error reading from client: ", err.Error())
+	ne, ok := err.(*net.OpError)
+	if ok && ne.Timeout() {
+		s.IsTerminating = true
+		return errors.New("connection timed out")
+	}
+
+	if err != io.EOF {
+		fmt.Println("Error reading from client: ", err.Error())
+	}
+	return err
+}
+
+// GetRequest reads a request from the client. Each request is a JSON object on a line by itself.
+// Blank lines are ignored.
+func (s *sessionState) GetRequest() (ClientRequest, error) {
+	var out ClientRequest
+	var line []byte
+	var err error
+	for len(line) == 0 {
+		line, err = s.readLine()
+		if err != nil {
+			return out, err
 		}
-		return out, err
 	}
 
-	err = json.Unmarshal(buffer[:bytesRead], &out)
+	err = json.Unmarshal(line, &out)
+	if err != nil || out.Action == "" {
+		return ClientRequest{}, errMalformedRequest
+	}
+	if out.Data == nil {
+		out.Data = make(map[string]string)
+	}
 
 	return out, nil
 }
 
-// SendResponse sends a JSON response message to the client
+// SendResponse sends a JSON response message to the client. Each response is on a line by itself.
 func (s sessionState) SendResponse(msg ServerResponse) (err error) {
 	out, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
 
-	_, err = s.Connection.Write([]byte(out))
-	return nil
+	_, err = s.Connection.Write(append(out, '\r', '\n'))
+	return err
 }
 
 // SendStringResponse is a syntactic sugar command for quickly sending error responses. The Info
@@ -143,23 +226,14 @@ func (s sessionState) SendStringResponse(code int, status string, info string) (
 	return s.SendResponse(ServerResponse{code, status, info, map[string]string{}})
 }
 
+// ReadClient reads one line of text from the client
 func (s *sessionState) ReadClient() (string, error) {
-	buffer := make([]byte, MaxCommandLength)
-	bytesRead, err := s.Connection.Read(buffer)
+	line, err := s.readLine()
 	if err != nil {
-		ne, ok := err.(*net.OpError)
-		if ok && ne.Timeout() {
-			s.IsTerminating = true
-			return "", errors.New("connection timed out")
-		}
-
-		if err.Error() != "EOF" {
-			fmt.Println("Error reading from client: ", err.Error())
-		}
 		return "", err
 	}
 
-	return strings.TrimSpace(string(buffer[:bytesRead])), nil
+	return strings.TrimSpace(string(line)), nil
 }
 
 func (s sessionState) WriteClient(msg string) (n int, err error) {
@@ -172,6 +246,7 @@ func (s sessionState) WriteClient(msg string) (n int, err error) {
 
 func main() {
 	gDiceWordList = config.SetupConfig()
+	defer logging.Shutdown()
 
 	dbhandler.Connect()
 	if !dbhandler.IsConnected() {
@@ -180,6 +255,9 @@ func main() {
 	}
 	defer dbhandler.Disconnect()
 
+	go deliveryWorker()
+	go expiryWorker()
+
 	listenString := viper.GetString("network.listen_ip") + ":" + viper.GetString("network.port")
 	listener, err := net.Listen("tcp", listenString)
 	if err != nil {
@@ -191,30 +269,150 @@ func main() {
 
 	defer listener.Close()
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logging.Writef("Received %s. Shutting down.", sig.String())
+		beginShutdown()
+		listener.Close()
+	}()
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Println("Error accepting a connection: ", err.Error())
-			os.Exit(1)
+			if isShuttingDown() {
+				break
+			}
+			logging.Writef("Error accepting a connection: %s", err.Error())
+			time.Sleep(time.Second)
+			continue
 		}
+		connWaitGroup.Add(1)
 		go connectionWorker(conn)
 	}
+
+	drainSessions(time.Second * time.Duration(viper.GetInt("network.shutdown_drain_sec")))
+	logCommandStats()
+	logging.Write("Shutdown complete")
+}
+
+// beginShutdown marks the server as shutting down and wakes the sessions which are waiting for a
+// request so that they can tell their clients and end. Busy sessions do the same once they finish
+// the command they are working on.
+func beginShutdown() {
+	connSessionLock.Lock()
+	defer connSessionLock.Unlock()
+
+	shuttingDown = true
+	for _, item := range connSessions {
+		if item.idle {
+			item.conn.SetReadDeadline(time.Now())
+		}
+	}
+}
+
+// isShuttingDown returns true if the server is shutting down
+func isShuttingDown() bool {
+	connSessionLock.Lock()
+	defer connSessionLock.Unlock()
+	return shuttingDown
+}
+
+// drainSessions waits for connected sessions to end. Any which are still connected after the
+// specified amount of time are disconnected.
+func drainSessions(timeout time.Duration) {
+	done := make(chan bool)
+	go func() {
+		connWaitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	connSessionLock.Lock()
+	logging.Writef("Closing %d sessions which didn't finish in time", len(connSessions))
+	for _, item := range connSessions {
+		item.conn.Close()
+	}
+	connSessionLock.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+	}
+}
+
+// addConnSession adds a session to the registry of connected sessions
+func addConnSession(session *sessionState) {
+	connSessionLock.Lock()
+	defer connSessionLock.Unlock()
+	connSessions[session.ID] = &connSession{session.Connection, false}
+}
+
+// removeConnSession removes a session from the registry of connected sessions
+func removeConnSession(session *sessionState) {
+	connSessionLock.Lock()
+	defer connSessionLock.Unlock()
+	delete(connSessions, session.ID)
+}
+
+// setSessionIdle marks whether a session is waiting for a request. It returns false if the session
+// is becoming idle and the server is shutting down, in which case the session should end.
+func setSessionIdle(session *sessionState, idle bool) bool {
+	connSessionLock.Lock()
+	defer connSessionLock.Unlock()
+
+	connSessions[session.ID].idle = idle
+	return !(idle && shuttingDown)
 }
 
 func connectionWorker(conn net.Conn) {
+	defer connWaitGroup.Done()
 	defer conn.Close()
 	conn.SetReadDeadline(time.Now().Add(time.Minute * 30))
 	conn.SetWriteDeadline(time.Now().Add(time.Minute * 10))
 
 	var session sessionState
+	session.ID = uuid.New().String()
 	session.Connection = conn
+	session.Reader = bufio.NewReaderSize(conn, MaxCommandLength)
 	session.LoginState = loginNoSession
+	addConnSession(&session)
+	defer removeConnSession(&session)
+	defer fshandler.GetFSHandler().CloseSessionFiles(session.ID)
+	defer unregisterDeviceSession(&session)
 
-	session.WriteClient("{\"Name\":\"Anselus\",\"Version\":\"0.1\",\"Code\":200," +
-		"\"Status\":\"OK\"}\r\n")
+	sendGreeting(&session)
 	for {
+		if !setSessionIdle(&session, true) {
+			session.SendStringResponse(407, "UNAVAILABLE", "Server shutting down")
+			break
+		}
 		request, err := session.GetRequest()
-		if err != nil && err.Error() != "EOF" {
+		setSessionIdle(&session, false)
+		if err != nil && isShuttingDown() {
+			session.SendStringResponse(407, "UNAVAILABLE", "Server shutting down")
+			break
+		}
+
+		// The read deadline may have been shortened by a shutdown which began just as the request
+		// arrived. The command is allowed to finish, so it gets the usual amount of time.
+		conn.SetReadDeadline(time.Now().Add(time.Minute * 30))
+
+		if err == errRequestTooLong {
+			session.SendStringResponse(400, "BAD REQUEST", "Request too long")
+			continue
+		}
+		if err == errMalformedRequest {
+			session.SendStringResponse(400, "BAD REQUEST", "Malformed request")
+			continue
+		}
+		if err != nil {
 			break
 		}
 		session.Message = request
@@ -232,73 +430,6 @@ func connectionWorker(conn net.Conn) {
 	}
 }
 
-func processCommand(session *sessionState) {
-	switch session.Message.Action {
-	case "ADDENTRY":
-		commandAddEntry(session)
-	case "CANCEL":
-		commandCancel(session)
-	case "COPY":
-		commandCopy(session)
-	case "DELETE":
-		commandDelete(session)
-	case "DEVICE":
-		commandDevice(session)
-	case "DEVKEY":
-		commandDevKey(session)
-	case "EXISTS":
-		commandExists(session)
-	case "GETWID":
-		commandGetWID(session)
-	case "ISCURRENT":
-		commandIsCurrent(session)
-	case "LIST":
-		commandList(session)
-	case "LISTDIRS":
-		commandListDirs(session)
-	case "LOGIN":
-		commandLogin(session)
-	case "LOGOUT":
-		commandLogout(session)
-	case "MKDIR":
-		commandMkDir(session)
-	case "MOVE":
-		commandMove(session)
-	case "NOOP":
-		// Do nothing. Just resets the idle counter.
-	case "ORGCARD":
-		commandOrgCard(session)
-	case "PASSCODE":
-		commandPasscode(session)
-	case "PASSWORD":
-		commandPassword(session)
-	case "PREREG":
-		commandPreregister(session)
-	case "REGCODE":
-		commandRegCode(session)
-	case "REGISTER":
-		commandRegister(session)
-	case "RESETPASSWORD":
-		commandResetPassword(session)
-	case "RMDIR":
-		commandRmDir(session)
-	case "SELECT":
-		commandSelect(session)
-	case "SETPASSWORD":
-		commandSetPassword(session)
-	case "SETSTATUS":
-		commandSetStatus(session)
-	case "UNREGISTER":
-		commandUnregister(session)
-	case "UPLOAD":
-		commandUpload(session)
-	case "USERCARD":
-		commandUserCard(session)
-	default:
-		commandUnrecognized(session)
-	}
-}
-
 func commandCancel(session *sessionState) {
 	if session.LoginState != loginClientSession {
 		session.LoginState = loginNoSession
@@ -310,11 +441,6 @@ func commandSetStatus(session *sessionState) {
 	// Command syntax:
 	// SETSTATUS(wid, status)
 
-	if session.Message.Validate([]string{"Workspace-ID", "Status"}) != nil {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
-		return
-	}
-
 	if !dbhandler.ValidateUUID(session.Message.Data["Workspace-ID"]) {
 		session.SendStringResponse(400, "BAD REQUEST", "Invalid Workspace-ID")
 		return
@@ -328,25 +454,18 @@ func commandSetStatus(session *sessionState) {
 		return
 	}
 
-	if session.LoginState != loginClientSession {
-		session.SendStringResponse(401, "UNAUTHORIZED", "")
-		return
-	}
-
-	adminAddress := "admin/" + viper.GetString("global.domain")
-	adminWid, err := dbhandler.ResolveAddress(adminAddress)
+	adminWid, err := getAdminWID()
 	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("commandPreregister: Error resolving address: %s", err)
+		logging.Writef("commandSetStatus: Error resolving address: %s", err)
 		return
 	}
-	if session.WID != adminWid {
-		session.SendStringResponse(403, "FORBIDDEN", "Only admin can use this")
+	if session.Message.Data["Workspace-ID"] == adminWid {
+		session.SendStringResponse(403, "FORBIDDEN", "admin status can't be changed")
 		return
 	}
-
 	if session.Message.Data["Workspace-ID"] == session.WID {
-		session.SendStringResponse(403, "FORBIDDEN", "admin status can't be changed")
+		session.SendStringResponse(403, "FORBIDDEN", "Can't change own status")
 		return
 	}
 
@@ -361,14 +480,47 @@ func commandSetStatus(session *sessionState) {
 	session.SendStringResponse(200, "OK", "")
 }
 
+// getClientIP returns the IP address of the session's client. IPv4 addresses are always returned in
+// their 4-byte form, even if the client connected over IPv6 using an IPv4-mapped address.
+func getClientIP(session *sessionState) net.IP {
+	host, _, err := net.SplitHostPort(session.Connection.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+
+	// Link-local IPv6 addresses include the zone, e.g. fe80::1%eth0, which ParseIP doesn't accept
+	if index := strings.IndexByte(host, '%'); index >= 0 {
+		host = host[:index]
+	}
+
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// getFailureSource returns the address which failures by the session's client are counted against.
+// IPv6 clients are counted by /64 because each host is usually free to pick any address in its
+// subnet, so otherwise it could just switch addresses when locked out.
+func getFailureSource(session *sessionState) string {
+	ip := getClientIP(session)
+	if ip == nil {
+		return ""
+	}
+	if ip.To4() == nil {
+		ip = ip.Mask(net.CIDRMask(64, 128))
+	}
+	return ip.String()
+}
+
 // logFailure is for logging the different types of client failures which can potentially
 // terminate a session. If, after logging the failure, the limit is reached, this will return
 // true, indicating that the current command handler needs to exit. The wid parameter may be empty,
 // but should be supplied when possible. By doing so, it limits lockouts for an IP address to that
 // specific workspace ID.
 func logFailure(session *sessionState, failType string, wid string) (bool, error) {
-	remoteip := strings.Split(session.Connection.RemoteAddr().String(), ":")[0]
-	err := dbhandler.LogFailure(failType, wid, remoteip)
+	err := dbhandler.LogFailure(failType, wid, getFailureSource(session))
 	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
 		logging.Writef("logFailure: error logging failure: %s", err.Error())
@@ -411,7 +563,7 @@ func isLocked(session *sessionState, failType string, wid string) (bool, error)
 
 func getLockout(session *sessionState, failType string, wid string) (string, error) {
 
-	lockTime, err := dbhandler.CheckLockout(failType, wid, session.Connection.RemoteAddr().String())
+	lockTime, err := dbhandler.CheckLockout(failType, wid, getFailureSource(session))
 	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
 		logging.Writef("getLockout: error checking lockout: %s", err.Error())
@@ -427,3 +579,37 @@ func getLockout(session *sessionState, failType string, wid string) (string, err
 
 	return "", nil
 }
+
+// registerDeviceSession records a session which has logged in so that it can be ended if its
+// device is revoked
+func registerDeviceSession(session *sessionState) {
+	deviceSessionLock.Lock()
+	defer deviceSessionLock.Unlock()
+	deviceSessions[session.ID] = deviceSession{session.WID, session.DevID, session.Connection}
+}
+
+// unregisterDeviceSession removes a session from the registry of logged-in sessions
+func unregisterDeviceSession(session *sessionState) {
+	deviceSessionLock.Lock()
+	defer deviceSessionLock.Unlock()
+	delete(deviceSessions, session.ID)
+}
+
+// endDeviceSessions closes the connections of all sessions logged in with the specified device
+// other than the one with the ID given and returns the number closed. The sessions' workers
+// exit when their next read fails.
+func endDeviceSessions(wid string, devid string, exceptID string) int {
+	deviceSessionLock.Lock()
+	defer deviceSessionLock.Unlock()
+
+	count := 0
+	for id, entry := range deviceSessions {
+		if id == exceptID || entry.wid != wid || entry.devid != devid {
+			continue
+		}
+		entry.conn.Close()
+		delete(deviceSessions, id)
+		count++
+	}
+	return count
+}
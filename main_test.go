@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darkwyrm/anselusd/logging"
+)
+
+// newPipeSession returns a session which reads from one end of an in-memory connection along with
+// the other end, which plays the part of the client
+func newPipeSession(t *testing.T) (*sessionState, net.Conn) {
+	server, client := net.Pipe()
+	server.SetDeadline(time.Now().Add(time.Second * 10))
+	client.SetDeadline(time.Now().Add(time.Second * 10))
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	var session sessionState
+	session.Connection = server
+	session.Reader = bufio.NewReaderSize(server, MaxCommandLength)
+	return &session, client
+}
+
+// startTestSession runs a session worker for one end of an in-memory connection and returns the
+// other end, which plays the part of the client, once the greeting has been read
+func startTestSession(t *testing.T) (net.Conn, *bufio.Reader) {
+	server, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(time.Second * 10))
+	t.Cleanup(func() { client.Close() })
+
+	connWaitGroup.Add(1)
+	go connectionWorker(server)
+
+	reader := bufio.NewReader(client)
+	greeting := readTestResponse(t, reader)
+	if greeting.Code != 200 {
+		t.Fatalf("unexpected greeting: %d %s", greeting.Code, greeting.Status)
+	}
+	return client, reader
+}
+
+// sendTestData writes each of the parts to the connection in order without waiting for the other
+// end to read them
+func sendTestData(conn net.Conn, parts ...string) {
+	go func() {
+		for _, part := range parts {
+			_, err := conn.Write([]byte(part))
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// readTestResponse reads one response from the server
+func readTestResponse(t *testing.T, reader *bufio.Reader) ServerResponse {
+	t.Helper()
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("error reading response: %s", err)
+	}
+
+	var response ServerResponse
+	err = json.Unmarshal([]byte(line), &response)
+	if err != nil {
+		t.Fatalf("bad response %q: %s", line, err)
+	}
+	return response
+}
+
+func TestGetRequestFraming(t *testing.T) {
+	session, client := newPipeSession(t)
+
+	// A request split across writes, two requests in one write, and blank lines between requests
+	sendTestData(client, `{"Action":"NO`, `OP","Data":{}}`+"\r\n",
+		`{"Action":"CANCEL"}`+"\n"+`{"Action":"PWD","Data":{"Path":"/"}}`+"\r\n",
+		"\r\n\n"+`{"Action":"QUIT"}`+"\n")
+
+	for _, expected := range []string{"NOOP", "CANCEL", "PWD", "QUIT"} {
+		request, err := session.GetRequest()
+		if err != nil {
+			t.Fatalf("GetRequest() failed for %s: %s", expected, err)
+		}
+		if request.Action != expected {
+			t.Fatalf("GetRequest() returned %s, expected %s", request.Action, expected)
+		}
+		if request.Data == nil {
+			t.Fatalf("GetRequest() returned nil Data for %s", expected)
+		}
+		if expected == "PWD" && request.Data["Path"] != "/" {
+			t.Fatal("GetRequest() lost the request's data")
+		}
+	}
+}
+
+func TestGetRequestTooLong(t *testing.T) {
+	session, client := newPipeSession(t)
+
+	// The whole of an overlong line is thrown away, so the request after it is read normally
+	longRequest := `{"Action":"NOOP","Data":{"Filler":"` + strings.Repeat("x", MaxCommandLength*2) +
+		`"}}` + "\r\n"
+	sendTestData(client, longRequest+`{"Action":"CANCEL"}`+"\r\n")
+
+	_, err := session.GetRequest()
+	if err != errRequestTooLong {
+		t.Fatalf("GetRequest() returned %v for an overlong request", err)
+	}
+
+	request, err := session.GetRequest()
+	if err != nil || request.Action != "CANCEL" {
+		t.Fatalf("GetRequest() failed to read the request after an overlong one: %v", err)
+	}
+}
+
+func TestGetRequestMalformed(t *testing.T) {
+	session, client := newPipeSession(t)
+
+	sendTestData(client, `{"Action":`+"\r\n", `{"Data":{}}`+"\r\n", `["CANCEL"]`+"\r\n",
+		`{"Action":"CANCEL"}`+"\r\n")
+
+	for i := 0; i < 3; i++ {
+		_, err := session.GetRequest()
+		if err != errMalformedRequest {
+			t.Fatalf("GetRequest() returned %v for malformed request #%d", err, i+1)
+		}
+	}
+
+	request, err := session.GetRequest()
+	if err != nil || request.Action != "CANCEL" {
+		t.Fatalf("GetRequest() failed to read the request after malformed ones: %v", err)
+	}
+}
+
+func TestSessionBadRequests(t *testing.T) {
+	client, reader := startTestSession(t)
+
+	// Bad requests are answered and the session carries on
+	sendTestData(client, strings.Repeat("x", MaxCommandLength+1)+"\r\n",
+		`{"Action":"CANCEL"}`+"\r\n", "not json\r\n", `{"Action":"CANCEL"}`+"\r\n")
+
+	for _, info := range []string{"Request too long", "", "Malformed request", ""} {
+		response := readTestResponse(t, reader)
+		if info == "" {
+			if response.Code != 200 {
+				t.Fatalf("session didn't continue after a bad request: %d %s", response.Code,
+					response.Info)
+			}
+			continue
+		}
+		if response.Code != 400 || response.Info != info {
+			t.Fatalf("expected 400 %s, got %d %s", info, response.Code, response.Info)
+		}
+	}
+
+	sendTestData(client, `{"Action":"QUIT"}`+"\r\n")
+}
+
+// resetShutdown undoes beginShutdown so that later tests can start sessions
+func resetShutdown() {
+	connSessionLock.Lock()
+	defer connSessionLock.Unlock()
+	shuttingDown = false
+}
+
+func TestShutdownSessions(t *testing.T) {
+	defer resetShutdown()
+	_, reader := startTestSession(t)
+
+	// Sessions waiting for a request are told right away
+	beginShutdown()
+	response := readTestResponse(t, reader)
+	if response.Code != 407 {
+		t.Fatalf("idle session got %d %s instead of a shutdown notice", response.Code,
+			response.Status)
+	}
+
+	done := make(chan bool)
+	go func() {
+		drainSessions(time.Second * 5)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 4):
+		t.Fatal("drainSessions() waited for sessions which had ended")
+	}
+
+	// Clients which connect during shutdown are turned away after the greeting
+	_, reader = startTestSession(t)
+	response = readTestResponse(t, reader)
+	if response.Code != 407 {
+		t.Fatalf("new session got %d %s instead of a shutdown notice", response.Code,
+			response.Status)
+	}
+}
+
+func TestDrainSessionsTimeout(t *testing.T) {
+	logging.Init(filepath.Join(t.TempDir(), "anselusd.log"), false)
+
+	// A session which is busy with a command is given until the time runs out
+	server, client := net.Pipe()
+	defer client.Close()
+	session := sessionState{ID: "busy-session", Connection: server}
+	addConnSession(&session)
+	connWaitGroup.Add(1)
+	go func() {
+		defer connWaitGroup.Done()
+		defer removeConnSession(&session)
+		buffer := make([]byte, 16)
+		for {
+			_, err := server.Read(buffer)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	drainSessions(time.Millisecond * 200)
+	if time.Since(start) < time.Millisecond*200 {
+		t.Fatal("drainSessions() didn't wait for a busy session")
+	}
+
+	_, err := client.Write([]byte("x"))
+	if err == nil {
+		t.Fatal("drainSessions() didn't close a session which didn't finish in time")
+	}
+}
+
+// addrConn is a connection which is only good for reporting the address of the other end
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestGetClientIP(t *testing.T) {
+	var session sessionState
+
+	// Link-local addresses come with the zone of the interface they were received on
+	session.Connection = addrConn{addr: &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 2001,
+		Zone: "eth0"}}
+	if ip := getClientIP(&session); !ip.Equal(net.ParseIP("fe80::1")) {
+		t.Fatalf("getClientIP() returned %v for a link-local address", ip)
+	}
+
+	session.Connection = addrConn{addr: &net.TCPAddr{IP: net.ParseIP("::ffff:192.168.1.10"),
+		Port: 2001}}
+	ip := getClientIP(&session)
+	if len(ip) != net.IPv4len || !ip.Equal(net.ParseIP("192.168.1.10")) {
+		t.Fatalf("getClientIP() returned %v for an IPv4-mapped address", ip)
+	}
+}
+
+func TestGetFailureSource(t *testing.T) {
+	expected := map[string]string{
+		"192.168.1.10": "192.168.1.10",
+		"127.0.0.1":    "127.0.0.1",
+		// IPv6 clients are counted by /64
+		"2001:db8:1:2:3:4:5:6":     "2001:db8:1:2::",
+		"2001:db8:1:2:ffff::1":     "2001:db8:1:2::",
+		"2001:db8:1:3::1":          "2001:db8:1:3::",
+		"fe80::1234:5678:9abc:def": "fe80::",
+	}
+
+	var session sessionState
+	for address, source := range expected {
+		session.Connection = addrConn{addr: &net.TCPAddr{IP: net.ParseIP(address), Port: 2001}}
+		if result := getFailureSource(&session); result != source {
+			t.Fatalf("getFailureSource() returned %s for %s, expected %s", result, address, source)
+		}
+	}
+
+	session.Connection = addrConn{addr: &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 2001,
+		Zone: "eth0"}}
+	if result := getFailureSource(&session); result != "fe80::" {
+		t.Fatalf("getFailureSource() returned %s for a link-local address", result)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darkwyrm/anselusd/cryptostring"
+	"github.com/darkwyrm/anselusd/dbhandler"
+	"github.com/darkwyrm/anselusd/ezcrypt"
+	"github.com/darkwyrm/anselusd/fshandler"
+	"github.com/darkwyrm/anselusd/logging"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+// Per-recipient delivery results returned by SEND and DELIVER
+const (
+	deliveryOK          = "OK"
+	deliveryQueued      = "QUEUED"
+	deliveryBadAddress  = "BAD ADDRESS"
+	deliveryNotFound    = "NOT FOUND"
+	deliveryQuota       = "QUOTA INSUFFICIENT"
+	deliveryUnsupported = "NOT IMPLEMENTED"
+	deliveryError       = "INTERNAL SERVER ERROR"
+)
+
+// resolveLocalRecipient returns the workspace ID for a recipient address on this server. An
+// empty workspace ID is returned along with a delivery result if the address can't be used.
+func resolveLocalRecipient(addr string) (string, string) {
+	if dbhandler.GetAnselusAddressType(addr) == 0 {
+		return "", deliveryBadAddress
+	}
+
+	parts := strings.Split(addr, "/")
+	if !strings.EqualFold(parts[1], viper.GetString("global.domain")) {
+		return "", deliveryUnsupported
+	}
+
+	wid, err := dbhandler.ResolveAddress(addr)
+	if err != nil {
+		if err.Error() == "workspace not found" {
+			return "", deliveryNotFound
+		}
+		logging.Writef("resolveLocalRecipient: error resolving %s: %s", addr, err.Error())
+		return "", deliveryError
+	}
+
+	// Workspaces which have been deleted, disabled, or are still awaiting approval keep their
+	// rows, but they can't receive anything
+	exists, status := dbhandler.CheckWorkspace(wid)
+	if !exists || (status != "active" && status != "approved") {
+		return "", deliveryNotFound
+	}
+
+	return wid, ""
+}
+
+// sendNotice places a JSON notice from the server into the inbox of a workspace. The time the
+// notice was sent is added to it.
+func sendNotice(wid string, notice map[string]string) error {
+	notice["Time"] = time.Now().UTC().Format("20060102T150405Z")
+	data, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+
+	fsh := fshandler.GetFSHandler()
+	tempHandle, tempName, err := fsh.MakeTempFile(wid)
+	if err != nil {
+		return err
+	}
+	defer fsh.DeleteTempFile(wid, tempName)
+
+	_, err = tempHandle.Write(data)
+	tempHandle.Close()
+	if err != nil {
+		return err
+	}
+
+	result := deliverMessage(wid, tempName, int64(len(data)), wid)
+	if result != deliveryOK {
+		return errors.New(result)
+	}
+	return nil
+}
+
+// deliverMessage places a copy of a message from the temporary file area of a workspace into the
+// inbox of a local recipient and charges it against the recipient's quota. The temporary file
+// itself is left in place.
+func deliverMessage(wid string, tempName string, size int64, recipient string) string {
+	fits, _, _, err := checkQuota(recipient, uint64(size))
+	if err != nil {
+		logging.Writef("deliverMessage: error checking quota for %s: %s", recipient,
+			err.Error())
+		return deliveryError
+	}
+	if !fits {
+		return deliveryQuota
+	}
+
+	fsh := fshandler.GetFSHandler()
+	inbox := fshandler.InboxPath(recipient)
+	exists, err := fsh.Exists(inbox)
+	if err == nil && !exists {
+		err = fsh.MakeDirectory(inbox)
+	}
+	if err != nil {
+		logging.Writef("deliverMessage: error preparing inbox for %s: %s", recipient, err.Error())
+		return deliveryError
+	}
+
+	copyName, err := fsh.CopyTempFile(wid, tempName)
+	if err != nil {
+		logging.Writef("deliverMessage: error copying message for %s: %s", recipient,
+			err.Error())
+		return deliveryError
+	}
+
+	_, err = fsh.InstallTempFile(wid, copyName, inbox)
+	if err != nil {
+		fsh.DeleteTempFile(wid, copyName)
+		logging.Writef("deliverMessage: error installing message for %s: %s", recipient,
+			err.Error())
+		return deliveryError
+	}
+	updateQuotaUsage(recipient, size)
+
+	return deliveryOK
+}
+
+// receiveMessage reads a sealed message of the size given in the current request into the
+// temporary file area of the specified workspace and checks it against the hash in the request.
+// Messages which are too large or don't fit in the workspace's quota are refused.
+// If the message could not be received, an error response has already been sent and the returned
+// name is empty. Otherwise, the caller is responsible for deleting the temporary file.
+func receiveMessage(session *sessionState, wid string) (string, int64, cryptostring.CryptoString) {
+	var msgHash cryptostring.CryptoString
+	err := msgHash.Set(session.Message.Data["Hash"])
+	if err != nil {
+		session.SendStringResponse(400, "BAD REQUEST", err.Error())
+		return "", 0, msgHash
+	}
+	if _, err = ezcrypt.GetHash(msgHash.Prefix); err != nil {
+		session.SendStringResponse(309, "ENCRYPTION TYPE NOT SUPPORTED",
+			"Supported: BLAKE2B-256, SHA-256, SHA3-256")
+		return "", 0, msgHash
+	}
+
+	msgSize, err := strconv.ParseInt(session.Message.Data["Size"], 10, 64)
+	if err != nil || msgSize < 1 {
+		session.SendStringResponse(400, "BAD REQUEST", "Bad message size")
+		return "", 0, msgHash
+	}
+
+	// The size is checked before any of the message is accepted. Copies for the recipients are
+	// checked against their own quotas when they are delivered.
+	maxSize := viper.GetInt64("global.max_message_size") * 1_048_576
+	if msgSize > maxSize {
+		response := NewServerResponse(414, "LIMIT REACHED")
+		response.Data["Max-Size"] = strconv.FormatInt(maxSize, 10)
+		session.SendResponse(*response)
+		return "", 0, msgHash
+	}
+	if isOverQuota(session, wid, uint64(msgSize)) {
+		return "", 0, msgHash
+	}
+
+	fsh := fshandler.GetFSHandler()
+	tempHandle, tempName, err := fsh.MakeTempFile(wid)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("receiveMessage: error creating temp file: %s", err.Error())
+		return "", 0, msgHash
+	}
+	defer tempHandle.Close()
+
+	if session.SendStringResponse(100, "CONTINUE", "") != nil {
+		fsh.DeleteTempFile(wid, tempName)
+		return "", 0, msgHash
+	}
+
+	_, err = io.CopyN(tempHandle, session.Reader, msgSize)
+	if err != nil {
+		fsh.DeleteTempFile(wid, tempName)
+		session.IsTerminating = true
+		return "", 0, msgHash
+	}
+
+	_, err = tempHandle.Seek(0, io.SeekStart)
+	if err != nil {
+		fsh.DeleteTempFile(wid, tempName)
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("receiveMessage: error rewinding temp file: %s", err.Error())
+		return "", 0, msgHash
+	}
+
+	hashMatch, err := ezcrypt.VerifyHash(msgHash, tempHandle)
+	if err != nil {
+		fsh.DeleteTempFile(wid, tempName)
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("receiveMessage: error hashing temp file: %s", err.Error())
+		return "", 0, msgHash
+	}
+	if !hashMatch {
+		fsh.DeleteTempFile(wid, tempName)
+		session.SendStringResponse(410, "HASH MISMATCH", "")
+		return "", 0, msgHash
+	}
+
+	return tempName, msgSize, msgHash
+}
+
+// splitRecipients returns the nonempty addresses in a comma-separated recipient list
+func splitRecipients(list string) []string {
+	recipients := make([]string, 0)
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			recipients = append(recipients, addr)
+		}
+	}
+	return recipients
+}
+
+// sendResults sends a successful response containing the per-recipient delivery results
+func sendResults(session *sessionState, results map[string]string) {
+	resultData, err := json.Marshal(results)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("sendResults: error encoding results: %s", err.Error())
+		return
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Results"] = string(resultData)
+	session.SendResponse(*response)
+}
+
+// queueRemoteMessage queues a copy of a message for delivery to recipients on another server and
+// returns the delivery result for them
+func queueRemoteMessage(wid string, tempName string, size int64, hash string, domain string,
+	recipients []string) string {
+
+	fsh := fshandler.GetFSHandler()
+	copyName, err := fsh.CopyTempFile(wid, tempName)
+	if err != nil {
+		logging.Writef("queueRemoteMessage: error copying message for %s: %s", domain,
+			err.Error())
+		return deliveryError
+	}
+
+	err = dbhandler.QueueDelivery(dbhandler.QueuedDelivery{
+		ID:         uuid.New().String(),
+		Sender:     wid,
+		Domain:     domain,
+		Recipients: strings.Join(recipients, ","),
+		TempName:   copyName,
+		Size:       size,
+		Hash:       hash,
+	})
+	if err != nil {
+		fsh.DeleteTempFile(wid, copyName)
+		return deliveryError
+	}
+
+	return deliveryQueued
+}
+
+func commandDeliver(session *sessionState) {
+	// Command syntax:
+	// DELIVER(Size, Hash, Recipients, Sender-Domain)
+
+	// DELIVER is used by other servers to hand off messages for local recipients, so it does not
+	// require a login. Instead, the connection must come from the server for the sending domain.
+	// Only recipients on this server are accepted.
+	senderDomain := strings.ToLower(session.Message.Data["Sender-Domain"])
+	if senderDomain == "" || strings.EqualFold(senderDomain, viper.GetString("global.domain")) ||
+		!isServerAddress(senderDomain, getClientIP(session)) {
+		logging.Writef("Refused delivery claiming to be from %s from %s", senderDomain,
+			session.Connection.RemoteAddr().String())
+		session.SendStringResponse(403, "FORBIDDEN", "Sender-Domain doesn't match connection")
+		return
+	}
+
+	recipients := splitRecipients(session.Message.Data["Recipients"])
+	if len(recipients) == 0 {
+		session.SendStringResponse(400, "BAD REQUEST", "No recipients")
+		return
+	}
+
+	// Recipients without room for the message are left out so that it is received into the
+	// temporary area of one which has room. A bad size is reported by receiveMessage.
+	msgSize, _ := strconv.ParseInt(session.Message.Data["Size"], 10, 64)
+	if msgSize < 0 {
+		msgSize = 0
+	}
+
+	results := make(map[string]string, len(recipients))
+	recipientWIDs := make(map[string]string)
+	quotaFull := false
+	for _, addr := range recipients {
+		wid, result := resolveLocalRecipient(addr)
+		if wid == "" {
+			results[addr] = result
+			continue
+		}
+
+		fits, _, _, err := checkQuota(wid, uint64(msgSize))
+		if err != nil {
+			logging.Writef("commandDeliver: error checking quota for %s: %s", wid, err.Error())
+			results[addr] = deliveryError
+			continue
+		}
+		if !fits {
+			results[addr] = deliveryQuota
+			quotaFull = true
+			continue
+		}
+		recipientWIDs[addr] = wid
+	}
+	if len(recipientWIDs) == 0 {
+		if quotaFull {
+			session.SendStringResponse(409, "QUOTA INSUFFICIENT", "")
+			return
+		}
+		session.SendStringResponse(404, "NOT FOUND", "No valid recipients")
+		return
+	}
+
+	// The message is staged in the temporary area of the first valid recipient
+	var stageWID string
+	for _, addr := range recipients {
+		if wid, exists := recipientWIDs[addr]; exists {
+			stageWID = wid
+			break
+		}
+	}
+
+	tempName, msgSize, _ := receiveMessage(session, stageWID)
+	if tempName == "" {
+		return
+	}
+	defer fshandler.GetFSHandler().DeleteTempFile(stageWID, tempName)
+
+	delivered := make(map[string]string)
+	for _, addr := range recipients {
+		wid, exists := recipientWIDs[addr]
+		if !exists {
+			continue
+		}
+		if result, exists := delivered[wid]; exists {
+			results[addr] = result
+			continue
+		}
+
+		results[addr] = deliverMessage(stageWID, tempName, msgSize, wid)
+		delivered[wid] = results[addr]
+	}
+
+	logging.Writef("Accepted delivery from %s for %d recipient(s)", senderDomain, len(delivered))
+	sendResults(session, results)
+}
+
+func commandSend(session *sessionState) {
+	// Command syntax:
+	// SEND(Size, Hash, Recipients)
+
+	recipients := splitRecipients(session.Message.Data["Recipients"])
+	if len(recipients) == 0 {
+		session.SendStringResponse(400, "BAD REQUEST", "No recipients")
+		return
+	}
+
+	// The sealed message is received into the sender's temporary file area and a copy is made for
+	// each local recipient and each remote domain once it has been verified
+	tempName, msgSize, msgHash := receiveMessage(session, session.WID)
+	if tempName == "" {
+		return
+	}
+	defer fshandler.GetFSHandler().DeleteTempFile(session.WID, tempName)
+
+	// A recipient listed more than once, or by both an address and an alias, gets one copy
+	results := make(map[string]string, len(recipients))
+	delivered := make(map[string]string)
+	remote := make(map[string][]string)
+	localDomain := viper.GetString("global.domain")
+	for _, addr := range recipients {
+		if dbhandler.GetAnselusAddressType(addr) != 0 {
+			domain := strings.ToLower(strings.Split(addr, "/")[1])
+			if !strings.EqualFold(domain, localDomain) {
+				remote[domain] = append(remote[domain], addr)
+				continue
+			}
+		}
+
+		wid, result := resolveLocalRecipient(addr)
+		if wid == "" {
+			results[addr] = result
+			continue
+		}
+
+		if result, exists := delivered[wid]; exists {
+			results[addr] = result
+			continue
+		}
+
+		results[addr] = deliverMessage(session.WID, tempName, msgSize, wid)
+		delivered[wid] = results[addr]
+	}
+
+	for domain, addrs := range remote {
+		result := queueRemoteMessage(session.WID, tempName, msgSize, msgHash.AsString(), domain,
+			addrs)
+		for _, addr := range addrs {
+			results[addr] = result
+		}
+	}
+	if len(remote) > 0 {
+		wakeDeliveryWorker()
+	}
+
+	sendResults(session, results)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"net"
 	"regexp"
@@ -18,11 +20,6 @@ import (
 func commandGetWID(session *sessionState) {
 	// command syntax:
 	// GETWID(User-ID, Domain="")
-	if !session.Message.HasField("User-ID") {
-		session.SendStringResponse(400, "BAD REQUEST", "")
-		return
-	}
-
 	if strings.ContainsAny(session.Message.Data["User-ID"], "/\"") {
 		session.SendStringResponse(400, "BAD REQUEST", "Bad User-ID")
 		return
@@ -53,7 +50,12 @@ func commandGetWID(session *sessionState) {
 			if terminate || err != nil {
 				return
 			}
+			session.SendStringResponse(404, "NOT FOUND", "")
+			return
 		}
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandGetWID: error resolving address: %s", err.Error())
+		return
 	}
 	response := NewServerResponse(200, "OK")
 	response.Data["Workspace-ID"] = wid
@@ -64,19 +66,6 @@ func commandPreregister(session *sessionState) {
 	// command syntax:
 	// PREREG(User-ID="",Workspace-ID="",Domain="")
 
-	adminAddress := "admin/" + viper.GetString("global.domain")
-	adminWid, err := dbhandler.ResolveAddress(adminAddress)
-	if err != nil {
-		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("commandPreregister: Error resolving address: %s", err)
-		return
-	}
-
-	if session.LoginState != loginClientSession || session.WID != adminWid {
-		session.SendStringResponse(403, "FORBIDDEN", "Only admin can use this")
-		return
-	}
-
 	// Just do some basic syntax checks on the user ID
 	uid := ""
 	if session.Message.HasField("User-ID") {
@@ -162,12 +151,6 @@ func commandRegCode(session *sessionState) {
 	// command syntax:
 	// REGCODE(User-ID, Reg-Code, Password-Hash, Device-ID, Device-Key, Domain="")
 	// REGCODE(Workspace-ID, Reg-Code, Password-Hash, Device-ID, Device-Key, Domain="")
-
-	if session.Message.Validate([]string{"Reg-Code", "Password-Hash", "Device-ID",
-		"Device-Key"}) != nil {
-		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
-		return
-	}
 	if !dbhandler.ValidateUUID(session.Message.Data["Device-ID"]) {
 		session.SendStringResponse(400, "BAD REQUEST", "Invalid Device-ID")
 		return
@@ -298,10 +281,42 @@ func commandRegCode(session *sessionState) {
 	session.SendStringResponse(201, "REGISTERED", "")
 }
 
+// isRegistrationSubnet returns true if the address is in one of the subnets for network
+// registration. IPv4 and IPv6 subnets are configured separately.
+func isRegistrationSubnet(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	subnetList := viper.GetString("global.registration_subnet6")
+	if ip.To4() != nil {
+		subnetList = viper.GetString("global.registration_subnet")
+	}
+
+	for _, part := range strings.Split(subnetList, ",") {
+		netstring := strings.TrimSpace(part)
+		if netstring == "" {
+			continue
+		}
+
+		// Skipping the error checking on the subnet strings because it's done during startup
+		_, subnet, _ := net.ParseCIDR(netstring)
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func commandRegister(session *sessionState) {
 	// command syntax:
 	// REGISTER(Workspace-ID, Password-Hash, Device-ID, Device-Key, User-ID="", Type="")
 
+	if session.Message.Data["Type"] == "shared" {
+		registerShared(session)
+		return
+	}
+
 	if session.Message.Validate([]string{"Workspace-ID", "Password-Hash", "Device-ID",
 		"Device-Key"}) != nil {
 		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
@@ -325,16 +340,10 @@ func commandRegister(session *sessionState) {
 	wtype := "individual"
 	if session.Message.HasField("Type") {
 		wtype = session.Message.Data["Type"]
-		if wtype != "shared" && wtype != "individual" {
+		if wtype != "individual" {
 			session.SendStringResponse(400, "BAD REQUEST", "Bad Type")
 			return
 		}
-
-		// TODO: Eliminate this when shared workspaces are implemented
-		if wtype == "shared" {
-			session.SendStringResponse(301, "NOT IMPLEMENTED", "")
-			return
-		}
 	}
 	regType := strings.ToLower(viper.GetString("global.registration"))
 
@@ -366,23 +375,7 @@ func commandRegister(session *sessionState) {
 	var workspaceStatus string
 	switch regType {
 	case "network":
-
-		ipParts := strings.Split(session.Connection.RemoteAddr().String(), ":")
-		clientIP := net.ParseIP(ipParts[0])
-
-		parts := strings.Split(viper.GetString("global.registration_subnet"), ",")
-		clientInSubnet := false
-		for _, part := range parts {
-			netstring := strings.TrimSpace(part)
-
-			// Skipping the error checking on the subnet strings because it's done during startup
-			_, subnet, _ := net.ParseCIDR(netstring)
-			if subnet.Contains(clientIP) {
-				clientInSubnet = true
-				break
-			}
-		}
-		if !clientInSubnet {
+		if !isRegistrationSubnet(getClientIP(session)) {
 			session.SendStringResponse(304, "REGISTRATION CLOSED", "")
 			return
 		}
@@ -422,6 +415,12 @@ func commandRegister(session *sessionState) {
 	}
 
 	if regType == "moderated" {
+		err = dbhandler.AddRegRequest(session.Message.Data["Workspace-ID"])
+		if err != nil {
+			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			logging.Writef("Internal server error. commandRegister.AddRegRequest. Error: %s\n", err)
+			return
+		}
 		session.SendStringResponse(101, "PENDING", "")
 	} else {
 		response := NewServerResponse(201, "REGISTERED")
@@ -430,23 +429,112 @@ func commandRegister(session *sessionState) {
 	}
 }
 
-func commandUnrecognized(session *sessionState) {
-	// command used when not recognized
-	session.SendStringResponse(400, "BAD REQUEST", "Unrecognized command")
+func commandRegApprove(session *sessionState) {
+	// command syntax:
+	// REGAPPROVE(Workspace-ID, Reason="")
+
+	decideRegRequest(session, "approved")
 }
 
-func commandUnregister(session *sessionState) {
+func commandRegList(session *sessionState) {
 	// command syntax:
-	// UNREGISTER(Password-Hash)
-	if !session.Message.HasField("Password-Hash") {
+	// REGLIST
+
+	requests, err := dbhandler.GetRegRequests()
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandRegList: error getting registration requests: %s", err.Error())
+		return
+	}
+
+	requestList := make([]map[string]string, 0, len(requests))
+	for _, request := range requests {
+		requestList = append(requestList, map[string]string{
+			"Workspace-ID": request.WID,
+			"User-ID":      request.UID,
+			"Requested":    request.Requested,
+		})
+	}
+
+	requestData, err := json.Marshal(requestList)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandRegList: error encoding registration requests: %s", err.Error())
+		return
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Requests"] = string(requestData)
+	session.SendResponse(*response)
+}
+
+func commandRegReject(session *sessionState) {
+	// command syntax:
+	// REGREJECT(Workspace-ID, Reason="")
+
+	decideRegRequest(session, "rejected")
+}
+
+// decideRegRequest approves or rejects a pending registration request. An approved workspace is
+// activated right away. A rejected one is kept until the requester logs in to learn the outcome.
+func decideRegRequest(session *sessionState, decision string) {
+	if !session.Message.HasField("Workspace-ID") {
 		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
 		return
 	}
 
-	if session.LoginState != loginClientSession {
-		session.SendStringResponse(401, "UNAUTHORIZED", "Must be logged in for this command")
+	wid := session.Message.Data["Workspace-ID"]
+	if !dbhandler.ValidateUUID(wid) {
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Workspace-ID")
+		return
+	}
+
+	reason := session.Message.Data["Reason"]
+	if len(reason) > 1024 {
+		session.SendStringResponse(400, "BAD REQUEST", "Reason too long")
+		return
+	}
+
+	status, _, err := dbhandler.GetRegRequest(wid)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("decideRegRequest: error getting registration request: %s", err.Error())
+		return
+	}
+	if status != "pending" {
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
 	}
 
+	workspaceStatus := "active"
+	if decision == "rejected" {
+		workspaceStatus = "rejected"
+	}
+	err = dbhandler.SetWorkspaceStatus(wid, workspaceStatus)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("decideRegRequest: error setting workspace status: %s", err.Error())
+		return
+	}
+
+	err = dbhandler.SetRegRequest(wid, decision, reason)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("decideRegRequest: error updating registration request: %s", err.Error())
+		return
+	}
+
+	session.SendStringResponse(200, "OK", "")
+}
+
+func commandUnrecognized(session *sessionState) {
+	// command used when not recognized
+	session.SendStringResponse(400, "BAD REQUEST", "Unrecognized command")
+}
+
+func commandUnregister(session *sessionState) {
+	// command syntax:
+	// UNREGISTER(Password-Hash)
 	match, err := dbhandler.CheckPassword(session.WID, session.Message.Data["Password-Hash"])
 	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
@@ -458,23 +546,15 @@ func commandUnregister(session *sessionState) {
 		return
 	}
 
-	regType := strings.ToLower(viper.GetString("global.registration"))
-	if regType == "private" || regType == "moderated" {
-		// TODO: submit admin request to delete workspace
-		// session.SendStringResponse(101, "PENDING", "Pending administrator approval")
-		session.SendStringResponse(301, "NOT IMPLEMENTED", "Not implemented yet. Sorry!")
-		return
-	}
-
-	adminWid, err := dbhandler.ResolveAddress("admin/" + viper.GetString("global.domain"))
+	adminWid, err := getAdminWID()
 	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
 		logging.Write("Unregister: failed to resolve admin account")
 		return
 	}
 
-	// This command can be used to unregister other workspaces, but only the admin account is
-	// allowed to do this
+	// This command can be used to unregister other workspaces, but only by those with permission
+	// to do so
 	wid := session.WID
 	if session.Message.HasField("Workspace-ID") {
 		if !dbhandler.ValidateUUID(session.Message.Data["Workspace-ID"]) {
@@ -483,14 +563,18 @@ func commandUnregister(session *sessionState) {
 		}
 
 		if session.WID != session.Message.Data["Workspace-ID"] {
-
-			if session.WID != adminWid {
+			allowed, err := hasPermission(session.WID, permUnregister)
+			if err != nil {
+				session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+				logging.Writef("Unregister: error checking permission: %s", err.Error())
+				return
+			}
+			if !allowed {
 				session.SendStringResponse(401, "UNAUTHORIZED",
-					"Only admin can unregister other workspaces")
+					"Not allowed to unregister other workspaces")
 				return
 			}
 			wid = session.Message.Data["Workspace-ID"]
-
 		}
 	}
 
@@ -500,41 +584,161 @@ func commandUnregister(session *sessionState) {
 		return
 	}
 
-	// Can't delete support or abuse accounts
-	for _, builtin := range []string{"support", "abuse"} {
-		address, err := dbhandler.ResolveAddress(builtin + "/" + viper.GetString("global.domain"))
-		if err != nil {
-			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-			logging.Write("Unregister: failed to resolve account " + builtin)
-			return
-		}
-		if wid == address {
-			session.SendStringResponse(403, "FORBIDDEN",
-				fmt.Sprintf("Can't unregister the built-in %s account", builtin))
-			return
-		}
+	// Can't delete support or abuse accounts. These are checked by user ID instead of by
+	// resolving their addresses because they are regular workspaces when they aren't forwarded to
+	// the admin, and resolving follows the forwarding.
+	uid, domain, err := dbhandler.GetWorkspaceAddress(wid)
+	if err != nil && err != sql.ErrNoRows {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("Unregister: error getting workspace address: %s", err.Error())
+		return
+	}
+	if strings.EqualFold(domain, viper.GetString("global.domain")) &&
+		(uid == "support" || uid == "abuse") {
+		session.SendStringResponse(403, "FORBIDDEN",
+			fmt.Sprintf("Can't unregister the built-in %s account", uid))
+		return
 	}
 
 	// You also don't delete aliases with this command
 	isAlias, err := dbhandler.IsAlias(wid)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("Unregister: error checking for alias: %s", err.Error())
+		return
+	}
 	if isAlias {
 		session.SendStringResponse(403, "FORBIDDEN", "Aliases aren't removed with this command")
 		return
 	}
 
-	err = dbhandler.RemoveWorkspace(wid)
+	// On private and moderated servers, users need an administrator's approval to leave
+	regType := strings.ToLower(viper.GetString("global.registration"))
+	if wid == session.WID && (regType == "private" || regType == "moderated") {
+		err = dbhandler.AddUnregRequest(wid)
+		if err != nil {
+			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			logging.Writef("Unregister: error adding unregistration request: %s", err.Error())
+			return
+		}
+		session.SendStringResponse(101, "PENDING", "Pending administrator approval")
+		return
+	}
+
+	if !removeWorkspace(session, wid) {
+		return
+	}
+
+	session.SendStringResponse(202, "UNREGISTERED", "")
+}
+
+func commandUnregApprove(session *sessionState) {
+	// command syntax:
+	// UNREGAPPROVE(Workspace-ID)
+
+	wid := takeUnregRequest(session)
+	if wid == "" {
+		return
+	}
+
+	if !removeWorkspace(session, wid) {
+		return
+	}
+
+	session.SendStringResponse(200, "OK", "")
+}
+
+func commandUnregDecline(session *sessionState) {
+	// command syntax:
+	// UNREGDECLINE(Workspace-ID)
+
+	if takeUnregRequest(session) == "" {
+		return
+	}
+
+	session.SendStringResponse(200, "OK", "")
+}
+
+func commandUnregList(session *sessionState) {
+	// command syntax:
+	// UNREGLIST
+
+	requests, err := dbhandler.GetUnregRequests()
 	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
-		logging.Writef("Unregister: error removing workspace from db: %s", err.Error())
+		logging.Writef("commandUnregList: error getting unregistration requests: %s",
+			err.Error())
+		return
+	}
+
+	requestList := make([]map[string]string, 0, len(requests))
+	for _, request := range requests {
+		requestList = append(requestList, map[string]string{
+			"Workspace-ID": request.WID,
+			"User-ID":      request.UID,
+			"Requested":    request.Requested,
+		})
+	}
+
+	requestData, err := json.Marshal(requestList)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandUnregList: error encoding unregistration requests: %s",
+			err.Error())
 		return
 	}
 
+	response := NewServerResponse(200, "OK")
+	response.Data["Requests"] = string(requestData)
+	session.SendResponse(*response)
+}
+
+// takeUnregRequest removes the unregistration request for the workspace in the current request's
+// Workspace-ID field from the queue. It handles sending the appropriate message and returns an
+// empty string if the command handler should just exit.
+func takeUnregRequest(session *sessionState) string {
+	if !session.Message.HasField("Workspace-ID") {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return ""
+	}
+
+	wid := session.Message.Data["Workspace-ID"]
+	if !dbhandler.ValidateUUID(wid) {
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Workspace-ID")
+		return ""
+	}
+
+	found, err := dbhandler.RemoveUnregRequest(wid)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("takeUnregRequest: error removing unregistration request: %s",
+			err.Error())
+		return ""
+	}
+	if !found {
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return ""
+	}
+
+	return wid
+}
+
+// removeWorkspace deletes a workspace from the database and the filesystem. It handles sending
+// the appropriate message on failure and returns false if the command handler should just exit.
+func removeWorkspace(session *sessionState, wid string) bool {
+	err := dbhandler.RemoveWorkspace(wid)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("Unregister: error removing workspace from db: %s", err.Error())
+		return false
+	}
+
 	err = fshandler.RemoveWorkspace(wid)
 	if err != nil {
 		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
 		logging.Writef("Unregister: error removing workspace from filesystem: %s", err.Error())
-		return
+		return false
 	}
 
-	session.SendStringResponse(202, "UNREGISTERED", "")
+	return true
 }
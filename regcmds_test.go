@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestIsRegistrationSubnet(t *testing.T) {
+	viper.Set("global.registration_subnet", "192.168.0.0/16, 10.0.0.0/8")
+	viper.Set("global.registration_subnet6", "fd00::/8")
+	defer viper.Set("global.registration_subnet", "")
+	defer viper.Set("global.registration_subnet6", "")
+
+	expected := map[string]bool{
+		"192.168.4.2": true,
+		"10.1.1.1":    true,
+		"172.16.0.1":  false,
+		"fd12::1":     true,
+		"2001:db8::1": false,
+		// IPv4-mapped addresses are checked against the IPv4 subnets
+		"::ffff:10.1.1.1":   true,
+		"::ffff:172.16.0.1": false,
+	}
+	for address, result := range expected {
+		if isRegistrationSubnet(net.ParseIP(address)) != result {
+			t.Fatalf("isRegistrationSubnet() returned %t for %s", !result, address)
+		}
+	}
+	if isRegistrationSubnet(nil) {
+		t.Fatal("isRegistrationSubnet() accepted an empty address")
+	}
+
+	// Each list is only used for its own kind of address, even when a subnet in the other list
+	// would cover it
+	viper.Set("global.registration_subnet", "")
+	viper.Set("global.registration_subnet6", "::/0")
+	if isRegistrationSubnet(net.ParseIP("10.1.1.1")) ||
+		isRegistrationSubnet(net.ParseIP("::ffff:10.1.1.1")) {
+		t.Fatal("isRegistrationSubnet() checked an IPv4 address against the IPv6 subnets")
+	}
+	if !isRegistrationSubnet(net.ParseIP("2001:db8::1")) {
+		t.Fatal("isRegistrationSubnet() refused an IPv6 address in an IPv6 subnet")
+	}
+
+	viper.Set("global.registration_subnet", "0.0.0.0/0")
+	viper.Set("global.registration_subnet6", "")
+	if isRegistrationSubnet(net.ParseIP("2001:db8::1")) {
+		t.Fatal("isRegistrationSubnet() checked an IPv6 address against the IPv4 subnets")
+	}
+}
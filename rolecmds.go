@@ -0,0 +1,188 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/darkwyrm/anselusd/dbhandler"
+	"github.com/darkwyrm/anselusd/logging"
+	"github.com/spf13/viper"
+)
+
+// Permissions which can be granted to workspaces through roles
+const (
+	permAliases         = "aliases"
+	permKeycards        = "keycards"
+	permOrgKeys         = "orgkeys"
+	permPreregister     = "prereg"
+	permRegistration    = "registration"
+	permResetPassword   = "resetpassword"
+	permRoles           = "roles"
+	permSetRoot         = "setroot"
+	permSetStatus       = "setstatus"
+	permSharedWorkspace = "sharedworkspace"
+	permUnregister      = "unregister"
+)
+
+// builtinRoles maps each of the server's roles to the permissions it grants. The admin role grants
+// everything. The admin account always has the admin role, even if it isn't in the database.
+var builtinRoles = map[string][]string{
+	"admin": {permAliases, permKeycards, permOrgKeys, permPreregister, permRegistration,
+		permResetPassword, permRoles, permSetRoot, permSetStatus, permSharedWorkspace,
+		permUnregister},
+	"moderator": {permPreregister, permRegistration, permSetStatus},
+	"support":   {permResetPassword},
+}
+
+// getAdminWID returns the workspace ID of the server's admin account
+func getAdminWID() (string, error) {
+	return dbhandler.ResolveAddress("admin/" + viper.GetString("global.domain"))
+}
+
+// hasPermission returns true if any of a workspace's roles grants the specified permission
+func hasPermission(wid string, permission string) (bool, error) {
+	adminWid, err := getAdminWID()
+	if err != nil {
+		return false, err
+	}
+	if wid == adminWid {
+		return true, nil
+	}
+
+	roles, err := dbhandler.GetRoles(wid)
+	if err != nil {
+		return false, err
+	}
+
+	for _, role := range roles {
+		for _, granted := range builtinRoles[role] {
+			if granted == permission {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// checkPermission returns true if the session is logged in and has the specified permission. It
+// handles sending the appropriate message and returns false if the command handler should just
+// exit.
+func checkPermission(session *sessionState, permission string) bool {
+	if session.LoginState != loginClientSession {
+		session.SendStringResponse(401, "UNAUTHORIZED", "")
+		return false
+	}
+
+	allowed, err := hasPermission(session.WID, permission)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("checkPermission: error checking permission %s for %s: %s", permission,
+			session.WID, err.Error())
+		return false
+	}
+	if !allowed {
+		session.SendStringResponse(403, "FORBIDDEN", "Permission denied")
+		return false
+	}
+
+	return true
+}
+
+// getRoleRequest validates the Workspace-ID and Role fields of the current request. It handles
+// sending the appropriate message and returns empty strings if the command handler should just
+// exit.
+func getRoleRequest(session *sessionState) (string, string) {
+	if session.Message.Validate([]string{"Workspace-ID", "Role"}) != nil {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return "", ""
+	}
+
+	wid := session.Message.Data["Workspace-ID"]
+	if !dbhandler.ValidateUUID(wid) {
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Workspace-ID")
+		return "", ""
+	}
+
+	role := strings.ToLower(session.Message.Data["Role"])
+	if _, exists := builtinRoles[role]; !exists {
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Role")
+		return "", ""
+	}
+
+	exists, _ := dbhandler.CheckWorkspace(wid)
+	if !exists {
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return "", ""
+	}
+
+	return wid, role
+}
+
+func commandGrantRole(session *sessionState) {
+	// Command syntax:
+	// GRANTROLE(Workspace-ID, Role)
+
+	wid, role := getRoleRequest(session)
+	if wid == "" {
+		return
+	}
+
+	err := dbhandler.AddRole(wid, role)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandGrantRole: error adding role: %s", err.Error())
+		return
+	}
+
+	logging.Writef("GRANTROLE: %s granted role %s to %s", session.WID, role, wid)
+	session.SendStringResponse(200, "OK", "")
+}
+
+func commandListRoles(session *sessionState) {
+	// Command syntax:
+	// LISTROLES(Workspace-ID="")
+
+	// Anyone may see their own roles, but seeing someone else's requires permission to manage them
+	wid := session.WID
+	if session.Message.HasField("Workspace-ID") && session.Message.Data["Workspace-ID"] != wid {
+		wid = session.Message.Data["Workspace-ID"]
+		if !dbhandler.ValidateUUID(wid) {
+			session.SendStringResponse(400, "BAD REQUEST", "Invalid Workspace-ID")
+			return
+		}
+
+		if !checkPermission(session, permRoles) {
+			return
+		}
+	}
+
+	roles, err := dbhandler.GetRoles(wid)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandListRoles: error getting roles: %s", err.Error())
+		return
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Roles"] = strings.Join(roles, ",")
+	session.SendResponse(*response)
+}
+
+func commandRevokeRole(session *sessionState) {
+	// Command syntax:
+	// REVOKEROLE(Workspace-ID, Role)
+
+	wid, role := getRoleRequest(session)
+	if wid == "" {
+		return
+	}
+
+	err := dbhandler.RemoveRole(wid, role)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandRevokeRole: error removing role: %s", err.Error())
+		return
+	}
+
+	logging.Writef("REVOKEROLE: %s revoked role %s from %s", session.WID, role, wid)
+	session.SendStringResponse(200, "OK", "")
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/darkwyrm/anselusd/dbhandler"
+	"github.com/darkwyrm/anselusd/logging"
+	"github.com/spf13/viper"
+)
+
+// Permission levels for members of shared workspaces. Each level includes the ones before it.
+const (
+	memberRead  = "read"
+	memberWrite = "write"
+	memberAdmin = "admin"
+)
+
+// checkFSAccess checks that the session may use its current filesystem root. Access to a
+// session's own workspace is unrestricted, but access to a shared workspace is checked against
+// the member's current permissions so that changes apply immediately. It handles sending the
+// appropriate message and returns false if the command handler should just exit.
+func checkFSAccess(session *sessionState, write bool) bool {
+	if !session.FSShared {
+		return true
+	}
+
+	permissions, err := dbhandler.GetMemberPermissions(session.FSRoot.WID(), session.WID)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		return false
+	}
+
+	switch permissions {
+	case "":
+		session.SendStringResponse(403, "FORBIDDEN", "Not a member of this workspace")
+		return false
+	case memberRead:
+		if write {
+			session.SendStringResponse(403, "FORBIDDEN", "Read-only access")
+			return false
+		}
+	}
+	return true
+}
+
+// getSharedWorkspace validates the Workspace-ID field of the current request and checks that it
+// refers to a shared workspace. It handles sending the appropriate message and returns an empty
+// string if the command handler should just exit.
+func getSharedWorkspace(session *sessionState) string {
+	if !session.Message.HasField("Workspace-ID") {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return ""
+	}
+
+	wid := session.Message.Data["Workspace-ID"]
+	if !dbhandler.ValidateUUID(wid) {
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Workspace-ID")
+		return ""
+	}
+
+	wtype, err := dbhandler.GetWorkspaceType(wid)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		return ""
+	}
+
+	switch wtype {
+	case "":
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return ""
+	case "shared":
+		return wid
+	default:
+		session.SendStringResponse(400, "BAD REQUEST", "Not a shared workspace")
+		return ""
+	}
+}
+
+// checkMemberAdmin returns true if the session is allowed to manage the members of a shared
+// workspace. The workspace's admin members and anyone with the sharedworkspace permission are
+// permitted to do this.
+func checkMemberAdmin(session *sessionState, wid string) bool {
+	permissions, err := dbhandler.GetMemberPermissions(wid, session.WID)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		return false
+	}
+	if permissions == memberAdmin {
+		return true
+	}
+
+	allowed, err := hasPermission(session.WID, permSharedWorkspace)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("checkMemberAdmin: error checking permission: %s", err)
+		return false
+	}
+	if allowed {
+		return true
+	}
+
+	session.SendStringResponse(403, "FORBIDDEN", "Only workspace admins can manage members")
+	return false
+}
+
+// resolveMember turns the Member-ID field of the current request, which may be a workspace ID or
+// an Anselus address, into the ID of a local individual workspace. It handles sending the
+// appropriate message and returns an empty string if the command handler should just exit.
+func resolveMember(session *sessionState) string {
+	if !session.Message.HasField("Member-ID") {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return ""
+	}
+
+	member := session.Message.Data["Member-ID"]
+	if !dbhandler.ValidateUUID(member) {
+		if dbhandler.GetAnselusAddressType(member) == 0 {
+			session.SendStringResponse(400, "BAD REQUEST", "Invalid Member-ID")
+			return ""
+		}
+
+		if !strings.EqualFold(strings.Split(member, "/")[1], viper.GetString("global.domain")) {
+			session.SendStringResponse(400, "BAD REQUEST", "Members must be on this server")
+			return ""
+		}
+
+		resolved, err := dbhandler.ResolveAddress(member)
+		if err != nil {
+			if err.Error() == "workspace not found" {
+				session.SendStringResponse(404, "NOT FOUND", "")
+				return ""
+			}
+			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			logging.Writef("resolveMember: Error resolving address: %s", err)
+			return ""
+		}
+		member = resolved
+	}
+
+	wtype, err := dbhandler.GetWorkspaceType(member)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		return ""
+	}
+
+	switch wtype {
+	case "":
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return ""
+	case "individual":
+		return member
+	default:
+		session.SendStringResponse(400, "BAD REQUEST", "Members must be individual workspaces")
+		return ""
+	}
+}
+
+// countAdmins returns the number of admin members in a member list
+func countAdmins(members map[string]string) int {
+	count := 0
+	for _, permissions := range members {
+		if permissions == memberAdmin {
+			count++
+		}
+	}
+	return count
+}
+
+func commandAddMember(session *sessionState) {
+	// Command syntax:
+	// ADDMEMBER(Workspace-ID, Member-ID, Permissions="read")
+
+	permissions := memberRead
+	if session.Message.HasField("Permissions") {
+		permissions = session.Message.Data["Permissions"]
+	}
+	switch permissions {
+	case memberRead, memberWrite, memberAdmin:
+		break
+	default:
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Permissions")
+		return
+	}
+
+	wid := getSharedWorkspace(session)
+	if wid == "" {
+		return
+	}
+
+	if !checkMemberAdmin(session, wid) {
+		return
+	}
+
+	member := resolveMember(session)
+	if member == "" {
+		return
+	}
+
+	// A workspace must always have an admin, so the last one can't be demoted
+	members, err := dbhandler.GetMembers(wid)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandAddMember: error getting members: %s", err.Error())
+		return
+	}
+	if members[member] == memberAdmin && permissions != memberAdmin && countAdmins(members) == 1 {
+		session.SendStringResponse(403, "FORBIDDEN", "Can't demote the last admin")
+		return
+	}
+
+	err = dbhandler.SetMember(wid, member, permissions)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandAddMember: error setting member: %s", err.Error())
+		return
+	}
+
+	session.SendStringResponse(200, "OK", "")
+}
+
+func commandListMembers(session *sessionState) {
+	// Command syntax:
+	// LISTMEMBERS(Workspace-ID)
+
+	wid := getSharedWorkspace(session)
+	if wid == "" {
+		return
+	}
+
+	members, err := dbhandler.GetMembers(wid)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandListMembers: error getting members: %s", err.Error())
+		return
+	}
+
+	// Any member may see who else is a member
+	if _, exists := members[session.WID]; !exists && !checkMemberAdmin(session, wid) {
+		return
+	}
+
+	memberData, err := json.Marshal(members)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandListMembers: error encoding members: %s", err.Error())
+		return
+	}
+
+	response := NewServerResponse(200, "OK")
+	response.Data["Members"] = string(memberData)
+	session.SendResponse(*response)
+}
+
+func commandRemoveMember(session *sessionState) {
+	// Command syntax:
+	// REMOVEMEMBER(Workspace-ID, Member-ID)
+
+	wid := getSharedWorkspace(session)
+	if wid == "" {
+		return
+	}
+
+	member := resolveMember(session)
+	if member == "" {
+		return
+	}
+
+	// Members may always leave on their own
+	if member != session.WID && !checkMemberAdmin(session, wid) {
+		return
+	}
+
+	members, err := dbhandler.GetMembers(wid)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandRemoveMember: error getting members: %s", err.Error())
+		return
+	}
+	if _, exists := members[member]; !exists {
+		session.SendStringResponse(404, "NOT FOUND", "")
+		return
+	}
+	if members[member] == memberAdmin && countAdmins(members) == 1 {
+		session.SendStringResponse(403, "FORBIDDEN", "Can't remove the last admin")
+		return
+	}
+
+	err = dbhandler.RemoveMember(wid, member)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("commandRemoveMember: error removing member: %s", err.Error())
+		return
+	}
+
+	session.SendStringResponse(200, "OK", "")
+}
+
+// registerShared handles REGISTER requests for shared workspaces. These are created by a logged-in
+// user, who becomes the first admin member. Shared workspaces have no password or devices of their
+// own -- members use their own workspaces to log in and then switch to the shared one's files.
+func registerShared(session *sessionState) {
+	// command syntax:
+	// REGISTER(Workspace-ID, Type="shared", User-ID="")
+
+	if session.LoginState != loginClientSession {
+		session.SendStringResponse(401, "UNAUTHORIZED", "Must be logged in for this command")
+		return
+	}
+
+	if !session.Message.HasField("Workspace-ID") {
+		session.SendStringResponse(400, "BAD REQUEST", "Missing required field")
+		return
+	}
+	wid := session.Message.Data["Workspace-ID"]
+	if !dbhandler.ValidateUUID(wid) {
+		session.SendStringResponse(400, "BAD REQUEST", "Invalid Workspace-ID")
+		return
+	}
+
+	uid := ""
+	if session.Message.HasField("User-ID") {
+		uid = session.Message.Data["User-ID"]
+		if strings.ContainsAny(uid, "/\"") {
+			session.SendStringResponse(400, "BAD REQUEST", "Bad User-ID")
+			return
+		}
+	}
+
+	regType := strings.ToLower(viper.GetString("global.registration"))
+	// When registration is private, shared workspaces are created only by those who can
+	// preregister accounts
+	if regType == "private" {
+		allowed, err := hasPermission(session.WID, permPreregister)
+		if err != nil {
+			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			logging.Writef("registerShared: error checking permission: %s", err)
+			return
+		}
+		if !allowed {
+			session.SendStringResponse(304, "REGISTRATION CLOSED", "")
+			return
+		}
+	}
+
+	success, _ := dbhandler.CheckWorkspace(wid)
+	if success {
+		response := NewServerResponse(408, "RESOURCE EXISTS")
+		response.Data["Field"] = "Workspace-ID"
+		session.SendResponse(*response)
+		return
+	}
+
+	if uid != "" {
+		success, _ = dbhandler.CheckUserID(uid)
+		if success {
+			response := NewServerResponse(408, "RESOURCE EXISTS")
+			response.Data["Field"] = "User-ID"
+			session.SendResponse(*response)
+			return
+		}
+	}
+
+	workspaceStatus := "active"
+	if regType == "moderated" {
+		workspaceStatus = "pending"
+	}
+
+	err := dbhandler.AddWorkspace(wid, uid, viper.GetString("global.domain"), "", workspaceStatus,
+		"shared")
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("Internal server error. registerShared.AddWorkspace. Error: %s\n", err)
+		return
+	}
+
+	err = dbhandler.SetMember(wid, session.WID, memberAdmin)
+	if err != nil {
+		session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+		logging.Writef("Internal server error. registerShared.SetMember. Error: %s\n", err)
+		return
+	}
+
+	if regType == "moderated" {
+		err = dbhandler.AddRegRequest(wid)
+		if err != nil {
+			session.SendStringResponse(300, "INTERNAL SERVER ERROR", "")
+			logging.Writef("Internal server error. registerShared.AddRegRequest. Error: %s\n", err)
+			return
+		}
+		session.SendStringResponse(101, "PENDING", "")
+	} else {
+		response := NewServerResponse(201, "REGISTERED")
+		response.Data["Domain"] = viper.GetString("global.domain")
+		session.SendResponse(*response)
+	}
+}
@@ -1,8 +1,11 @@
 from base64 import b85encode
+import hashlib
+import json
 import os.path
 import platform
 import re
 import secrets
+import socket
 import sys
 import time
 
@@ -64,12 +67,14 @@ import pyanselus.serverconn as serverconn
 # Initial User Primary Encryption Key: nSRso=K(WF{P+4x5S*5?Da-rseY-^>S8VN#v+)IN
 # Initial User Primary Decryption Key: 4A!nTPZSVD#tm78d=-?1OIQ43{ipSpE;@il{lYkg
 
-def load_server_config_file() -> dict:
-	'''Loads the Anselus server configuration from the config file'''
+def load_server_config_file(config_file_path='') -> dict:
+	'''Loads the Anselus server configuration from the config file. The server's usual config 
+	file is used unless another is specified.'''
 	
-	config_file_path = '/etc/anselusd/serverconfig.toml'
-	if platform.system() == 'Windows':
-		config_file_path = 'C:\\ProgramData\\anselusd\\serverconfig.toml'
+	if not config_file_path:
+		config_file_path = '/etc/anselusd/serverconfig.toml'
+		if platform.system() == 'Windows':
+			config_file_path = 'C:\\ProgramData\\anselusd\\serverconfig.toml'
 
 	if os.path.exists(config_file_path):
 		try:
@@ -110,16 +115,18 @@ def load_server_config_file() -> dict:
 	return serverconfig
 
 
-def setup_test():
-	'''Resets the Postgres test database to be ready for an integration test'''
+def setup_test(serverconfig=None):
+	'''Resets the Postgres test database to be ready for an integration test. The database of the 
+	server using the usual config file is reset unless another server config is given.'''
 	
-	serverconfig = load_server_config_file()
+	if serverconfig is None:
+		serverconfig = load_server_config_file()
 
 	# Reset the test database to defaults
 	try:
 		conn = psycopg2.connect(host=serverconfig['database']['ip'],
 								port=serverconfig['database']['port'],
-								database="anselus",
+								database=serverconfig['database']['name'],
 								user=serverconfig['database']['user'],
 								password=serverconfig['database']['password'])
 	except Exception as e:
@@ -141,7 +148,7 @@ def setup_test():
 	return conn
 
 
-def init_server(dbconn) -> dict:
+def init_server(dbconn, domain='example.com') -> dict:
 	'''Adds basic data to the database as if setupconfig had been run. Returns data needed for 
 	tests, such as the keys'''
 	
@@ -155,7 +162,7 @@ def init_server(dbconn) -> dict:
 		'Name':'Example, Inc.',
 		'Contact-Admin':'c590b44c-798d-4055-8d72-725a7942f3f6/acme.com',
 		'Language':'en',
-		'Domain':'example.com',
+		'Domain':domain,
 		'Primary-Verification-Key':'ED25519:r#r*RiXIN-0n)BzP3bv`LA&t4LFEQNF0Q@$N~RF*',
 		'Encryption-Key':'CURVE25519:SNhj2K`hgBd8>G>lW$!pXiM7S-B!Fbd9jT2&{{Az'
 	})
@@ -248,20 +255,20 @@ def init_server(dbconn) -> dict:
 	admin_wid = 'ae406c5e-2673-4d3e-af20-91325d9623ca'
 	regcode = 'Undamaged Shining Amaretto Improve Scuttle Uptake'
 	cur.execute(f"INSERT INTO prereg(wid, uid, domain, regcode) VALUES('{admin_wid}', 'admin', "
-		f"'example.com', '{regcode}');")
+		f"'{domain}', '{regcode}');")
 	
 	# Set up abuse/support forwarding to admin
 	abuse_wid = 'f8cfdbdf-62fe-4275-b490-736f5fdc82e3'
 	cur.execute("INSERT INTO workspaces(wid, uid, domain, password, status, wtype) "
-		f"VALUES('{abuse_wid}', 'abuse', 'example.com', '-', 'active', 'alias');")
+		f"VALUES('{abuse_wid}', 'abuse', '{domain}', '-', 'active', 'alias');")
 	cur.execute(f"INSERT INTO aliases(wid, alias) VALUES('{abuse_wid}', "
-		f"'{'/'.join([admin_wid, 'example.com'])}');")
+		f"'{'/'.join([admin_wid, domain])}');")
 
 	support_wid = 'f0309ef1-a155-4655-836f-55173cc1bc3b'
 	cur.execute(f"INSERT INTO workspaces(wid, uid, domain, password, status, wtype) "
-		f"VALUES('{support_wid}', 'support', 'example.com', '-', 'active', 'alias');")
+		f"VALUES('{support_wid}', 'support', '{domain}', '-', 'active', 'alias');")
 	cur.execute(f"INSERT INTO aliases(wid, alias) VALUES('{support_wid}', "
-		f"'{'/'.join([admin_wid, 'example.com'])}');")
+		f"'{'/'.join([admin_wid, domain])}');")
 	
 	cur.close()
 	dbconn.commit()	
@@ -277,7 +284,7 @@ def init_server(dbconn) -> dict:
 		'second_org_entry' : new_entry,
 		'support_wid' : support_wid,
 		'abuse_wid' : abuse_wid,
-		'org_domain' : 'example.com'
+		'org_domain' : domain
 	}
 
 
@@ -459,3 +466,74 @@ def init_user(config: dict, conn: serverconn.ServerConnection):
 	config['user_devid'] = devid
 	config['user_devpair'] = devpair
 	config['user_password'] = password
+
+
+def login_user(config: dict, conn: serverconn.ServerConnection):
+	'''Logs in as the test user created by init_user()'''
+	
+	status = serverconn.login(conn, config['user_wid'], CryptoString(config['oekey']))
+	assert not status.error(), f"login_user(): login phase failed: {status.info()}"
+
+	status = serverconn.password(conn, config['user_wid'], config['user_password'].hashstring)
+	assert not status.error(), f"login_user(): password phase failed: {status.info()}"
+
+	status = serverconn.device(conn, config['user_devid'], config['user_devpair'])
+	assert not status.error(), f"login_user(): device phase failed: {status.info()}"
+
+
+def set_quota(dbconn, wid: str, quota: int):
+	'''Sets the disk quota of a workspace in bytes and clears its usage'''
+	cur = dbconn.cursor()
+	cur.execute("DELETE FROM quotas WHERE wid=%s;", (wid,))
+	cur.execute("INSERT INTO quotas(wid, usage, quota) VALUES(%s, 0, %s);", (wid, quota))
+	cur.close()
+	dbconn.commit()
+
+
+class RawConnection:
+	'''A bare connection to the server for tests which need to send data other than requests, such 
+	as a message for SEND, or to send requests which aren't well-formed. It can be used in place of 
+	a ServerConnection with the setup functions in this module.'''
+
+	def __init__(self):
+		self.sock = None
+		self.reader = None
+		self.greeting = None
+	
+	def connect(self, host: str, port: int) -> bool:
+		'''Connects to the server and reads its greeting'''
+		try:
+			self.sock = socket.create_connection((host, port), timeout=30)
+		except Exception:
+			return False
+		self.reader = self.sock.makefile('rb')
+		self.greeting = self.read_response(None)
+		return self.greeting is not None and self.greeting['Code'] == 200
+	
+	def write(self, data: bytes):
+		'''Sends raw data to the server'''
+		self.sock.sendall(data)
+
+	def send_message(self, msg: dict):
+		'''Sends a request to the server'''
+		self.write(json.dumps(msg).encode() + b'\r\n')
+
+	def read_response(self, schema) -> dict:
+		'''Reads a response from the server. The schema is accepted for compatibility with 
+		ServerConnection and is not checked.'''
+		line = self.reader.readline()
+		if not line:
+			return None
+		return json.loads(line)
+
+	def disconnect(self):
+		'''Closes the connection'''
+		self.reader.close()
+		self.sock.close()
+
+
+def blake2b_hash(data: bytes) -> str:
+	'''Returns the BLAKE2B-256 hash of the data as a CryptoString'''
+	hasher = hashlib.blake2b(digest_size=32)
+	hasher.update(data)
+	return 'BLAKE2B-256:' + b85encode(hasher.digest()).decode()
@@ -0,0 +1,214 @@
+from pyanselus.cryptostring import CryptoString
+from pyanselus.encryption import EncryptionPair
+from pyanselus.serverconn import ServerConnection
+from integration_setup import setup_test, init_server, init_user, regcode_admin, login_admin, \
+	login_user
+
+def test_aliases():
+	'''Tests ADDALIAS, LISTALIASES, and REMOVEALIAS'''
+
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# password is 'SandstoneAgendaTricycle'
+	pwhash = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	devid = '22222222-2222-2222-2222-222222222222'
+	devpair = EncryptionPair(CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+
+	dbdata['pwhash'] = pwhash
+	dbdata['devid'] = devid
+	dbdata['devpair'] = devpair
+
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+	init_user(dbdata, conn)
+
+	conn.send_message({'Action' : "LOGOUT", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200, 'test_aliases(): failed to log admin out'
+
+	# Subtest #1: Users can add and list their own aliases
+	login_user(dbdata, conn)
+	conn.send_message({
+		'Action' : "ADDALIAS",
+		'Data' : { 'Alias' : 'chris' }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_aliases(): subtest #1: failed to add alias'
+	assert response['Data']['Address'] == 'chris/example.com', \
+		'test_aliases(): subtest #1: wrong address returned for alias'
+
+	conn.send_message({'Action' : "LISTALIASES", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Data']['Aliases'] == 'chris/example.com', \
+		'test_aliases(): subtest #1: alias not listed'
+
+	# Subtest #2: User IDs which are taken can't be used for aliases
+	conn.send_message({
+		'Action' : "ADDALIAS",
+		'Data' : { 'Alias' : 'chris' }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 408 and response['Status'] == 'RESOURCE EXISTS', \
+		'test_aliases(): subtest #2: server added a duplicate alias'
+
+	# Subtest #3: Regular users can't touch other workspaces' aliases or the built-in ones
+	conn.send_message({
+		'Action' : "LISTALIASES",
+		'Data' : { 'Workspace-ID' : dbdata['admin_wid'] }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		"test_aliases(): subtest #3: user allowed to list another workspace's aliases"
+
+	conn.send_message({
+		'Action' : "REMOVEALIAS",
+		'Data' : { 'Alias' : 'support' }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'test_aliases(): subtest #3: server removed a built-in alias'
+
+	# Subtest #4: Remove an alias
+	conn.send_message({
+		'Action' : "REMOVEALIAS",
+		'Data' : { 'Alias' : 'chris/example.com' }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_aliases(): subtest #4: failed to remove alias'
+
+	conn.send_message({'Action' : "LISTALIASES", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Data']['Aliases'] == '', \
+		'test_aliases(): subtest #4: removed alias still listed'
+
+	conn.send_message({
+		'Action' : "REMOVEALIAS",
+		'Data' : { 'Alias' : 'chris' }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 404 and response['Status'] == 'NOT FOUND', \
+		'test_aliases(): subtest #4: server removed a nonexistent alias'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+def test_aliases_removed_with_workspace():
+	'''Tests that a workspace's aliases go away when the workspace is unregistered'''
+
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# password is 'SandstoneAgendaTricycle'
+	dbdata['pwhash'] = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	dbdata['devid'] = '22222222-2222-2222-2222-222222222222'
+	dbdata['devpair'] = EncryptionPair(
+		CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+	init_user(dbdata, conn)
+
+	# Administrators can manage aliases for other workspaces
+	conn.send_message({
+		'Action' : "ADDALIAS",
+		'Data' : {
+			'Alias' : 'chris',
+			'Workspace-ID' : dbdata['user_wid']
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_aliases_removed_with_workspace(): failed to add alias for user'
+	alias_wid = response['Data']['Workspace-ID']
+
+	conn.send_message({
+		'Action' : "UNREGISTER",
+		'Data' : {
+			'Password-Hash' : dbdata['pwhash'],
+			'Workspace-ID' : dbdata['user_wid']
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 202 and response['Status'] == 'UNREGISTERED', \
+		'test_aliases_removed_with_workspace(): failed to unregister user'
+
+	dbconn.commit()
+	cur = dbconn.cursor()
+	cur.execute("SELECT COUNT(*) FROM aliases WHERE wid=%s;", (alias_wid,))
+	assert cur.fetchone()[0] == 0, \
+		'test_aliases_removed_with_workspace(): alias left pointing to removed workspace'
+	cur.execute("SELECT COUNT(*) FROM workspaces WHERE wid=%s;", (alias_wid,))
+	assert cur.fetchone()[0] == 0, \
+		'test_aliases_removed_with_workspace(): alias workspace left behind'
+	cur.close()
+
+	# The alias's user ID can be used again afterward
+	conn.send_message({
+		'Action' : "ADDALIAS",
+		'Data' : { 'Alias' : 'chris' }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		"test_aliases_removed_with_workspace(): removed alias's user ID not freed"
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+def test_unregister_builtin():
+	'''Tests that the built-in support and abuse accounts can't be unregistered, whether or not 
+	they are forwarded to the administrator'''
+
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# password is 'SandstoneAgendaTricycle'
+	dbdata['pwhash'] = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	dbdata['devid'] = '22222222-2222-2222-2222-222222222222'
+	dbdata['devpair'] = EncryptionPair(
+		CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+
+	# setupconfig makes support a regular workspace when it isn't forwarded to the administrator
+	cur = dbconn.cursor()
+	cur.execute("DELETE FROM aliases WHERE wid=%s;", (dbdata['support_wid'],))
+	cur.execute("UPDATE workspaces SET wtype='individual' WHERE wid=%s;",
+		(dbdata['support_wid'],))
+	cur.close()
+	dbconn.commit()
+
+	for name in ['support', 'abuse']:
+		conn.send_message({
+			'Action' : "UNREGISTER",
+			'Data' : {
+				'Password-Hash' : dbdata['pwhash'],
+				'Workspace-ID' : dbdata[name + '_wid']
+			}
+		})
+		response = conn.read_response(None)
+		assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+			f'test_unregister_builtin(): server unregistered the {name} account'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+if __name__ == '__main__':
+	test_aliases()
+	test_aliases_removed_with_workspace()
+	test_unregister_builtin()
@@ -0,0 +1,298 @@
+import json
+import os.path
+import time
+
+from pyanselus.cryptostring import CryptoString
+from pyanselus.encryption import EncryptionPair
+from integration_setup import load_server_config_file, setup_test, init_server, regcode_admin, \
+	login_admin, set_quota, RawConnection, blake2b_hash
+
+# These tests need two servers running on localhost. The one for example.com is the usual test
+# server on port 2001, using the settings in serverconfig_example_com.toml, and the one for
+# example.net runs on port 2002 using serverconfig_example_net.toml.
+
+# The directory in each workspace which receives delivered messages
+inbox_dir = '3d1f3a5c-7b38-4ab3-a8c1-58a5c1d0e9d2'
+
+def setup_servers():
+	'''Resets both servers and registers and logs in the administrator on each. Returns the
+	database connections, server data, and client connections for example.com and example.net'''
+
+	remote_config_path = os.path.join(os.path.dirname(os.path.abspath(__file__)),
+		'serverconfig_example_net.toml')
+	remote_config = load_server_config_file(remote_config_path)
+
+	out = list()
+	for config, domain, port in [(None, 'example.com', 2001),
+			(remote_config, 'example.net', 2002)]:
+		dbconn = setup_test(config)
+		dbdata = init_server(dbconn, domain)
+
+		conn = RawConnection()
+		assert conn.connect('localhost', port), f"Connection to server at localhost:{port} failed"
+
+		# password is 'SandstoneAgendaTricycle'
+		dbdata['pwhash'] = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+					'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+		dbdata['devid'] = '22222222-2222-2222-2222-222222222222'
+		dbdata['devpair'] = EncryptionPair(
+			CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+			CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+
+		regcode_admin(dbdata, conn)
+		login_admin(dbdata, conn)
+		out.append((dbconn, dbdata, conn))
+
+	return out
+
+
+def test_deliver_remote():
+	'''Tests delivery of a message with SEND to a recipient on another server'''
+
+	local, remote = setup_servers()
+	local_db, _, local_conn = local
+	_, remote_data, remote_conn = remote
+
+	message = b'This is a sealed message. Honest.'
+	recipient = '/'.join([remote_data['admin_wid'], 'example.net'])
+
+	local_conn.send_message({
+		'Action': 'SEND',
+		'Data': {
+			'Size': str(len(message)),
+			'Hash': blake2b_hash(message),
+			'Recipients': recipient
+		}
+	})
+	response = local_conn.read_response(None)
+	assert response['Code'] == 100 and response['Status'] == 'CONTINUE', \
+		'test_deliver_remote(): server refused to accept message'
+
+	local_conn.write(message)
+	response = local_conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_deliver_remote(): SEND failed'
+	assert json.loads(response['Data']['Results']) == { recipient: 'QUEUED' }, \
+		'test_deliver_remote(): message for remote recipient was not queued'
+
+	# The delivery worker is woken up when the message is queued, so it should be handed off
+	# almost immediately
+	cur = local_db.cursor()
+	for _ in range(30):
+		local_db.commit()
+		cur.execute("SELECT COUNT(*) FROM deliveryqueue;")
+		if cur.fetchone()[0] == 0:
+			break
+		time.sleep(1)
+	else:
+		assert False, 'test_deliver_remote(): message was never delivered'
+
+	# The remote organization's keycard is pinned on first contact
+	cur.execute("SELECT roothash FROM remoteorgs WHERE domain='example.net';")
+	row = cur.fetchone()
+	assert row and row[0] == remote_data['root_org_entry'].hash, \
+		"test_deliver_remote(): remote organization's root entry was not saved"
+	cur.close()
+
+	remote_conn.send_message({
+		'Action': 'LIST',
+		'Data': { 'Path': ' '.join(['/', remote_data['admin_wid'], inbox_dir]) }
+	})
+	response = remote_conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_deliver_remote(): failed to list recipient inbox'
+	assert len(response['Data']['Files'].split(',')) == 1 and response['Data']['Files'], \
+		'test_deliver_remote(): message not found in recipient inbox'
+
+	local_conn.send_message({'Action' : "QUIT"})
+	remote_conn.send_message({'Action' : "QUIT"})
+
+
+def test_deliver_wrong_sender():
+	'''Tests that DELIVER is refused from a connection which doesn't come from the server for the
+	sending domain'''
+
+	_, remote = setup_servers()
+	_, remote_data, remote_conn = remote
+
+	message = b'This is a sealed message. Honest.'
+	recipient = '/'.join([remote_data['admin_wid'], 'example.net'])
+
+	# The test client connects from 127.0.0.1, which isn't used by the server for example.org
+	conn = RawConnection()
+	assert conn.connect('localhost', 2002), "Connection to server at localhost:2002 failed"
+	conn.send_message({
+		'Action': 'DELIVER',
+		'Data': {
+			'Size': str(len(message)),
+			'Hash': blake2b_hash(message),
+			'Recipients': recipient,
+			'Sender-Domain': 'example.org'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'test_deliver_wrong_sender(): server accepted delivery from the wrong address'
+
+	# Messages for the server's own domain can't be handed off this way, either
+	conn.send_message({
+		'Action': 'DELIVER',
+		'Data': {
+			'Size': str(len(message)),
+			'Hash': blake2b_hash(message),
+			'Recipients': recipient,
+			'Sender-Domain': 'example.net'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'test_deliver_wrong_sender(): server accepted delivery claiming to be from itself'
+
+	conn.send_message({'Action' : "QUIT"})
+	remote_conn.send_message({'Action' : "QUIT"})
+
+
+def test_deliver_changed_orgcard():
+	'''Tests that messages aren't delivered to a server whose keycard doesn't start with the root
+	entry saved for its domain'''
+
+	local, remote = setup_servers()
+	local_db, _, local_conn = local
+	_, remote_data, remote_conn = remote
+
+	cur = local_db.cursor()
+	cur.execute("INSERT INTO remoteorgs(domain, roothash, firstseen) VALUES('example.net', "
+		"'BLAKE2B-256:tSl@QzD1w-vNq@CC-5`($KuxO0#aOl^-cy(l7XXT', NOW());")
+	local_db.commit()
+
+	message = b'This is a sealed message. Honest.'
+	recipient = '/'.join([remote_data['admin_wid'], 'example.net'])
+	local_conn.send_message({
+		'Action': 'SEND',
+		'Data': {
+			'Size': str(len(message)),
+			'Hash': blake2b_hash(message),
+			'Recipients': recipient
+		}
+	})
+	response = local_conn.read_response(None)
+	assert response['Code'] == 100 and response['Status'] == 'CONTINUE', \
+		'test_deliver_changed_orgcard(): server refused to accept message'
+
+	local_conn.write(message)
+	response = local_conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_deliver_changed_orgcard(): SEND failed'
+
+	# The attempt fails and the message stays in the queue for another try
+	for _ in range(30):
+		local_db.commit()
+		cur.execute("SELECT attempts, lasterror FROM deliveryqueue;")
+		row = cur.fetchone()
+		if row and row[0] > 0:
+			break
+		time.sleep(1)
+	else:
+		assert False, 'test_deliver_changed_orgcard(): delivery was never attempted'
+	assert 'root entry' in row[1], \
+		'test_deliver_changed_orgcard(): delivery failed for the wrong reason'
+	cur.close()
+
+	local_conn.send_message({'Action' : "QUIT"})
+	remote_conn.send_message({'Action' : "QUIT"})
+
+
+def test_send_limits():
+	'''Tests that SEND refuses messages which are too large or don't fit in the sender's quota
+	before accepting any of the message'''
+
+	local, _ = setup_servers()
+	local_db, local_data, local_conn = local
+
+	message = b'This is a sealed message. Honest.'
+	recipient = '/'.join([local_data['admin_wid'], 'example.com'])
+
+	# Subtest #1: The default limit is 32 MiB
+	local_conn.send_message({
+		'Action': 'SEND',
+		'Data': {
+			'Size': str(33 * 1048576),
+			'Hash': blake2b_hash(message),
+			'Recipients': recipient
+		}
+	})
+	response = local_conn.read_response(None)
+	assert response['Code'] == 414 and response['Status'] == 'LIMIT REACHED' and \
+		response['Data']['Max-Size'] == str(32 * 1048576), \
+		'test_send_limits(): subtest #1: server accepted a message over the size limit'
+
+	# Subtest #2: The message has to fit in the sender's quota
+	set_quota(local_db, local_data['admin_wid'], 16)
+	local_conn.send_message({
+		'Action': 'SEND',
+		'Data': {
+			'Size': str(len(message)),
+			'Hash': blake2b_hash(message),
+			'Recipients': recipient
+		}
+	})
+	response = local_conn.read_response(None)
+	assert response['Code'] == 409 and response['Status'] == 'QUOTA INSUFFICIENT', \
+		"test_send_limits(): subtest #2: server accepted a message over the sender's quota"
+
+	local_conn.send_message({'Action' : "QUIT"})
+
+
+def test_deliver_limits():
+	'''Tests that DELIVER refuses messages which are too large or which none of the recipients
+	have room for before accepting any of the message'''
+
+	_, remote = setup_servers()
+	remote_db, remote_data, remote_conn = remote
+
+	message = b'This is a sealed message. Honest.'
+	recipient = '/'.join([remote_data['admin_wid'], 'example.net'])
+
+	# The test client connects from the same address as the server for example.com
+	conn = RawConnection()
+	assert conn.connect('localhost', 2002), "Connection to server at localhost:2002 failed"
+
+	# Subtest #1: The default limit is 32 MiB
+	conn.send_message({
+		'Action': 'DELIVER',
+		'Data': {
+			'Size': str(33 * 1048576),
+			'Hash': blake2b_hash(message),
+			'Recipients': recipient,
+			'Sender-Domain': 'example.com'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 414 and response['Status'] == 'LIMIT REACHED', \
+		'test_deliver_limits(): subtest #1: server accepted a message over the size limit'
+
+	# Subtest #2: Recipients without room are refused
+	set_quota(remote_db, remote_data['admin_wid'], 16)
+	conn.send_message({
+		'Action': 'DELIVER',
+		'Data': {
+			'Size': str(len(message)),
+			'Hash': blake2b_hash(message),
+			'Recipients': recipient,
+			'Sender-Domain': 'example.com'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 409 and response['Status'] == 'QUOTA INSUFFICIENT', \
+		"test_deliver_limits(): subtest #2: server accepted a message over the recipient's quota"
+
+	conn.send_message({'Action' : "QUIT"})
+	remote_conn.send_message({'Action' : "QUIT"})
+
+
+if __name__ == '__main__':
+	test_deliver_remote()
+	test_deliver_wrong_sender()
+	test_deliver_changed_orgcard()
+	test_send_limits()
+	test_deliver_limits()
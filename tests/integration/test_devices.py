@@ -0,0 +1,241 @@
+import json
+
+from pyanselus.cryptostring import CryptoString
+from pyanselus.encryption import EncryptionPair
+import pyanselus.serverconn as serverconn
+from integration_setup import setup_test, init_server, init_user, regcode_admin, login_admin, \
+	login_user
+
+def setup_user() -> dict:
+	'''Resets the server and creates the test user. Returns the server data with the test user's
+	information added.'''
+
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+	conn = serverconn.ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# password is 'SandstoneAgendaTricycle'
+	dbdata['pwhash'] = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	dbdata['devid'] = '22222222-2222-2222-2222-222222222222'
+	dbdata['devpair'] = EncryptionPair(
+		CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+	init_user(dbdata, conn)
+	conn.send_message({'Action' : "QUIT"})
+
+	return dbdata
+
+
+def request_device(dbdata: dict, devid: str, devpair: EncryptionPair):
+	'''Attempts to log in as the test user with a device which hasn't been approved. The server
+	ends the session afterward.'''
+
+	conn = serverconn.ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	status = serverconn.login(conn, dbdata['user_wid'], CryptoString(dbdata['oekey']))
+	assert not status.error(), f"request_device(): login phase failed: {status.info()}"
+
+	status = serverconn.password(conn, dbdata['user_wid'], dbdata['user_password'].hashstring)
+	assert not status.error(), f"request_device(): password phase failed: {status.info()}"
+
+	conn.send_message({
+		'Action' : "DEVICE",
+		'Data' : {
+			'Device-ID' : devid,
+			'Device-Key' : devpair.public.as_string()
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 101 and response['Status'] == 'PENDING', \
+		'request_device(): server did not hold new device for approval'
+
+
+def test_device_approval():
+	'''Tests that a new device must be approved with DEVAPPROVE before it can be used and that
+	DEVDENY turns one away'''
+
+	dbdata = setup_user()
+	conn = serverconn.ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+	login_user(dbdata, conn)
+
+	# Subtest #1: A new device is held for approval and can log in once approved
+	newdevid = '55555555-5555-5555-5555-555555555555'
+	newdevpair = EncryptionPair()
+	request_device(dbdata, newdevid, newdevpair)
+
+	conn.send_message({
+		'Action' : "DEVAPPROVE",
+		'Data' : { 'Device-ID' : newdevid }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_device_approval(): subtest #1: failed to approve device'
+
+	newconn = serverconn.ServerConnection()
+	assert newconn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+	login_user(dict(dbdata, user_devid=newdevid, user_devpair=newdevpair), newconn)
+	newconn.send_message({'Action' : "QUIT"})
+
+	# Subtest #2: A denied device is removed and can't be approved afterward
+	otherdevid = '66666666-6666-6666-6666-666666666666'
+	request_device(dbdata, otherdevid, EncryptionPair())
+
+	conn.send_message({
+		'Action' : "DEVDENY",
+		'Data' : { 'Device-ID' : otherdevid }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_device_approval(): subtest #2: failed to deny device'
+
+	conn.send_message({
+		'Action' : "DEVAPPROVE",
+		'Data' : { 'Device-ID' : otherdevid }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 404 and response['Status'] == 'NOT FOUND', \
+		'test_device_approval(): subtest #2: server approved a denied device'
+
+	# Subtest #3: A device can't take over the ID of another with a different key, and there is
+	# no request to approve or deny afterward
+	otherconn = serverconn.ServerConnection()
+	assert otherconn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+	status = serverconn.login(otherconn, dbdata['user_wid'], CryptoString(dbdata['oekey']))
+	assert not status.error(), f"test_device_approval(): login phase failed: {status.info()}"
+	status = serverconn.password(otherconn, dbdata['user_wid'],
+		dbdata['user_password'].hashstring)
+	assert not status.error(), f"test_device_approval(): password phase failed: {status.info()}"
+
+	otherconn.send_message({
+		'Action' : "DEVICE",
+		'Data' : {
+			'Device-ID' : newdevid,
+			'Device-Key' : EncryptionPair().public.as_string()
+		}
+	})
+	response = otherconn.read_response(None)
+	assert response['Code'] == 401 and response['Status'] == 'UNAUTHORIZED', \
+		"test_device_approval(): subtest #3: server accepted another device's ID"
+	otherconn.send_message({'Action' : "QUIT"})
+
+	conn.send_message({
+		'Action' : "DEVDENY",
+		'Data' : { 'Device-ID' : newdevid }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 404 and response['Status'] == 'NOT FOUND', \
+		'test_device_approval(): subtest #3: server denied an active device'
+
+	newconn = serverconn.ServerConnection()
+	assert newconn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+	login_user(dict(dbdata, user_devid=newdevid, user_devpair=newdevpair), newconn)
+	newconn.send_message({'Action' : "QUIT"})
+
+	conn.send_message({'Action' : "LOGOUT", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200, 'test_device_approval(): failed to log out'
+
+	# Subtest #4: Approval requires a login
+	conn.send_message({
+		'Action' : "DEVAPPROVE",
+		'Data' : { 'Device-ID' : newdevid }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 401 and response['Status'] == 'UNAUTHORIZED', \
+		'test_device_approval(): subtest #4: server allowed approval without a login'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+def test_device_management():
+	'''Tests DEVLIST, DEVRENAME, and DEVREVOKE'''
+
+	dbdata = setup_user()
+	conn = serverconn.ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+	login_user(dbdata, conn)
+
+	# Subtest #1: The last active device can't be revoked
+	conn.send_message({
+		'Action' : "DEVREVOKE",
+		'Data' : { 'Device-ID' : dbdata['user_devid'] }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'test_device_management(): subtest #1: server revoked the last active device'
+
+	# Subtest #2: Rename a device and list the workspace's devices
+	newdevid = '55555555-5555-5555-5555-555555555555'
+	request_device(dbdata, newdevid, EncryptionPair())
+
+	conn.send_message({
+		'Action' : "DEVRENAME",
+		'Data' : {
+			'Device-ID' : dbdata['user_devid'],
+			'Name' : 'Laptop'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_device_management(): subtest #2: failed to rename device'
+
+	conn.send_message({'Action' : "DEVLIST", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_device_management(): subtest #2: failed to list devices'
+	devices = { item['Device-ID']: item for item in json.loads(response['Data']['Devices']) }
+	assert len(devices) == 2, 'test_device_management(): subtest #2: wrong number of devices'
+	assert devices[dbdata['user_devid']]['Name'] == 'Laptop' and \
+		devices[dbdata['user_devid']]['Status'] == 'active' and \
+		devices[dbdata['user_devid']]['Last-Seen'], \
+		'test_device_management(): subtest #2: bad information for device in use'
+	assert devices[newdevid]['Status'] == 'pending', \
+		'test_device_management(): subtest #2: bad information for pending device'
+
+	# Subtest #3: Renaming or revoking a device the workspace doesn't have fails
+	conn.send_message({
+		'Action' : "DEVRENAME",
+		'Data' : {
+			'Device-ID' : '77777777-7777-7777-7777-777777777777',
+			'Name' : 'Phone'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 404 and response['Status'] == 'NOT FOUND', \
+		'test_device_management(): subtest #3: server renamed a nonexistent device'
+
+	conn.send_message({
+		'Action' : "DEVREVOKE",
+		'Data' : { 'Device-ID' : '77777777-7777-7777-7777-777777777777' }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 404 and response['Status'] == 'NOT FOUND', \
+		'test_device_management(): subtest #3: server revoked a nonexistent device'
+
+	# Subtest #4: Revoke a pending device
+	conn.send_message({
+		'Action' : "DEVREVOKE",
+		'Data' : { 'Device-ID' : newdevid }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_device_management(): subtest #4: failed to revoke device'
+
+	conn.send_message({'Action' : "DEVLIST", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and len(json.loads(response['Data']['Devices'])) == 1, \
+		'test_device_management(): subtest #4: revoked device still listed'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+if __name__ == '__main__':
+	test_device_approval()
+	test_device_management()
@@ -0,0 +1,309 @@
+import uuid
+
+from pyanselus.cryptostring import CryptoString
+from pyanselus.encryption import EncryptionPair
+from integration_setup import setup_test, init_server, regcode_admin, login_admin, set_quota, \
+	RawConnection, blake2b_hash
+
+def setup_fs_test() -> tuple:
+	'''Resets the server, registers and logs in the administrator, and selects a new directory in
+	the admin's workspace. Returns the database connection, server data, and client connection.
+	The path of the directory is saved in the server data as 'testdir'.'''
+
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+
+	conn = RawConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# password is 'SandstoneAgendaTricycle'
+	dbdata['pwhash'] = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	dbdata['devid'] = '22222222-2222-2222-2222-222222222222'
+	dbdata['devpair'] = EncryptionPair(
+		CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+
+	# Workspace files aren't removed by setup_test(), so each test gets a directory of its own
+	dbdata['testdir'] = ' '.join(['/', dbdata['admin_wid'], str(uuid.uuid4())])
+	conn.send_message({
+		'Action': 'MKDIR',
+		'Data': { 'Path': dbdata['testdir'] }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'setup_fs_test(): failed to create test directory'
+
+	select_dir(conn, dbdata['testdir'])
+	return dbconn, dbdata, conn
+
+
+def select_dir(conn, path: str):
+	'''Makes the directory the current one for the session'''
+	conn.send_message({
+		'Action': 'SELECT',
+		'Data': { 'Path': path }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'select_dir(): failed to select directory'
+
+
+def upload_file(conn, data: bytes) -> str:
+	'''Uploads a file into the current directory in one go and returns its name'''
+	conn.send_message({
+		'Action': 'UPLOAD',
+		'Data': {
+			'Size': str(len(data)),
+			'Hash': blake2b_hash(data)
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 100 and response['Status'] == 'CONTINUE', \
+		'upload_file(): server refused the upload'
+
+	conn.write(data)
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'upload_file(): upload failed'
+	return response['Data']['FileName']
+
+
+def test_upload_resume():
+	'''Tests resuming an UPLOAD which was cut off part of the way through'''
+
+	_, dbdata, conn = setup_fs_test()
+
+	filedata = b'0123456789' * 100
+	filehash = blake2b_hash(filedata)
+
+	# Subtest #1: Start the upload and drop the connection halfway through
+	conn.send_message({
+		'Action': 'UPLOAD',
+		'Data': {
+			'Size': str(len(filedata)),
+			'Hash': filehash
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 100 and response['Status'] == 'CONTINUE', \
+		'test_upload_resume(): subtest #1: server refused the upload'
+	assert response['Data']['Offset'] == '0' and response['Data']['Name'], \
+		'test_upload_resume(): subtest #1: server returned bad transfer information'
+	tempname = response['Data']['Name']
+
+	conn.write(filedata[:500])
+	conn.disconnect()
+
+	# Subtest #2: Name and Offset are required together
+	conn = RawConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+	login_admin(dbdata, conn)
+	select_dir(conn, dbdata['testdir'])
+
+	conn.send_message({
+		'Action': 'UPLOAD',
+		'Data': {
+			'Size': str(len(filedata)),
+			'Hash': filehash,
+			'Name': tempname
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 400 and response['Status'] == 'BAD REQUEST', \
+		'test_upload_resume(): subtest #2: server accepted a resume without an offset'
+
+	# Subtest #3: An offset past the end of the file is refused
+	conn.send_message({
+		'Action': 'UPLOAD',
+		'Data': {
+			'Size': str(len(filedata)),
+			'Hash': filehash,
+			'Name': tempname,
+			'Offset': str(len(filedata) + 1)
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 400 and response['Status'] == 'BAD REQUEST', \
+		'test_upload_resume(): subtest #3: server accepted a bad offset'
+
+	# Subtest #4: Resume from where the first connection left off
+	conn.send_message({
+		'Action': 'UPLOAD',
+		'Data': {
+			'Size': str(len(filedata)),
+			'Hash': filehash,
+			'Name': tempname,
+			'Offset': '500'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 100 and response['Status'] == 'CONTINUE', \
+		'test_upload_resume(): subtest #4: server refused to resume the upload'
+	assert response['Data']['Name'] == tempname and response['Data']['Offset'] == '500', \
+		'test_upload_resume(): subtest #4: server returned bad transfer information'
+
+	conn.write(filedata[500:])
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_upload_resume(): subtest #4: resumed upload failed'
+	assert response['Data']['FileName'], \
+		'test_upload_resume(): subtest #4: server did not return the name of the file'
+
+	# Subtest #5: The temp file is gone once it has been installed
+	conn.send_message({
+		'Action': 'UPLOAD',
+		'Data': {
+			'Size': str(len(filedata)),
+			'Hash': filehash,
+			'Name': tempname,
+			'Offset': '500'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] != 100, \
+		'test_upload_resume(): subtest #5: server resumed an upload which had finished'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+def test_download():
+	'''Tests the DOWNLOAD handshake, including resuming from an offset'''
+
+	_, dbdata, conn = setup_fs_test()
+
+	filedata = b'0123456789' * 100
+	filepath = ' '.join([dbdata['testdir'], upload_file(conn, filedata)])
+
+	# Subtest #1: Download the whole file
+	conn.send_message({
+		'Action': 'DOWNLOAD',
+		'Data': { 'Path': filepath }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 104 and response['Status'] == 'TRANSFER', \
+		'test_download(): subtest #1: server refused the download'
+	assert response['Data']['Total-Size'] == str(len(filedata)) and \
+		response['Data']['Offset'] == '0' and \
+		response['Data']['Remaining-Size'] == str(len(filedata)), \
+		'test_download(): subtest #1: server returned bad transfer information'
+
+	conn.send_message({'Action': 'TRANSFER', 'Data': {}})
+	assert conn.reader.read(len(filedata)) == filedata, \
+		'test_download(): subtest #1: downloaded data did not match the file'
+
+	# Subtest #2: Resume from partway through. Total-Size is still the size of the whole file.
+	conn.send_message({
+		'Action': 'DOWNLOAD',
+		'Data': {
+			'Path': filepath,
+			'Offset': '600'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 104 and response['Status'] == 'TRANSFER', \
+		'test_download(): subtest #2: server refused to resume the download'
+	assert response['Data']['Total-Size'] == str(len(filedata)) and \
+		response['Data']['Offset'] == '600' and \
+		response['Data']['Remaining-Size'] == str(len(filedata) - 600), \
+		'test_download(): subtest #2: server returned bad transfer information'
+
+	conn.send_message({'Action': 'TRANSFER', 'Data': {}})
+	assert conn.reader.read(len(filedata) - 600) == filedata[600:], \
+		'test_download(): subtest #2: downloaded data did not match the rest of the file'
+
+	# Subtest #3: An offset past the end of the file is refused
+	conn.send_message({
+		'Action': 'DOWNLOAD',
+		'Data': {
+			'Path': filepath,
+			'Offset': str(len(filedata) + 1)
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 400 and response['Status'] == 'BAD REQUEST', \
+		'test_download(): subtest #3: server accepted a bad offset'
+
+	# Subtest #4: The client can back out after the handshake and carry on with the session
+	conn.send_message({
+		'Action': 'DOWNLOAD',
+		'Data': { 'Path': filepath }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 104 and response['Status'] == 'TRANSFER', \
+		'test_download(): subtest #4: server refused the download'
+
+	conn.send_message({'Action': 'CANCEL', 'Data': {}})
+	select_dir(conn, dbdata['testdir'])
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+def test_quota():
+	'''Tests that filesystem commands which add to a workspace are refused with 409 once they
+	would take it over its quota'''
+
+	dbconn, dbdata, conn = setup_fs_test()
+
+	filedata = b'0123456789' * 100
+	set_quota(dbconn, dbdata['admin_wid'], 1500)
+
+	# Subtest #1: Files which fit are counted against the quota
+	filename = upload_file(conn, filedata)
+	filepath = ' '.join([dbdata['testdir'], filename])
+
+	cur = dbconn.cursor()
+	cur.execute("SELECT usage FROM quotas WHERE wid=%s;", (dbdata['admin_wid'],))
+	row = cur.fetchone()
+	cur.close()
+	assert row and row[0] == len(filedata), \
+		'test_quota(): subtest #1: upload was not counted against the quota'
+
+	# Subtest #2: An upload which doesn't fit is refused before any data is sent
+	conn.send_message({
+		'Action': 'UPLOAD',
+		'Data': {
+			'Size': str(len(filedata)),
+			'Hash': blake2b_hash(filedata)
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 409 and response['Status'] == 'QUOTA INSUFFICIENT', \
+		'test_quota(): subtest #2: server accepted an upload over the quota'
+	assert response['Data']['Quota'] == '1500' and \
+		response['Data']['Usage'] == str(len(filedata)), \
+		'test_quota(): subtest #2: server returned bad quota information'
+
+	# Subtest #3: Copies count, too
+	conn.send_message({
+		'Action': 'COPY',
+		'Data': {
+			'SourceFile': filepath,
+			'DestDir': dbdata['testdir']
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 409 and response['Status'] == 'QUOTA INSUFFICIENT', \
+		'test_quota(): subtest #3: server made a copy over the quota'
+
+	# Subtest #4: Deleting a file frees up its space
+	conn.send_message({
+		'Action': 'DELETE',
+		'Data': { 'Path': filepath }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_quota(): subtest #4: failed to delete file'
+
+	upload_file(conn, filedata)
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+if __name__ == '__main__':
+	test_upload_resume()
+	test_download()
+	test_quota()
@@ -1,8 +1,14 @@
+from base64 import b85encode
+import json
+import secrets
+
 from pyanselus.cryptostring import CryptoString
-from pyanselus.encryption import EncryptionPair
+from pyanselus.encryption import EncryptionPair, PublicKey, SigningPair
 import pyanselus.keycard as keycard
+import pyanselus.serverconn as serverconn
 from pyanselus.serverconn import ServerConnection
-from integration_setup import setup_test, init_server, regcode_admin, login_admin
+from integration_setup import setup_test, init_server, init_user, regcode_admin, login_admin, \
+	login_user
 
 # Keys used in the various tests. 
 # THESE KEYS ARE STORED ON GITHUB! DO NOT USE THESE FOR ANYTHING EXCEPT UNIT TESTS!!
@@ -297,6 +303,17 @@ def test_addentry_usercard():
 		second_user_entry.make_bytestring(-1).decode(), \
 		"test_orgcard.usercard: entry didn't match"
 
+	# An entry whose index is already in use means the keycard changed after the entry was
+	# chained, so the client is told to chain from the current entry and try again
+	conn.send_message({
+		'Action' : "ADDENTRY",
+		'Data' : { 'Base-Entry' : second_user_entry.make_bytestring(1).decode() }
+	})
+
+	response = conn.read_response(server_response)
+	assert response['Code'] == 408 and response['Status'] == 'RESOURCE EXISTS', \
+		'test_addentry(): server accepted an entry with a duplicate index'
+
 	conn.send_message({'Action' : "QUIT"})
 
 def test_iscurrent():
@@ -327,7 +344,287 @@ def test_iscurrent():
 		response['Data']['Is-Current'] == 'YES', 'test_iscurrent: org success check failed'
 
 
+def test_listexpiring():
+	'''Tests the LISTEXPIRING command'''
+
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# password is 'SandstoneAgendaTricycle'
+	dbdata['pwhash'] = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	dbdata['devid'] = '22222222-2222-2222-2222-222222222222'
+	dbdata['devpair'] = EncryptionPair(
+		CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+	init_user(dbdata, conn)
+
+	# Subtest #1: The organization's current entry expires in a year, so it is only listed when
+	# looking far enough ahead
+	conn.send_message({
+		'Action' : "LISTEXPIRING",
+		'Data' : { 'Days' : '1095' }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_listexpiring: subtest #1: failed to list expiring entries'
+	entries = json.loads(response['Data']['Entries'])
+	assert len(entries) == 1 and entries[0]['Owner'] == 'organization' and \
+		entries[0]['Index'] == '2' and entries[0]['Status'] == 'expiring', \
+		'test_listexpiring: subtest #1: wrong entries listed'
+
+	conn.send_message({
+		'Action' : "LISTEXPIRING",
+		'Data' : { 'Days' : '0' }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and json.loads(response['Data']['Entries']) == [], \
+		'test_listexpiring: subtest #1: entries listed which are not expiring'
+
+	# Subtest #2: Bad number of days
+	conn.send_message({
+		'Action' : "LISTEXPIRING",
+		'Data' : { 'Days' : '-1' }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 400 and response['Status'] == 'BAD REQUEST', \
+		'test_listexpiring: subtest #2: server accepted a bad number of days'
+
+	conn.send_message({'Action' : "LOGOUT", 'Data' : {}})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200, 'test_listexpiring: failed to log admin out'
+
+	# Subtest #3: Regular users can't see who else's keycards are expiring
+	login_user(dbdata, conn)
+	conn.send_message({'Action' : "LISTEXPIRING", 'Data' : {}})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'test_listexpiring: subtest #3: server allowed a regular user to list expiring entries'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+def test_revokeentry():
+	'''Tests that only keycard managers can add revocations, which let the next entry skip the 
+	custody signature'''
+
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# password is 'SandstoneAgendaTricycle'
+	dbdata['pwhash'] = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	dbdata['devid'] = '22222222-2222-2222-2222-222222222222'
+	dbdata['devpair'] = EncryptionPair(
+		CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+	init_user(dbdata, conn)
+
+	conn.send_message({'Action' : "LOGOUT", 'Data' : {}})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200, 'test_revokeentry: failed to log admin out'
+
+	# The user starts a keycard
+	login_user(dbdata, conn)
+	rootentry = keycard.UserEntry()
+	rootentry.set_fields({
+		'Name':'Corbin Simons',
+		'Workspace-ID':dbdata['user_wid'],
+		'User-ID':dbdata['user_uid'],
+		'Domain':dbdata['user_domain'],
+		'Contact-Request-Verification-Key':'ED25519:d0-oQb;{QxwnO{=!|^62+E=UYk2Y3mr2?XKScF4D',
+		'Contact-Request-Encryption-Key':'CURVE25519:yBZ0{1fE9{2<b~#i^R+JT-yh-y5M(Wyw_)}_SZOn',
+		'Public-Encryption-Key':'CURVE25519:_`UC|vltn_%P5}~vwV^)oY){#uvQSSy(dOD_l(yE'
+	})
+	crspair = SigningPair(
+		CryptoString('ED25519:d0-oQb;{QxwnO{=!|^62+E=UYk2Y3mr2?XKScF4D'),
+		CryptoString('ED25519:ip52{ps^jH)t$k-9bc_RzkegpIW?}FFe~BX&<V}9'))
+	status = serverconn.addentry(conn, rootentry, CryptoString(dbdata['ovkey']), crspair)
+	assert not status.error(), f"test_revokeentry: failed to add user's root entry: {status.info()}"
+
+	# Subtest #1: Users can't revoke their own keycards. Anyone who had the user's password and a
+	# device could otherwise replace the user's keys.
+	conn.send_message({
+		'Action' : "REVOKEENTRY",
+		'Data' : { 'Workspace-ID' : dbdata['user_wid'] }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'test_revokeentry: subtest #1: server allowed a user to revoke their own keycard'
+
+	# Subtest #2: Without a revocation, an entry which isn't signed with the current entry's key
+	# is refused
+	newcrspair = SigningPair()
+	newentry = keycard.UserEntry()
+	newentry.set_fields({
+		'Name':'Corbin Simons',
+		'Workspace-ID':dbdata['user_wid'],
+		'User-ID':dbdata['user_uid'],
+		'Domain':dbdata['user_domain'],
+		'Index':'2',
+		'Contact-Request-Verification-Key':newcrspair.get_public_key(),
+		'Contact-Request-Encryption-Key':EncryptionPair().get_public_key(),
+		'Public-Encryption-Key':EncryptionPair().get_public_key()
+	})
+	conn.send_message({
+		'Action' : "ADDENTRY",
+		'Data' : { 'Base-Entry' : newentry.make_bytestring(0).decode() }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 412 and response['Status'] == 'NONCOMPLIANT KEYCARD DATA', \
+		'test_revokeentry: subtest #2: server accepted an entry without a custody signature'
+
+	# Subtest #3: Administrators can revoke a user's keycard. Sessions are limited in how many
+	# login attempts they can make, so a new one is used.
+	conn.send_message({'Action' : "QUIT"})
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+	login_admin(dbdata, conn)
+	conn.send_message({'Action' : "REVOKEENTRY", 'Data' : {}})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 400 and response['Status'] == 'BAD REQUEST', \
+		'test_revokeentry: subtest #3: server revoked without a Workspace-ID'
+
+	conn.send_message({
+		'Action' : "REVOKEENTRY",
+		'Data' : { 'Workspace-ID' : dbdata['user_wid'] }
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Status'] == 'OK' and \
+		response['Data']['Index'] == '2', \
+		"test_revokeentry: subtest #3: failed to revoke user's keycard"
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+def test_orgrotate():
+	'''Tests that ORGROTATE chains a new entry onto the organization's keycard and stores its keys,
+	and that the old encryption key still works for logins during the grace period'''
+
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# password is 'SandstoneAgendaTricycle'
+	dbdata['pwhash'] = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	dbdata['devid'] = '22222222-2222-2222-2222-222222222222'
+	dbdata['devpair'] = EncryptionPair(
+		CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+	init_user(dbdata, conn)
+	conn.send_message({'Action' : "QUIT"})
+
+	# Subtest #1: Regular users can't rotate the organization's keys. Sessions are limited in how
+	# many login attempts they can make, so each login in this test gets a new one.
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+	login_user(dbdata, conn)
+	conn.send_message({'Action' : "ORGROTATE", 'Data' : {}})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'test_orgrotate: subtest #1: server allowed a regular user to rotate the org keys'
+	conn.send_message({'Action' : "QUIT"})
+
+	# Subtest #2: The new entry is chained from the current one
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+	login_admin(dbdata, conn)
+	conn.send_message({'Action' : "ORGROTATE", 'Data' : {}})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 200 and response['Status'] == 'OK' and \
+		response['Data']['Index'] == '3', 'test_orgrotate: subtest #2: failed to rotate org keys'
+	conn.send_message({'Action' : "QUIT"})
+
+	cur = dbconn.cursor()
+	cur.execute("SELECT entry, fingerprint FROM keycards WHERE owner='organization' AND "
+		"index='3';")
+	row = cur.fetchone()
+	assert row and row[1] == response['Data']['Hash'], \
+		'test_orgrotate: subtest #2: new entry was not saved'
+
+	new_entry = keycard.OrgEntry()
+	status = new_entry.set(row[0].encode())
+	assert not status.error(), f"test_orgrotate: subtest #2: bad new entry: {status.info()}"
+	assert new_entry.prev_hash == dbdata['second_org_entry'].hash, \
+		'test_orgrotate: subtest #2: new entry does not follow the current one'
+
+	status = new_entry.verify_chain(dbdata['second_org_entry'])
+	assert not status.error(), \
+		f"test_orgrotate: subtest #2: new entry failed to chain-verify: {status.info()}"
+
+	status = new_entry.verify_signature(
+		CryptoString(new_entry.fields['Primary-Verification-Key']), 'Organization')
+	assert not status.error(), \
+		f"test_orgrotate: subtest #2: new entry's org signature didn't verify: {status.info()}"
+
+	# Subtest #3: The keys for the new entry are stored
+	for field, purpose in [('Primary-Verification-Key', 'sign'), ('Encryption-Key', 'encrypt')]:
+		cur.execute("SELECT pubkey FROM orgkeys WHERE purpose=%s ORDER BY rowid DESC LIMIT 1;",
+			(purpose,))
+		row = cur.fetchone()
+		assert row and row[0] == new_entry.fields[field], \
+			f"test_orgrotate: subtest #3: new {purpose} key was not stored"
+
+	cur.execute("SELECT COUNT(*) FROM orgkeys WHERE purpose='encrypt';")
+	assert cur.fetchone()[0] == 3, \
+		'test_orgrotate: subtest #3: earlier encryption keys were not kept'
+
+	# Subtest #4: Clients which haven't seen the new entry yet can still log in with the old
+	# encryption key during the grace period. login_admin() uses the key in dbdata['oekey'],
+	# which is the one from the entry before the rotation.
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+	login_admin(dbdata, conn)
+	conn.send_message({'Action' : "QUIT"})
+
+	# Subtest #5: Once the new key is older than the grace period, the old one is refused
+	cur.execute("UPDATE orgkeys SET creationtime='2000-01-01 00:00:00' WHERE purpose='encrypt' "
+		"AND pubkey=%s;", (new_entry.fields['Encryption-Key'],))
+	cur.close()
+	dbconn.commit()
+
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+	challenge = b85encode(secrets.token_bytes(32))
+	status = PublicKey(CryptoString(dbdata['oekey'])).encrypt(challenge)
+	assert not status.error(), 'test_orgrotate: subtest #5: failed to encrypt server challenge'
+	conn.send_message({
+		'Action' : "LOGIN",
+		'Data' : {
+			'Workspace-ID' : dbdata['admin_wid'],
+			'Login-Type' : 'PLAIN',
+			'Challenge' : status['data']
+		}
+	})
+	response = conn.read_response(server_response)
+	assert response['Code'] == 306 and response['Status'] == 'KEY FAILURE', \
+		'test_orgrotate: subtest #5: server accepted a retired key after the grace period'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
 if __name__ == '__main__':
 	test_orgcard()
 	test_addentry_usercard()
 	test_iscurrent()
+	test_listexpiring()
+	test_revokeentry()
+	test_orgrotate()
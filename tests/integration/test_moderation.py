@@ -0,0 +1,249 @@
+import json
+
+from pyanselus.cryptostring import CryptoString
+from pyanselus.encryption import EncryptionPair
+from pyanselus.serverconn import ServerConnection
+from integration_setup import load_server_config_file, setup_test, init_server, init_user, \
+	regcode_admin, login_admin, login_user
+
+# password is 'SandstoneAgendaTricycle'
+pwhash = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+			'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+
+def setup_admin():
+	'''Resets the server, logs in as the administrator, and creates the test user. Returns the
+	database connection, server data, and client connection.'''
+
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	dbdata['pwhash'] = pwhash
+	dbdata['devid'] = '22222222-2222-2222-2222-222222222222'
+	dbdata['devpair'] = EncryptionPair(
+		CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+	init_user(dbdata, conn)
+
+	return dbconn, dbdata, conn
+
+
+def get_workspace_status(dbconn, wid: str) -> str:
+	'''Returns the status of a workspace straight from the database'''
+	dbconn.commit()
+	cur = dbconn.cursor()
+	cur.execute("SELECT status FROM workspaces WHERE wid=%s;", (wid,))
+	row = cur.fetchone()
+	cur.close()
+	return row[0] if row else ''
+
+
+def test_register_moderated():
+	'''Tests that REGISTER is held for approval on a moderated server'''
+
+	# This only works when the server is configured for moderated registration
+	serverconfig = load_server_config_file()
+	if serverconfig['global']['registration'] != 'moderated':
+		return
+
+	dbconn, _, conn = setup_admin()
+
+	wid = '77777777-7777-7777-7777-777777777777'
+	conn.send_message({
+		'Action' : "REGISTER",
+		'Data' : {
+			'Workspace-ID' : wid,
+			'Password-Hash' : pwhash,
+			'Device-ID' : '11111111-1111-1111-1111-111111111111',
+			'Device-Key' : 'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 101 and response['Status'] == 'PENDING', \
+		'test_register_moderated(): registration was not held for approval'
+	assert get_workspace_status(dbconn, wid) == 'pending', \
+		'test_register_moderated(): workspace was not marked pending'
+
+	conn.send_message({'Action' : "REGLIST", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and \
+		[item['Workspace-ID'] for item in json.loads(response['Data']['Requests'])] == [wid], \
+		'test_register_moderated(): request missing from queue'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+def test_regqueue():
+	'''Tests REGLIST, REGAPPROVE, and REGREJECT'''
+
+	dbconn, dbdata, conn = setup_admin()
+
+	# Queue a couple of requests as if they had been made while in moderated mode
+	approve_wid = '77777777-7777-7777-7777-777777777777'
+	reject_wid = '88888888-8888-8888-8888-888888888888'
+	cur = dbconn.cursor()
+	for wid, uid in [(approve_wid, 'pending1'), (reject_wid, 'pending2')]:
+		cur.execute("INSERT INTO workspaces(wid, uid, domain, password, status, wtype) "
+			"VALUES(%s, %s, 'example.com', %s, 'pending', 'individual');", (wid, uid, pwhash))
+		cur.execute("INSERT INTO regrequests(wid, requested, status) "
+			"VALUES(%s, NOW(), 'pending');", (wid,))
+	cur.close()
+	dbconn.commit()
+
+	# Subtest #1: List the pending requests
+	conn.send_message({'Action' : "REGLIST", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_regqueue(): subtest #1: failed to list requests'
+	requests = { item['Workspace-ID']: item for item in json.loads(response['Data']['Requests']) }
+	assert len(requests) == 2 and requests[approve_wid]['User-ID'] == 'pending1' and \
+		requests[reject_wid]['User-ID'] == 'pending2', \
+		'test_regqueue(): subtest #1: request list was wrong'
+
+	# Subtest #2: Approve one and reject the other
+	conn.send_message({
+		'Action' : "REGAPPROVE",
+		'Data' : { 'Workspace-ID' : approve_wid }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_regqueue(): subtest #2: failed to approve request'
+	assert get_workspace_status(dbconn, approve_wid) == 'active', \
+		'test_regqueue(): subtest #2: approved workspace was not activated'
+
+	conn.send_message({
+		'Action' : "REGREJECT",
+		'Data' : {
+			'Workspace-ID' : reject_wid,
+			'Reason' : 'Unknown requester'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_regqueue(): subtest #2: failed to reject request'
+	assert get_workspace_status(dbconn, reject_wid) == 'rejected', \
+		'test_regqueue(): subtest #2: rejected workspace was not marked rejected'
+
+	# Subtest #3: Decided requests can't be decided again and are no longer listed
+	conn.send_message({
+		'Action' : "REGAPPROVE",
+		'Data' : { 'Workspace-ID' : reject_wid }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 404 and response['Status'] == 'NOT FOUND', \
+		'test_regqueue(): subtest #3: server approved a rejected request'
+
+	conn.send_message({'Action' : "REGLIST", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and json.loads(response['Data']['Requests']) == [], \
+		'test_regqueue(): subtest #3: decided requests still listed'
+
+	conn.send_message({'Action' : "LOGOUT", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200, 'test_regqueue(): failed to log admin out'
+
+	# Subtest #4: Users without the registration permission can't see the queue
+	login_user(dbdata, conn)
+	conn.send_message({'Action' : "REGLIST", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'test_regqueue(): subtest #4: server allowed a regular user to list requests'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+def request_unregister(dbdata: dict):
+	'''Logs in as the test user and asks to unregister'''
+
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+	login_user(dbdata, conn)
+
+	conn.send_message({
+		'Action' : "UNREGISTER",
+		'Data' : { 'Password-Hash' : dbdata['user_password'].hashstring }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 101 and response['Status'] == 'PENDING', \
+		'request_unregister(): unregistration was not held for approval'
+
+	# Users can't decide their own requests
+	conn.send_message({
+		'Action' : "UNREGAPPROVE",
+		'Data' : { 'Workspace-ID' : dbdata['user_wid'] }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'request_unregister(): user allowed to approve own unregistration'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+def test_unregqueue():
+	'''Tests UNREGLIST, UNREGAPPROVE, and UNREGDECLINE'''
+
+	# Self-unregistration only requires approval on private and moderated servers
+	serverconfig = load_server_config_file()
+	if serverconfig['global']['registration'] not in ['private', 'moderated']:
+		return
+
+	dbconn, dbdata, conn = setup_admin()
+
+	# Subtest #1: A user's request is queued and can be declined
+	request_unregister(dbdata)
+
+	conn.send_message({'Action' : "UNREGLIST", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_unregqueue(): subtest #1: failed to list requests'
+	assert [item['Workspace-ID'] for item in json.loads(response['Data']['Requests'])] == \
+		[dbdata['user_wid']], 'test_unregqueue(): subtest #1: request list was wrong'
+
+	conn.send_message({
+		'Action' : "UNREGDECLINE",
+		'Data' : { 'Workspace-ID' : dbdata['user_wid'] }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_unregqueue(): subtest #1: failed to decline request'
+	assert get_workspace_status(dbconn, dbdata['user_wid']) == 'active', \
+		'test_unregqueue(): subtest #1: declined workspace was not left alone'
+
+	# Subtest #2: A declined request is gone
+	conn.send_message({
+		'Action' : "UNREGAPPROVE",
+		'Data' : { 'Workspace-ID' : dbdata['user_wid'] }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 404 and response['Status'] == 'NOT FOUND', \
+		'test_unregqueue(): subtest #2: server approved a declined request'
+
+	# Subtest #3: Approving a request removes the workspace
+	request_unregister(dbdata)
+
+	conn.send_message({
+		'Action' : "UNREGAPPROVE",
+		'Data' : { 'Workspace-ID' : dbdata['user_wid'] }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_unregqueue(): subtest #3: failed to approve request'
+	assert get_workspace_status(dbconn, dbdata['user_wid']) == 'deleted', \
+		'test_unregqueue(): subtest #3: approved workspace was not removed'
+
+	conn.send_message({'Action' : "UNREGLIST", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and json.loads(response['Data']['Requests']) == [], \
+		'test_unregqueue(): subtest #3: approved request still listed'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+if __name__ == '__main__':
+	test_register_moderated()
+	test_regqueue()
+	test_unregqueue()
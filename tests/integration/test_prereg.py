@@ -203,21 +203,23 @@ def test_getwid():
 	response = conn.read_response(server_response)
 	assert response['Code'] == 200 and response['Status'] == 'OK', \
 		'test_getwid: subtest #1 returned an error'
-	assert response['Data']['Workspace-ID'] == dbdata['support_wid']
+	assert response['Data']['Workspace-ID'] == dbdata['admin_wid'], \
+		'test_getwid: subtest #1 did not resolve alias to its target'
 
 	# Subtest #2: lookup with domain
 	conn.send_message({
 		'Action' : "GETWID",
 		'Data' : {
 			'User-ID' : 'abuse',
-			'Domain' : 'org_domain'
+			'Domain' : dbdata['org_domain']
 		}
 	})
 
 	response = conn.read_response(server_response)
 	assert response['Code'] == 200 and response['Status'] == 'OK', \
 		'test_getwid: subtest #1 returned an error'
-	assert response['Data']['Workspace-ID'] == dbdata['abuse_wid']
+	assert response['Data']['Workspace-ID'] == dbdata['admin_wid'], \
+		'test_getwid: subtest #2 did not resolve alias to its target'
 
 
 if __name__ == '__main__':
@@ -0,0 +1,145 @@
+from pyanselus.cryptostring import CryptoString
+from pyanselus.encryption import EncryptionPair
+from pyanselus.serverconn import ServerConnection
+from integration_setup import setup_test, init_server, init_user, regcode_admin, login_admin, \
+	login_user
+
+def test_roles():
+	'''Tests GRANTROLE, LISTROLES, and REVOKEROLE and the permissions roles grant'''
+
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# password is 'SandstoneAgendaTricycle'
+	pwhash = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	devid = '22222222-2222-2222-2222-222222222222'
+	devpair = EncryptionPair(CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+
+	dbdata['pwhash'] = pwhash
+	dbdata['devid'] = devid
+	dbdata['devpair'] = devpair
+
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+	init_user(dbdata, conn)
+
+	# Subtest #1: Grant a role and list it
+	conn.send_message({
+		'Action' : "GRANTROLE",
+		'Data' : {
+			'Workspace-ID' : dbdata['user_wid'],
+			'Role' : 'moderator'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_roles(): subtest #1: failed to grant role'
+
+	conn.send_message({
+		'Action' : "LISTROLES",
+		'Data' : { 'Workspace-ID' : dbdata['user_wid'] }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Data']['Roles'] == 'moderator', \
+		'test_roles(): subtest #1: granted role not listed'
+
+	# Subtest #2: Roles the server doesn't have can't be granted
+	conn.send_message({
+		'Action' : "GRANTROLE",
+		'Data' : {
+			'Workspace-ID' : dbdata['user_wid'],
+			'Role' : 'overlord'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 400 and response['Status'] == 'BAD REQUEST', \
+		'test_roles(): subtest #2: server granted an unknown role'
+
+	conn.send_message({'Action' : "LOGOUT", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200, 'test_roles(): failed to log admin out'
+
+	# Subtest #3: The role grants its permissions, but nothing else
+	login_user(dbdata, conn)
+	conn.send_message({'Action' : "REGLIST", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_roles(): subtest #3: moderator denied a permission the role grants'
+
+	conn.send_message({
+		'Action' : "GRANTROLE",
+		'Data' : {
+			'Workspace-ID' : dbdata['user_wid'],
+			'Role' : 'admin'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'test_roles(): subtest #3: moderator allowed to grant roles'
+
+	conn.send_message({
+		'Action' : "LISTROLES",
+		'Data' : { 'Workspace-ID' : dbdata['admin_wid'] }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		"test_roles(): subtest #3: moderator allowed to list someone else's roles"
+
+	conn.send_message({'Action' : "LOGOUT", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200, 'test_roles(): failed to log user out'
+
+	# Subtest #4: Revoking the role takes its permissions away. Sessions are limited in how many
+	# login attempts they can make, so a new one is used.
+	conn.send_message({'Action' : "QUIT"})
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+	login_admin(dbdata, conn)
+	conn.send_message({
+		'Action' : "REVOKEROLE",
+		'Data' : {
+			'Workspace-ID' : dbdata['user_wid'],
+			'Role' : 'moderator'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_roles(): subtest #4: failed to revoke role'
+
+	conn.send_message({'Action' : "LOGOUT", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200, 'test_roles(): failed to log admin out'
+
+	conn.send_message({'Action' : "QUIT"})
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+	login_user(dbdata, conn)
+	conn.send_message({'Action' : "REGLIST", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'test_roles(): subtest #4: revoked role still grants permissions'
+
+	# Subtest #5: Permission is checked before the request's fields, and a login before that
+	conn.send_message({'Action' : "RESETPASSWORD", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'test_roles(): subtest #5: fields checked before permission'
+
+	conn.send_message({'Action' : "LOGOUT", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200, 'test_roles(): failed to log user out'
+
+	conn.send_message({'Action' : "RESETPASSWORD", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 401 and response['Status'] == 'UNAUTHORIZED', \
+		'test_roles(): subtest #5: permission checked without a login'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+if __name__ == '__main__':
+	test_roles()
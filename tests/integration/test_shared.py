@@ -0,0 +1,152 @@
+import json
+
+from pyanselus.cryptostring import CryptoString
+from pyanselus.encryption import EncryptionPair
+from pyanselus.serverconn import ServerConnection
+from integration_setup import setup_test, init_server, init_user, regcode_admin, login_admin, \
+	login_user
+
+def test_shared_members():
+	'''Tests ADDMEMBER, LISTMEMBERS, REMOVEMEMBER, and SETROOT with a shared workspace'''
+
+	dbconn = setup_test()
+	dbdata = init_server(dbconn)
+	conn = ServerConnection()
+	assert conn.connect('localhost', 2001), "Connection to server at localhost:2001 failed"
+
+	# password is 'SandstoneAgendaTricycle'
+	pwhash = '$argon2id$v=19$m=65536,t=2,p=1$ew5lqHA5z38za+257DmnTA$0LWVrI2r7XCq' \
+				'dcCYkJLok65qussSyhN5TTZP+OTgzEI'
+	devid = '22222222-2222-2222-2222-222222222222'
+	devpair = EncryptionPair(CryptoString(r'CURVE25519:@X~msiMmBq0nsNnn0%~x{M|NU_{?<Wj)cYybdh&Z'),
+		CryptoString(r'CURVE25519:W30{oJ?w~NBbj{F8Ag4~<bcWy6_uQ{i{X?NDq4^l'))
+
+	dbdata['pwhash'] = pwhash
+	dbdata['devid'] = devid
+	dbdata['devpair'] = devpair
+
+	regcode_admin(dbdata, conn)
+	login_admin(dbdata, conn)
+	init_user(dbdata, conn)
+
+	shared_wid = '44444444-4444-4444-4444-444444444444'
+	conn.send_message({
+		'Action' : "REGISTER",
+		'Data' : {
+			'Workspace-ID' : shared_wid,
+			'Type' : 'shared'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 201 and response['Status'] == 'REGISTERED', \
+		'test_shared_members(): failed to register shared workspace'
+
+	# Subtest #1: Add a member
+	conn.send_message({
+		'Action' : "ADDMEMBER",
+		'Data' : {
+			'Workspace-ID' : shared_wid,
+			'Member-ID' : dbdata['user_wid'],
+			'Permissions' : 'write'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_shared_members(): subtest #1: failed to add member'
+
+	conn.send_message({
+		'Action' : "LISTMEMBERS",
+		'Data' : { 'Workspace-ID' : shared_wid }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_shared_members(): subtest #1: failed to list members'
+	assert json.loads(response['Data']['Members']) == {
+			dbdata['admin_wid'] : 'admin',
+			dbdata['user_wid'] : 'write'
+		}, 'test_shared_members(): subtest #1: member list was wrong'
+
+	# Subtest #2: The last admin can't be demoted or removed
+	conn.send_message({
+		'Action' : "ADDMEMBER",
+		'Data' : {
+			'Workspace-ID' : shared_wid,
+			'Member-ID' : dbdata['admin_wid'],
+			'Permissions' : 'read'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'test_shared_members(): subtest #2: server allowed demoting the last admin'
+
+	conn.send_message({
+		'Action' : "REMOVEMEMBER",
+		'Data' : {
+			'Workspace-ID' : shared_wid,
+			'Member-ID' : dbdata['admin_wid']
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'test_shared_members(): subtest #2: server allowed removing the last admin'
+
+	conn.send_message({'Action' : "LOGOUT", 'Data' : {}})
+	response = conn.read_response(None)
+	assert response['Code'] == 200, 'test_shared_members(): failed to log admin out'
+
+	# Subtest #3: Members who aren't admins can't manage members
+	login_user(dbdata, conn)
+	conn.send_message({
+		'Action' : "ADDMEMBER",
+		'Data' : {
+			'Workspace-ID' : shared_wid,
+			'Member-ID' : dbdata['user_wid'],
+			'Permissions' : 'admin'
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'test_shared_members(): subtest #3: server allowed a non-admin member to manage members'
+
+	# Subtest #4: Members can switch to the shared workspace
+	conn.send_message({
+		'Action' : "SETROOT",
+		'Data' : { 'Workspace-ID' : shared_wid }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_shared_members(): subtest #4: member failed to switch to shared workspace'
+
+	conn.send_message({
+		'Action' : "SETROOT",
+		'Data' : { 'Workspace-ID' : dbdata['user_wid'] }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_shared_members(): subtest #4: member failed to switch back to own workspace'
+
+	# Subtest #5: Members can leave on their own, after which they lose access
+	conn.send_message({
+		'Action' : "REMOVEMEMBER",
+		'Data' : {
+			'Workspace-ID' : shared_wid,
+			'Member-ID' : dbdata['user_wid']
+		}
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 200 and response['Status'] == 'OK', \
+		'test_shared_members(): subtest #5: member failed to leave shared workspace'
+
+	conn.send_message({
+		'Action' : "SETROOT",
+		'Data' : { 'Workspace-ID' : shared_wid }
+	})
+	response = conn.read_response(None)
+	assert response['Code'] == 403 and response['Status'] == 'FORBIDDEN', \
+		'test_shared_members(): subtest #5: former member switched to shared workspace'
+
+	conn.send_message({'Action' : "QUIT"})
+
+
+if __name__ == '__main__':
+	test_shared_members()
@@ -1,6 +1,7 @@
 package anselusd
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/darkwyrm/anselusd/cryptostring"
@@ -46,3 +47,27 @@ func TestEZCryptSignVerify(t *testing.T) {
 		t.Fatal("SigningPair.Verify() failed")
 	}
 }
+
+func TestEZCryptHashData(t *testing.T) {
+	testData := "This is some hashing test data"
+
+	hash, err := ezcrypt.HashData("BLAKE2B-256", strings.NewReader(testData))
+	if err != nil || !hash.IsValid() || hash.Prefix != "BLAKE2B-256" {
+		t.Fatal("ezcrypt.HashData() failed")
+	}
+
+	verified, err := ezcrypt.VerifyHash(hash, strings.NewReader(testData))
+	if err != nil || !verified {
+		t.Fatal("ezcrypt.VerifyHash() failed to verify matching data")
+	}
+
+	verified, err = ezcrypt.VerifyHash(hash, strings.NewReader("Some other data"))
+	if err != nil || verified {
+		t.Fatal("ezcrypt.VerifyHash() verified mismatched data")
+	}
+
+	_, err = ezcrypt.HashData("MD5", strings.NewReader(testData))
+	if err == nil {
+		t.Fatal("ezcrypt.HashData() accepted an unsupported algorithm")
+	}
+}
@@ -110,7 +110,7 @@ func TestEntrySize(t *testing.T) {
 			t.Fatal("BenchmarkEntrySize: compliance check failure on new entry\n")
 		}
 
-		verified, err = newEntry.VerifyChain(entry)
+		verified, err = newEntry.VerifyChain(entry, cryptostring.CryptoString{})
 		if !verified {
 			t.Fatalf("BenchmarkEntrySize: chain verify failure: %s\n", err)
 		}
@@ -487,10 +487,77 @@ func TestOrgChain(t *testing.T) {
 		t.Fatal("TestOrgChain: compliance check failure on new entry\n")
 	}
 
-	verified, err = newEntry.VerifyChain(entry)
+	verified, err = newEntry.VerifyChain(entry, cryptostring.CryptoString{})
 	if !verified {
 		t.Fatalf("TestOrgChain: chain verify failure: %s\n", err)
 	}
+
+	card := keycard.Keycard{Type: "Organization", Entries: []keycard.Entry{*entry, *newEntry}}
+	verified, err = card.VerifyChain(cryptostring.CryptoString{})
+	if !verified {
+		t.Fatalf("TestOrgChain: keycard chain verify failure: %s\n", err)
+	}
+}
+
+func TestOrgChainRequiredOnly(t *testing.T) {
+	entry := keycard.NewOrgEntry()
+	var orgSigningKey cryptostring.CryptoString
+
+	err := orgSigningKey.Set("ED25519:msvXw(nII<Qm6oBHc+92xwRI3>VFF-RcZ=7DEu3|")
+	if err != nil {
+		t.Fatalf("TestOrgChainRequiredOnly: org signing key decoding failure: %s\n", err)
+	}
+
+	entry.SetFields(map[string]string{
+		"Name":                       "Acme, Inc.",
+		"Contact-Admin":              "ae406c5e-2673-4d3e-af20-91325d9623ca/acme.com",
+		"Language":                   "en",
+		"Primary-Verification-Key":   "ED25519:)8id(gE02^S<{3H>9B;X4{DuYcb`%wo^mC&1lN88",
+		"Secondary-Verification-Key": "ED25519:)8id(gE02^S<{3H>9B;X4{DuYcb`%wo^mC&1lN88",
+		"Encryption-Key":             "CURVE25519:@b?cjpeY;<&y+LSOA&yUQ&ZIrp(JGt{W$*V>ATLG",
+		"Time-To-Live":               "14",
+		"Expires":                    "20201002",
+		"Timestamp":                  "20200901T131313Z"})
+
+	err = entry.GenerateHash("BLAKE2B-256")
+	if err != nil {
+		t.Fatalf("TestOrgChainRequiredOnly: hashing failure: %s\n", err)
+	}
+	err = entry.Sign(orgSigningKey, "Organization")
+	if err != nil {
+		t.Fatalf("TestOrgChainRequiredOnly: org signing failure: %s\n", err)
+	}
+
+	// Rotating only the required keys leaves the secondary verification key alone
+	newEntry, newKeys, err := entry.Chain(orgSigningKey, false)
+	if err != nil {
+		t.Fatalf("TestOrgChainRequiredOnly: chain failure error: %s\n", err)
+	}
+
+	if _, exists := newKeys["Secondary-Verification-Key.public"]; exists {
+		t.Fatal("TestOrgChainRequiredOnly: chain rotated an optional key\n")
+	}
+	if newEntry.Fields["Secondary-Verification-Key"] !=
+		entry.Fields["Secondary-Verification-Key"] {
+		t.Fatal("TestOrgChainRequiredOnly: chain didn't keep the secondary verification key\n")
+	}
+	if newEntry.Fields["Encryption-Key"] == entry.Fields["Encryption-Key"] {
+		t.Fatal("TestOrgChainRequiredOnly: chain didn't rotate the encryption key\n")
+	}
+
+	// The chained entry has its own dates and is linked to the previous one
+	if newEntry.Fields["Expires"] == entry.Fields["Expires"] ||
+		newEntry.Fields["Timestamp"] == entry.Fields["Timestamp"] {
+		t.Fatal("TestOrgChainRequiredOnly: chain copied the previous entry's dates\n")
+	}
+	if newEntry.PrevHash != entry.Hash {
+		t.Fatal("TestOrgChainRequiredOnly: chain didn't set the previous hash\n")
+	}
+
+	verified, err := newEntry.VerifyChain(entry, cryptostring.CryptoString{})
+	if !verified {
+		t.Fatalf("TestOrgChainRequiredOnly: chain verify failure: %s\n", err)
+	}
 }
 
 func TestUserChain(t *testing.T) {
@@ -613,7 +680,7 @@ func TestUserChain(t *testing.T) {
 		t.Fatal("TestUserChain: compliance check failure on new entry\n")
 	}
 
-	verified, err = newEntry.VerifyChain(entry)
+	verified, err = newEntry.VerifyChain(entry, cryptostring.CryptoString{})
 	if !verified {
 		t.Fatalf("TestUserChain: chain verify failure: %s\n", err)
 	}
@@ -973,3 +1040,160 @@ func TestIsTimestampValid(t *testing.T) {
 		t.Fatal("TestIsTimestampValid: IsTimestampValid passed a failing timestamp\n")
 	}
 }
+
+func TestUserRevocation(t *testing.T) {
+	var signingKey, orgSigningKey, orgVerifyKey cryptostring.CryptoString
+
+	err := signingKey.Set("ED25519:p;XXU0XF#UO^}vKbC-wS(#5W6=OEIFmR2z`rS1j+")
+	if err != nil {
+		t.Fatalf("TestUserRevocation: signing key decoding failure: %s\n", err)
+	}
+
+	err = orgSigningKey.Set("ED25519:msvXw(nII<Qm6oBHc+92xwRI3>VFF-RcZ=7DEu3|")
+	if err != nil {
+		t.Fatalf("TestUserRevocation: org signing key decoding failure: %s\n", err)
+	}
+
+	err = orgVerifyKey.Set("ED25519:)8id(gE02^S<{3H>9B;X4{DuYcb`%wo^mC&1lN88")
+	if err != nil {
+		t.Fatalf("TestUserRevocation: org verification key decoding failure: %s\n", err)
+	}
+
+	entry := keycard.NewUserEntry()
+	entry.SetFields(map[string]string{
+		"Workspace-ID":                     "4418bf6c-000b-4bb3-8111-316e72030468",
+		"Domain":                           "example.com",
+		"Contact-Request-Verification-Key": "ED25519:d0-oQb;{QxwnO{=!|^62+E=UYk2Y3mr2?XKScF4D",
+		"Contact-Request-Encryption-Key":   "CURVE25519:j(IBzX*F%OZF;g77O8jrVjM1a`Y<6-ehe{S;{gph",
+		"Public-Encryption-Key":            "CURVE25519:nSRso=K(WF{P+4x5S*5?Da-rseY-^>S8VN#v+)IN",
+		"Time-To-Live":                     "30",
+		"Expires":                          "20201002",
+		"Timestamp":                        "20200901T131313Z"})
+	err = entry.Sign(orgSigningKey, "Organization")
+	if err != nil {
+		t.Fatalf("TestUserRevocation: org signing failure: %s\n", err)
+	}
+	err = entry.GenerateHash("BLAKE2B-256")
+	if err != nil {
+		t.Fatalf("TestUserRevocation: hashing failure: %s\n", err)
+	}
+	err = entry.Sign(signingKey, "User")
+	if err != nil {
+		t.Fatalf("TestUserRevocation: user signing failure: %s\n", err)
+	}
+
+	// The revocation is linked to the entry it revokes and signed by the organization
+	revocation := keycard.NewRevocationEntry()
+	revocation.SetFields(map[string]string{
+		"Index":        "2",
+		"Workspace-ID": entry.Fields["Workspace-ID"],
+		"Domain":       entry.Fields["Domain"]})
+	revocation.PrevHash = entry.Hash
+	err = revocation.GenerateHash("BLAKE2B-256")
+	if err != nil {
+		t.Fatalf("TestUserRevocation: revocation hashing failure: %s\n", err)
+	}
+	err = revocation.Sign(orgSigningKey, "Organization")
+	if err != nil {
+		t.Fatalf("TestUserRevocation: revocation signing failure: %s\n", err)
+	}
+	if !revocation.IsCompliant() {
+		t.Fatal("TestUserRevocation: compliance check failed a compliant revocation\n")
+	}
+
+	copied, err := keycard.NewEntryFromData(string(revocation.MakeByteString(-1)))
+	if err != nil {
+		t.Fatalf("TestUserRevocation: failed to create revocation from data: %s\n", err)
+	}
+	if copied.Type != "Revocation" || copied.Hash != revocation.Hash || !copied.IsCompliant() {
+		t.Fatal("TestUserRevocation: revocation didn't survive conversion to and from data\n")
+	}
+
+	// Revocations are only signed by the organization
+	_, err = keycard.NewEntryFromData(string(revocation.MakeByteString(-1)) +
+		"User-Signature:" + revocation.Signatures["Organization"] + "\r\n")
+	if err == nil {
+		t.Fatal("TestUserRevocation: created a revocation from bad data\n")
+	}
+
+	verified, err := revocation.VerifyChain(entry, orgVerifyKey)
+	if !verified {
+		t.Fatalf("TestUserRevocation: revocation chain verify failure: %s\n", err)
+	}
+
+	// The entry after a revocation has no custody signature because it starts a new chain
+	newEntry := keycard.NewUserEntry()
+	newEntry.SetFields(entry.Fields)
+	newEntry.Fields["Index"] = "3"
+	newEntry.PrevHash = revocation.Hash
+	err = newEntry.Sign(orgSigningKey, "Organization")
+	if err != nil {
+		t.Fatalf("TestUserRevocation: org signing failure: %s\n", err)
+	}
+	err = newEntry.GenerateHash("BLAKE2B-256")
+	if err != nil {
+		t.Fatalf("TestUserRevocation: hashing failure: %s\n", err)
+	}
+
+	verified, err = newEntry.VerifyChain(revocation, orgVerifyKey)
+	if !verified {
+		t.Fatalf("TestUserRevocation: restarted chain verify failure: %s\n", err)
+	}
+
+	card := keycard.Keycard{Type: "User", Entries: []keycard.Entry{*entry, *revocation, *newEntry}}
+	verified, err = card.VerifyChain(orgVerifyKey)
+	if !verified {
+		t.Fatalf("TestUserRevocation: keycard chain verify failure: %s\n", err)
+	}
+
+	// Revocations can't be verified without the organization's key
+	verified, _ = card.VerifyChain(cryptostring.CryptoString{})
+	if verified {
+		t.Fatal("TestUserRevocation: keycard chain verify passed without an org key\n")
+	}
+
+	// A revocation signed by anyone other than the organization breaks the chain
+	forged := keycard.NewRevocationEntry()
+	forged.SetFields(revocation.Fields)
+	forged.PrevHash = entry.Hash
+	err = forged.GenerateHash("BLAKE2B-256")
+	if err != nil {
+		t.Fatalf("TestUserRevocation: forged revocation hashing failure: %s\n", err)
+	}
+
+	card.Entries[1] = *forged
+	verified, _ = card.VerifyChain(orgVerifyKey)
+	if verified {
+		t.Fatal("TestUserRevocation: keycard chain verify passed an unsigned revocation\n")
+	}
+
+	err = forged.Sign(signingKey, "Organization")
+	if err != nil {
+		t.Fatalf("TestUserRevocation: forged revocation signing failure: %s\n", err)
+	}
+	card.Entries[1] = *forged
+	verified, _ = card.VerifyChain(orgVerifyKey)
+	if verified {
+		t.Fatal("TestUserRevocation: keycard chain verify passed a wrongly signed revocation\n")
+	}
+
+	// Changing a revocation after it was signed also breaks the chain
+	altered := keycard.NewRevocationEntry()
+	altered.SetFields(revocation.Fields)
+	altered.Fields["Domain"] = "example.net"
+	altered.PrevHash = revocation.PrevHash
+	altered.Hash = revocation.Hash
+	altered.Signatures["Organization"] = revocation.Signatures["Organization"]
+	card.Entries[1] = *altered
+	verified, _ = card.VerifyChain(orgVerifyKey)
+	if verified {
+		t.Fatal("TestUserRevocation: keycard chain verify passed an altered revocation\n")
+	}
+
+	// A revocation which isn't linked to the previous entry breaks the chain
+	revocation.PrevHash = newEntry.Hash
+	verified, _ = revocation.VerifyChain(entry, orgVerifyKey)
+	if verified {
+		t.Fatal("TestUserRevocation: chain verify passed an unlinked revocation\n")
+	}
+}
@@ -380,7 +380,8 @@ rows = cur.fetchall()
 if rows[0][0] is False:
 	cur.execute("CREATE TABLE iwkspc_devices(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL, "
 				"devid CHAR(36) NOT NULL, devkey VARCHAR(1000) NOT NULL, "
-				"status VARCHAR(16) NOT NULL);")
+				"status VARCHAR(16) NOT NULL, source VARCHAR(48), label VARCHAR(64), "
+				"lastseen TIMESTAMP, UNIQUE(wid, devid));")
 
 
 cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
@@ -427,7 +428,8 @@ rows = cur.fetchall()
 if rows[0][0] is False:
 	cur.execute("CREATE TABLE keycards(rowid SERIAL PRIMARY KEY, owner VARCHAR(292) NOT NULL, "
 				"creationtime TIMESTAMP NOT NULL, index INTEGER NOT NULL, "
-				"entry VARCHAR(8192) NOT NULL, fingerprint VARCHAR(96) NOT NULL);")
+				"entry VARCHAR(8192) NOT NULL, fingerprint VARCHAR(96) NOT NULL, "
+				"UNIQUE(owner, index));")
 
 
 cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
@@ -440,6 +442,75 @@ if rows[0][0] is False:
 				"purpose VARCHAR(8) NOT NULL, fingerprint VARCHAR(96) NOT NULL);")
 
 
+cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
+			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'deliveryqueue' "
+			"AND c.relkind = 'r');")
+rows = cur.fetchall()
+if rows[0][0] is False:
+	cur.execute("CREATE TABLE deliveryqueue(rowid SERIAL PRIMARY KEY, id CHAR(36) NOT NULL UNIQUE, "
+				"sender CHAR(36) NOT NULL, domain VARCHAR(255) NOT NULL, "
+				"recipients VARCHAR(8192) NOT NULL, tempname VARCHAR(64) NOT NULL, "
+				"size BIGINT NOT NULL, hash VARCHAR(128) NOT NULL, attempts INTEGER NOT NULL, "
+				"created TIMESTAMP NOT NULL, nextattempt TIMESTAMP NOT NULL, "
+				"lasterror VARCHAR(1024));")
+
+
+cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
+			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'remoteorgs' "
+			"AND c.relkind = 'r');")
+rows = cur.fetchall()
+if rows[0][0] is False:
+	cur.execute("CREATE TABLE remoteorgs(rowid SERIAL PRIMARY KEY, "
+				"domain VARCHAR(255) NOT NULL UNIQUE, roothash VARCHAR(128) NOT NULL, "
+				"firstseen TIMESTAMP NOT NULL);")
+
+
+cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
+			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'shared_members' "
+			"AND c.relkind = 'r');")
+rows = cur.fetchall()
+if rows[0][0] is False:
+	cur.execute("CREATE TABLE shared_members(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL, "
+				"member CHAR(36) NOT NULL, permissions VARCHAR(16) NOT NULL, UNIQUE(wid, member));")
+
+
+cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
+			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'regrequests' "
+			"AND c.relkind = 'r');")
+rows = cur.fetchall()
+if rows[0][0] is False:
+	cur.execute("CREATE TABLE regrequests(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL UNIQUE, "
+				"requested TIMESTAMP NOT NULL, status VARCHAR(16) NOT NULL, reason VARCHAR(1024));")
+
+
+cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
+			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'roles' "
+			"AND c.relkind = 'r');")
+rows = cur.fetchall()
+if rows[0][0] is False:
+	cur.execute("CREATE TABLE roles(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL, "
+				"role VARCHAR(32) NOT NULL, UNIQUE(wid, role));")
+
+
+cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
+			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'unregrequests' "
+			"AND c.relkind = 'r');")
+rows = cur.fetchall()
+if rows[0][0] is False:
+	cur.execute("CREATE TABLE unregrequests(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL UNIQUE, "
+				"requested TIMESTAMP NOT NULL);")
+
+
+cur.execute("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON "
+			"n.oid = c.relnamespace WHERE n.nspname = 'public' AND c.relname = 'expirynotices' "
+			"AND c.relkind = 'r');")
+rows = cur.fetchall()
+if rows[0][0] is False:
+	cur.execute("CREATE TABLE expirynotices(rowid SERIAL PRIMARY KEY, owner VARCHAR(292) NOT NULL, "
+				"index INTEGER NOT NULL, kind VARCHAR(16) NOT NULL, sent TIMESTAMP NOT NULL, "
+				"UNIQUE(owner, index, kind));")
+
+
 # create the org's keys and put them in the table
 
 ekey = dict()
@@ -0,0 +1,66 @@
+-- Brings the database of an existing installation up to date with the current schema. Unlike
+-- psql_schema.sql, this keeps existing data, aside from anything which breaks a new constraint,
+-- and can safely be run more than once:
+--
+--	psql -h 127.0.0.1 -U anselus -d anselus -f upgrade_schema.sql
+
+-- Messages waiting to be delivered to other servers
+CREATE TABLE IF NOT EXISTS deliveryqueue(rowid SERIAL PRIMARY KEY, id CHAR(36) NOT NULL UNIQUE,
+	sender CHAR(36) NOT NULL, domain VARCHAR(255) NOT NULL, recipients VARCHAR(8192) NOT NULL,
+	tempname VARCHAR(64) NOT NULL, size BIGINT NOT NULL, hash VARCHAR(128) NOT NULL,
+	attempts INTEGER NOT NULL, created TIMESTAMP NOT NULL, nextattempt TIMESTAMP NOT NULL,
+	lasterror VARCHAR(1024));
+
+-- Members of shared workspaces
+CREATE TABLE IF NOT EXISTS shared_members(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL,
+	member CHAR(36) NOT NULL, permissions VARCHAR(16) NOT NULL, UNIQUE(wid, member));
+
+-- The address a pending device connected from
+ALTER TABLE iwkspc_devices ADD COLUMN IF NOT EXISTS source VARCHAR(48);
+
+-- Names for devices chosen by their users and the time each device last logged in
+ALTER TABLE iwkspc_devices ADD COLUMN IF NOT EXISTS label VARCHAR(64);
+ALTER TABLE iwkspc_devices ADD COLUMN IF NOT EXISTS lastseen TIMESTAMP;
+
+-- Registration requests made while the server is in moderated mode
+CREATE TABLE IF NOT EXISTS regrequests(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL UNIQUE,
+	requested TIMESTAMP NOT NULL, status VARCHAR(16) NOT NULL, reason VARCHAR(1024));
+
+-- Roles granted to workspaces
+CREATE TABLE IF NOT EXISTS roles(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL,
+	role VARCHAR(32) NOT NULL, UNIQUE(wid, role));
+
+-- Requests from users to remove their own workspaces
+CREATE TABLE IF NOT EXISTS unregrequests(rowid SERIAL PRIMARY KEY, wid CHAR(36) NOT NULL UNIQUE,
+	requested TIMESTAMP NOT NULL);
+
+-- Keycard entry indexes are unique for each owner so that concurrent updates can't fork a
+-- keycard. PostgreSQL can't add a constraint only if it's missing, so the check is done by hand.
+DO $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname='keycards_owner_index_key') THEN
+		ALTER TABLE keycards ADD CONSTRAINT keycards_owner_index_key UNIQUE(owner, index);
+	END IF;
+END $$;
+
+-- Keycard expiration notices which have already been sent
+CREATE TABLE IF NOT EXISTS expirynotices(rowid SERIAL PRIMARY KEY, owner VARCHAR(292) NOT NULL,
+	index INTEGER NOT NULL, kind VARCHAR(16) NOT NULL, sent TIMESTAMP NOT NULL,
+	UNIQUE(owner, index, kind));
+
+-- A workspace can only have one device with a given ID. Requests which reuse the ID of another
+-- device can only have come from a device trying to take its place, so they are dropped.
+DO $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname='iwkspc_devices_wid_devid_key') THEN
+		DELETE FROM iwkspc_devices d WHERE status='pending' AND EXISTS (SELECT 1 FROM
+			iwkspc_devices o WHERE o.wid=d.wid AND o.devid=d.devid AND o.rowid<>d.rowid AND
+			(o.status<>'pending' OR o.rowid<d.rowid));
+		ALTER TABLE iwkspc_devices ADD CONSTRAINT iwkspc_devices_wid_devid_key UNIQUE(wid, devid);
+	END IF;
+END $$;
+
+-- The root keycard entry of each organization this server has delivered to
+CREATE TABLE IF NOT EXISTS remoteorgs(rowid SERIAL PRIMARY KEY,
+	domain VARCHAR(255) NOT NULL UNIQUE, roothash VARCHAR(128) NOT NULL,
+	firstseen TIMESTAMP NOT NULL);